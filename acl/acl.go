@@ -0,0 +1,152 @@
+// Package acl decides which clients may use the DNS, TUI and API listeners.
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"dnsplane/config"
+	"dnsplane/ipvalidator"
+)
+
+// Modes lists the supported access control modes.
+var Modes = []string{config.ACLModeAllow, config.ACLModeAllowListOnly, config.ACLModeLocalOnly}
+
+// NormalizeMode returns mode in lower case with the old name deny replaced by
+// allow-list-only.
+func NormalizeMode(mode string) string {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if mode == config.ACLModeDeny {
+		return config.ACLModeAllowListOnly
+	}
+	return mode
+}
+
+// IsValidMode reports whether mode is one of Modes.
+func IsValidMode(mode string) bool {
+	for _, m := range Modes {
+		if mode == m {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL is a compiled access control list. It is never modified after New, so
+// it can be used by any number of listeners while a new one is being built.
+// A nil ACL allows every client.
+type ACL struct {
+	mode  string
+	allow ipvalidator.Ranges
+	deny  ipvalidator.Ranges
+}
+
+// New compiles settings. Invalid entries are left out and reported in the
+// returned error. An invalid mode is reported too and falls back to
+// allow-local-only, so a typo never opens a listener to everyone.
+func New(settings config.ACL) (*ACL, error) {
+	var errs []error
+	acl := &ACL{mode: NormalizeMode(settings.Mode)}
+	if !IsValidMode(acl.mode) {
+		errs = append(errs, fmt.Errorf("invalid mode %q (use %s)", settings.Mode, strings.Join(Modes, ", ")))
+		acl.mode = config.ACLModeLocalOnly
+	}
+	var err error
+	if acl.allow, err = ipvalidator.ParseRanges(settings.Allow); err != nil {
+		errs = append(errs, fmt.Errorf("allow: %w", err))
+	}
+	if acl.deny, err = ipvalidator.ParseRanges(settings.Deny); err != nil {
+		errs = append(errs, fmt.Errorf("deny: %w", err))
+	}
+	return acl, errors.Join(errs...)
+}
+
+// Allowed reports whether the client at addr may use the listener. The allow
+// list takes precedence over the deny list, so a narrow allow entry can make
+// an exception to a broad deny entry.
+func (a *ACL) Allowed(addr netip.Addr) bool {
+	if a == nil {
+		return true
+	}
+	addr = addr.Unmap()
+	switch {
+	case a.allow.Contains(addr):
+		return true
+	case a.deny.Contains(addr):
+		return false
+	case a.mode == config.ACLModeAllowListOnly:
+		return false
+	case a.mode == config.ACLModeLocalOnly:
+		return IsLocal(addr)
+	}
+	return true
+}
+
+// AllowedAddr is Allowed for a connection's remote address. Clients without
+// an IP address, such as those on a UNIX socket, are always allowed.
+func (a *ACL) AllowedAddr(addr net.Addr) bool {
+	ip, ok := ClientIP(addr)
+	if !ok {
+		return true
+	}
+	return a.Allowed(ip)
+}
+
+// IsLocal reports whether addr is a loopback, private or link-local address.
+func IsLocal(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast()
+}
+
+// ClientIP returns the IP address of a remote address, or false when it has
+// none.
+func ClientIP(addr net.Addr) (netip.Addr, bool) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, ok := netip.AddrFromSlice(a.IP)
+		return ip.Unmap(), ok
+	case *net.TCPAddr:
+		ip, ok := netip.AddrFromSlice(a.IP)
+		return ip.Unmap(), ok
+	case nil:
+		return netip.Addr{}, false
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
+
+// Set holds the access control lists of the listeners.
+type Set struct {
+	DNS *ACL
+	TUI *ACL
+	API *ACL
+}
+
+// NewSet compiles the access control lists of every listener. Errors are
+// prefixed with the listener they belong to.
+func NewSet(settings config.ACLSettings) (*Set, error) {
+	set := &Set{}
+	var errs []error
+	for _, entry := range []struct {
+		name     string
+		settings config.ACL
+		acl      **ACL
+	}{
+		{"dns", settings.DNS, &set.DNS},
+		{"tui", settings.TUI, &set.TUI},
+		{"api", settings.API, &set.API},
+	} {
+		acl, err := New(entry.settings)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", entry.name, err))
+		}
+		*entry.acl = acl
+	}
+	return set, errors.Join(errs...)
+}
@@ -0,0 +1,87 @@
+package acl
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"dnsplane/config"
+)
+
+func TestAllowed(t *testing.T) {
+	lists := map[string]config.ACL{
+		"allow":            {Mode: config.ACLModeAllow, Deny: []string{"192.0.2.0/24"}, Allow: []string{"192.0.2.53"}},
+		"allow-list-only":  {Mode: config.ACLModeAllowListOnly, Allow: []string{"198.51.100.0/24", "::ffff:203.0.113.0/120"}},
+		"deny alias":       {Mode: config.ACLModeDeny, Allow: []string{"198.51.100.0/24"}},
+		"allow-local-only": {Mode: config.ACLModeLocalOnly, Deny: []string{"10.9.0.0/16"}},
+		"invalid mode":     {Mode: "open"},
+	}
+	tests := []struct {
+		list string
+		addr string
+		want bool
+	}{
+		{list: "allow", addr: "203.0.113.1", want: true},
+		{list: "allow", addr: "192.0.2.1", want: false},
+		{list: "allow", addr: "192.0.2.53", want: true},
+		{list: "allow", addr: "::ffff:192.0.2.1", want: false},
+		{list: "allow-list-only", addr: "198.51.100.7", want: true},
+		{list: "allow-list-only", addr: "203.0.113.9", want: true},
+		{list: "allow-list-only", addr: "127.0.0.1", want: false},
+		{list: "deny alias", addr: "198.51.100.7", want: true},
+		{list: "deny alias", addr: "192.168.1.1", want: false},
+		{list: "allow-local-only", addr: "127.0.0.1", want: true},
+		{list: "allow-local-only", addr: "192.168.1.1", want: true},
+		{list: "allow-local-only", addr: "fe80::1", want: true},
+		{list: "allow-local-only", addr: "10.9.1.1", want: false},
+		{list: "allow-local-only", addr: "8.8.8.8", want: false},
+		{list: "invalid mode", addr: "8.8.8.8", want: false},
+		{list: "invalid mode", addr: "10.0.0.1", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.list+" "+tt.addr, func(t *testing.T) {
+			acl, _ := New(lists[tt.list])
+			if got := acl.Allowed(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("Allowed(%s) = %t, want %t", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewReportsInvalidSettings(t *testing.T) {
+	if _, err := New(config.ACL{Mode: config.ACLModeDeny}); err != nil {
+		t.Errorf("deny alias rejected: %v", err)
+	}
+	if _, err := New(config.ACL{Mode: "open"}); err == nil {
+		t.Error("invalid mode not reported")
+	}
+	acl, err := New(config.ACL{Mode: config.ACLModeAllow, Deny: []string{"bogus", "192.0.2.0/24"}})
+	if err == nil {
+		t.Error("invalid entry not reported")
+	}
+	if acl.Allowed(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("valid entry next to an invalid one was dropped")
+	}
+}
+
+func TestAllowedAddr(t *testing.T) {
+	acl, _ := New(config.ACL{Mode: config.ACLModeAllowListOnly})
+	var nilACL *ACL
+	if !nilACL.AllowedAddr(&net.UDPAddr{IP: net.ParseIP("192.0.2.1")}) {
+		t.Error("nil ACL refused a client")
+	}
+	if acl.AllowedAddr(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4000}) {
+		t.Error("client outside the allow list was served")
+	}
+	if !acl.AllowedAddr(&net.UnixAddr{Name: "/tmp/dnsplane.socket", Net: "unix"}) {
+		t.Error("UNIX socket client was refused")
+	}
+}
+
+func TestNormalizeMode(t *testing.T) {
+	for input, want := range map[string]string{"Deny": config.ACLModeAllowListOnly, " allow ": config.ACLModeAllow, "ALLOW-LOCAL-ONLY": config.ACLModeLocalOnly} {
+		if got := NormalizeMode(input); got != want {
+			t.Errorf("NormalizeMode(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
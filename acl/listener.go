@@ -0,0 +1,36 @@
+package acl
+
+import "net"
+
+// Listener wraps a net.Listener and closes connections from clients that are
+// not allowed before they are returned by Accept.
+type Listener struct {
+	net.Listener
+	acl    func() *ACL
+	denied func(net.Addr)
+}
+
+// NewListener returns a listener that checks every connection accepted by
+// inner against the list returned by acl, so changes to the settings apply
+// to new connections right away. denied, if not nil, is called with the
+// address of every refused client.
+func NewListener(inner net.Listener, acl func() *ACL, denied func(net.Addr)) *Listener {
+	return &Listener{Listener: inner, acl: acl, denied: denied}
+}
+
+// Accept waits for the next connection from an allowed client.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.acl().AllowedAddr(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		if l.denied != nil {
+			l.denied(conn.RemoteAddr())
+		}
+		_ = conn.Close()
+	}
+}
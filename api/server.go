@@ -4,15 +4,32 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"strings"
 
+	"dnsplane/acl"
+	"dnsplane/blocklist"
+	"dnsplane/config"
 	"dnsplane/daemon"
 	"dnsplane/data"
 	"dnsplane/dnsrecords"
+	"dnsplane/dnsservers"
+	"dnsplane/policy"
+	"dnsplane/rpz"
 
 	"github.com/gin-gonic/gin"
 )
 
+// dnsQueryHandler serves DNS-over-HTTPS on the API when registered.
+var dnsQueryHandler http.Handler
+
+// RegisterDNSQueryHandler sets the DNS-over-HTTPS handler exposed at
+// /dns-query when the doh.on_api setting is enabled.
+func RegisterDNSQueryHandler(handler http.Handler) {
+	dnsQueryHandler = handler
+}
+
 // RouteRegistrar registers HTTP routes on the supplied Gin engine.
 type RouteRegistrar func(*gin.Engine)
 
@@ -44,7 +61,17 @@ func Start(state *daemon.State, port string, registrar RouteRegistrar) {
 		router := gin.Default()
 		registrar(router)
 
-		if err := router.Run(fmt.Sprintf(":%s", trimmed)); err != nil {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%s", trimmed))
+		if err != nil {
+			log.Printf("api: server stopped with error: %v", err)
+			return
+		}
+		apiACL := func() *acl.ACL { return data.GetInstance().GetACL().API }
+		listener = acl.NewListener(listener, apiACL, func(addr net.Addr) {
+			data.GetInstance().IncrementACLDenials()
+			log.Printf("ACL: refused API connection from %s", addr)
+		})
+		if err := router.RunListener(listener); err != nil {
 			log.Printf("api: server stopped with error: %v", err)
 		}
 	}()
@@ -57,6 +84,27 @@ func RegisterDNSRoutes(router *gin.Engine) {
 	}
 	router.GET("/dns/records", listRecordsHandler)
 	router.POST("/dns/records", addRecordHandler)
+	router.GET("/dns/routes", listRoutesHandler)
+	router.POST("/dns/routes", addRouteHandler)
+	router.DELETE("/dns/routes", removeRouteHandler)
+	router.GET("/blocklist", listBlocklistHandler)
+	router.POST("/blocklist", addBlocklistHandler)
+	router.DELETE("/blocklist", removeBlocklistHandler)
+	router.POST("/blocklist/reload", reloadBlocklistHandler)
+	router.POST("/blocklist/refresh", refreshBlocklistHandler)
+	router.GET("/policy", listPolicyHandler)
+	router.POST("/policy", addPolicyHandler)
+	router.DELETE("/policy", removePolicyHandler)
+	router.POST("/policy/test", testPolicyHandler)
+	router.GET("/rpz", listRPZHandler)
+	router.POST("/rpz", addRPZHandler)
+	router.DELETE("/rpz", removeRPZHandler)
+	router.POST("/rpz/reload", reloadRPZHandler)
+	router.POST("/rpz/refresh", refreshRPZHandler)
+	if dnsQueryHandler != nil && data.GetInstance().GetResolverSettings().DoH.OnAPI {
+		router.GET("/dns-query", gin.WrapH(dnsQueryHandler))
+		router.POST("/dns-query", gin.WrapH(dnsQueryHandler))
+	}
 }
 
 func addRecordHandler(c *gin.Context) {
@@ -100,6 +148,251 @@ func listRecordsHandler(c *gin.Context) {
 	c.JSON(200, resp)
 }
 
+func listRoutesHandler(c *gin.Context) {
+	result := dnsservers.ListRoutes(data.GetInstance().GetServers())
+	c.JSON(200, gin.H{"routes": result.Routes})
+}
+
+func addRouteHandler(c *gin.Context) {
+	updateRoutes(c, dnsservers.AddRoute, 201, "route added")
+}
+
+func removeRouteHandler(c *gin.Context) {
+	updateRoutes(c, dnsservers.RemoveRoute, 200, "route removed")
+}
+
+func updateRoutes(c *gin.Context, apply func([]string, []dnsservers.DNSServer) ([]dnsservers.DNSServer, []dnsservers.Message, error), status int, text string) {
+	dnsData := data.GetInstance()
+	var request []string
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": "invalid input"})
+		return
+	}
+
+	updated, messages, err := apply(request, dnsData.GetServers())
+	if errors.Is(err, dnsservers.ErrHelpRequested) {
+		c.JSON(200, gin.H{"messages": extractServerMessages(messages)})
+		return
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error(), "messages": extractServerMessages(messages)})
+		return
+	}
+	dnsData.UpdateServers(updated)
+	c.JSON(status, gin.H{"status": text, "messages": extractServerMessages(messages)})
+}
+
+func listBlocklistHandler(c *gin.Context) {
+	dnsData := data.GetInstance()
+	c.JSON(200, gin.H{
+		"response": dnsData.GetResolverSettings().Blocklist.Response,
+		"rules":    dnsData.GetBlocklist().Len(),
+		"lists":    dnsData.GetBlocklist().Status(),
+	})
+}
+
+func addBlocklistHandler(c *gin.Context) {
+	updateBlocklists(c, blocklist.Add, 201, "blocklist added")
+}
+
+func removeBlocklistHandler(c *gin.Context) {
+	updateBlocklists(c, blocklist.Remove, 200, "blocklist removed")
+}
+
+func reloadBlocklistHandler(c *gin.Context) {
+	dnsData := data.GetInstance()
+	statuses := dnsData.GetBlocklist().Load(dnsData.GetResolverSettings().Blocklist)
+	c.JSON(200, gin.H{"status": "blocklists reloaded", "rules": dnsData.GetBlocklist().Len(), "lists": statuses})
+}
+
+func refreshBlocklistHandler(c *gin.Context) {
+	dnsData := data.GetInstance()
+	var statuses []blocklist.Status
+	for _, subscription := range dnsData.GetResolverSettings().Blocklist.URLs {
+		statuses = append(statuses, dnsData.GetBlocklist().Refresh(subscription.URL))
+	}
+	c.JSON(200, gin.H{"status": "blocklists refreshed", "rules": dnsData.GetBlocklist().Len(), "lists": statuses})
+}
+
+func updateBlocklists(c *gin.Context, apply func([]string, config.BlocklistSettings, string) (config.BlocklistSettings, []blocklist.Message, error), status int, text string) {
+	dnsData := data.GetInstance()
+	var request []string
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": "invalid input"})
+		return
+	}
+
+	settings := dnsData.GetResolverSettings()
+	updated, messages, err := apply(request, settings.Blocklist, data.ConfigDir())
+	if errors.Is(err, blocklist.ErrHelpRequested) {
+		c.JSON(200, gin.H{"messages": extractBlocklistMessages(messages)})
+		return
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error(), "messages": extractBlocklistMessages(messages)})
+		return
+	}
+	settings.Blocklist = updated
+	dnsData.UpdateSettings(settings)
+	statuses := dnsData.GetBlocklist().Load(updated)
+	go dnsData.RefreshBlocklists()
+	c.JSON(status, gin.H{"status": text, "lists": statuses, "messages": extractBlocklistMessages(messages)})
+}
+
+func listPolicyHandler(c *gin.Context) {
+	c.JSON(200, gin.H{"rules": data.GetInstance().GetPolicyRules()})
+}
+
+func addPolicyHandler(c *gin.Context) {
+	updatePolicy(c, policy.Add, 201, "rule added")
+}
+
+func removePolicyHandler(c *gin.Context) {
+	updatePolicy(c, policy.Remove, 200, "rule removed")
+}
+
+func testPolicyHandler(c *gin.Context) {
+	var request []string
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": "invalid input"})
+		return
+	}
+	name, qtype, messages, err := policy.ParseTest(request)
+	if errors.Is(err, policy.ErrHelpRequested) {
+		c.JSON(200, gin.H{"messages": extractPolicyMessages(messages)})
+		return
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error(), "messages": extractPolicyMessages(messages)})
+		return
+	}
+	decision := data.GetInstance().TestPolicy(name, qtype)
+	c.JSON(200, gin.H{"decision": decision, "messages": []string{decision.String()}})
+}
+
+func updatePolicy(c *gin.Context, apply func([]string, []policy.Rule) ([]policy.Rule, []policy.Message, error), status int, text string) {
+	dnsData := data.GetInstance()
+	var request []string
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": "invalid input"})
+		return
+	}
+
+	updated, messages, err := apply(request, dnsData.GetPolicyRules())
+	if errors.Is(err, policy.ErrHelpRequested) {
+		c.JSON(200, gin.H{"messages": extractPolicyMessages(messages)})
+		return
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error(), "messages": extractPolicyMessages(messages)})
+		return
+	}
+	if err := dnsData.UpdatePolicyRules(updated); err != nil {
+		c.JSON(500, gin.H{"error": "rules are in use but could not be saved: " + err.Error(), "rules": updated, "messages": extractPolicyMessages(messages)})
+		return
+	}
+	c.JSON(status, gin.H{"status": text, "rules": updated, "messages": extractPolicyMessages(messages)})
+}
+
+func listRPZHandler(c *gin.Context) {
+	dnsData := data.GetInstance()
+	c.JSON(200, gin.H{"rules": dnsData.GetRPZ().Len(), "zones": dnsData.GetRPZ().Status()})
+}
+
+func addRPZHandler(c *gin.Context) {
+	updateRPZ(c, rpz.Add, 201, "zone added")
+}
+
+func removeRPZHandler(c *gin.Context) {
+	updateRPZ(c, rpz.Remove, 200, "zone removed")
+}
+
+func reloadRPZHandler(c *gin.Context) {
+	dnsData := data.GetInstance()
+	statuses := dnsData.GetRPZ().Load(dnsData.GetResolverSettings().RPZ)
+	c.JSON(200, gin.H{"status": "zones reloaded", "rules": dnsData.GetRPZ().Len(), "zones": statuses})
+}
+
+func refreshRPZHandler(c *gin.Context) {
+	dnsData := data.GetInstance()
+	var statuses []rpz.Status
+	for _, zone := range dnsData.GetResolverSettings().RPZ {
+		if zone.Primary != "" {
+			statuses = append(statuses, dnsData.GetRPZ().Transfer(zone))
+		}
+	}
+	c.JSON(200, gin.H{"status": "zones refreshed", "rules": dnsData.GetRPZ().Len(), "zones": statuses})
+}
+
+func updateRPZ(c *gin.Context, apply func([]string, []config.RPZZone, string) ([]config.RPZZone, []rpz.Message, error), status int, text string) {
+	dnsData := data.GetInstance()
+	var request []string
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": "invalid input"})
+		return
+	}
+
+	settings := dnsData.GetResolverSettings()
+	updated, messages, err := apply(request, settings.RPZ, data.ConfigDir())
+	if errors.Is(err, rpz.ErrHelpRequested) {
+		c.JSON(200, gin.H{"messages": extractRPZMessages(messages)})
+		return
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error(), "messages": extractRPZMessages(messages)})
+		return
+	}
+	settings.RPZ = updated
+	dnsData.UpdateSettings(settings)
+	statuses := dnsData.GetRPZ().Load(updated)
+	go dnsData.RefreshRPZ()
+	c.JSON(status, gin.H{"status": text, "zones": statuses, "messages": extractRPZMessages(messages)})
+}
+
+func extractRPZMessages(msgs []rpz.Message) []string {
+	if len(msgs) == 0 {
+		return nil
+	}
+	res := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		res = append(res, msg.Text)
+	}
+	return res
+}
+
+func extractPolicyMessages(msgs []policy.Message) []string {
+	if len(msgs) == 0 {
+		return nil
+	}
+	res := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		res = append(res, msg.Text)
+	}
+	return res
+}
+
+func extractBlocklistMessages(msgs []blocklist.Message) []string {
+	if len(msgs) == 0 {
+		return nil
+	}
+	res := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		res = append(res, msg.Text)
+	}
+	return res
+}
+
+func extractServerMessages(msgs []dnsservers.Message) []string {
+	if len(msgs) == 0 {
+		return nil
+	}
+	res := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		res = append(res, msg.Text)
+	}
+	return res
+}
+
 func extractRecordMessages(msgs []dnsrecords.Message) []string {
 	if len(msgs) == 0 {
 		return nil
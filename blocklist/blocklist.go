@@ -0,0 +1,263 @@
+// Package blocklist blocks queries for names found in ad and tracker lists.
+package blocklist
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dnsplane/config"
+
+	"github.com/miekg/dns"
+)
+
+// Responses sent for blocked queries.
+const (
+	// ResponseNXDOMAIN answers that the name does not exist.
+	ResponseNXDOMAIN = "nxdomain"
+	// ResponseNull answers A queries with 0.0.0.0 and AAAA queries with ::,
+	// and other types with an empty answer.
+	ResponseNull = "null"
+	// ResponseRefused refuses the query.
+	ResponseRefused = "refused"
+)
+
+// Responses lists every supported response.
+var Responses = []string{ResponseNXDOMAIN, ResponseNull, ResponseRefused}
+
+// IsValidResponse reports whether response is a supported response.
+func IsValidResponse(response string) bool {
+	for _, candidate := range Responses {
+		if candidate == response {
+			return true
+		}
+	}
+	return false
+}
+
+// BlockedTTL is the TTL of the records in a null response.
+const BlockedTTL = 60
+
+// Match describes the rule that blocked a name.
+type Match struct {
+	// Rule is the blocked name or, for suffix rules, the blocked domain.
+	Rule   string
+	Source string
+}
+
+// Index answers whether a name is blocked. It is built from the rules of every
+// list and never modified afterwards.
+type Index struct {
+	exact    map[string]string
+	suffix   map[string]string
+	wildcard map[string]string
+}
+
+// Match returns the rule blocking name. Exact rules are checked first, then
+// suffix and wildcard rules from the name itself up to its top level domain.
+// Wildcard rules only match below their domain.
+func (x *Index) Match(name string) (Match, bool) {
+	if x == nil {
+		return Match{}, false
+	}
+	name = dns.CanonicalName(name)
+	if source, ok := x.exact[name]; ok {
+		return Match{Rule: name, Source: source}, true
+	}
+	if len(x.suffix) == 0 && len(x.wildcard) == 0 {
+		return Match{}, false
+	}
+	for offset, end := 0, false; !end; offset, end = dns.NextLabel(name, offset) {
+		domain := name[offset:]
+		if source, ok := x.suffix[domain]; ok {
+			return Match{Rule: domain, Source: source}, true
+		}
+		if source, ok := x.wildcard[domain]; ok && offset > 0 {
+			return Match{Rule: "*." + domain, Source: source}, true
+		}
+	}
+	return Match{}, false
+}
+
+// Len returns the number of distinct rules.
+func (x *Index) Len() int {
+	if x == nil {
+		return 0
+	}
+	return len(x.exact) + len(x.suffix) + len(x.wildcard)
+}
+
+// Status describes one loaded list.
+type Status struct {
+	Source string `json:"source"`
+	// URL marks a list downloaded over HTTP(S).
+	URL    bool      `json:"url,omitempty"`
+	Rules  int       `json:"rules"`
+	Loaded time.Time `json:"loaded,omitempty"`
+	// Checked is when a downloaded list was last checked for changes.
+	Checked time.Time `json:"checked,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type list struct {
+	rules  *Rules
+	status Status
+}
+
+// Blocklist holds the loaded lists. Lookups use an immutable index that is
+// replaced as a whole when lists are reloaded, so queries never wait for a
+// reload.
+type Blocklist struct {
+	index atomic.Pointer[Index]
+
+	mu    sync.Mutex
+	lists map[string]*list
+	order []string
+
+	// cacheDir holds the downloaded copies of lists subscribed to by URL.
+	cacheDir  string
+	client    *http.Client
+	refreshMu sync.Mutex
+}
+
+// New returns an empty blocklist that keeps downloaded lists in cacheDir.
+func New(cacheDir string) *Blocklist {
+	return &Blocklist{
+		lists:    make(map[string]*list),
+		cacheDir: cacheDir,
+		client:   &http.Client{Timeout: downloadTimeout},
+	}
+}
+
+// Match returns the rule blocking name, if any.
+func (b *Blocklist) Match(name string) (Match, bool) {
+	return b.index.Load().Match(name)
+}
+
+// Len returns the number of distinct rules in use.
+func (b *Blocklist) Len() int {
+	return b.index.Load().Len()
+}
+
+// Load reads the configured list files and the downloaded copies of the URL
+// lists, replacing the lists loaded before. Nothing is downloaded here; see
+// Refresh. A list that cannot be read keeps the rules it had before, if any,
+// and reports the error in its status.
+func (b *Blocklist) Load(settings config.BlocklistSettings) []Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sources := len(settings.Files) + len(settings.URLs)
+	lists := make(map[string]*list, sources)
+	order := make([]string, 0, sources)
+	add := func(source string, read func(string) *list) {
+		if _, seen := lists[source]; seen {
+			return
+		}
+		loaded := read(source)
+		if loaded.rules == nil {
+			if previous, ok := b.lists[source]; ok && previous.rules != nil {
+				loaded.rules = previous.rules
+				loaded.status.Rules = previous.status.Rules
+				loaded.status.Loaded = previous.status.Loaded
+			}
+		}
+		lists[source] = loaded
+		order = append(order, source)
+	}
+	for _, path := range settings.Files {
+		add(path, loadFile)
+	}
+	for _, subscription := range settings.URLs {
+		add(subscription.URL, b.loadDownloaded)
+	}
+	b.lists = lists
+	b.order = order
+	b.rebuild()
+	return b.statusLocked()
+}
+
+// Status returns the state of every list in load order.
+func (b *Blocklist) Status() []Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.statusLocked()
+}
+
+func (b *Blocklist) statusLocked() []Status {
+	statuses := make([]Status, 0, len(b.order))
+	for _, source := range b.order {
+		statuses = append(statuses, b.lists[source].status)
+	}
+	return statuses
+}
+
+// rebuild merges the rules of every list into a new index and swaps it in.
+// The first list naming a rule is reported as its source.
+func (b *Blocklist) rebuild() {
+	index := &Index{exact: make(map[string]string), suffix: make(map[string]string), wildcard: make(map[string]string)}
+	for _, source := range b.order {
+		rules := b.lists[source].rules
+		if rules == nil {
+			continue
+		}
+		mergeRules(index.exact, rules.Exact, source)
+		mergeRules(index.suffix, rules.Suffix, source)
+		mergeRules(index.wildcard, rules.Wildcard, source)
+	}
+	b.index.Store(index)
+}
+
+func mergeRules(index map[string]string, rules map[string]struct{}, source string) {
+	for name := range rules {
+		if _, ok := index[name]; !ok {
+			index[name] = source
+		}
+	}
+}
+
+func loadFile(path string) *list {
+	loaded := &list{status: Status{Source: path}}
+	file, err := os.Open(path)
+	if err != nil {
+		loaded.status.Error = err.Error()
+		return loaded
+	}
+	defer file.Close()
+	rules, err := Parse(file)
+	if err != nil {
+		loaded.status.Error = err.Error()
+		return loaded
+	}
+	loaded.rules = rules
+	loaded.status.Rules = rules.Len()
+	loaded.status.Loaded = time.Now()
+	return loaded
+}
+
+// Respond fills response with the answer for a blocked question and returns
+// a short description of it for logging. Unknown responses fall back to
+// NXDOMAIN.
+func Respond(response *dns.Msg, question dns.Question, mode string) string {
+	switch mode {
+	case ResponseRefused:
+		response.Rcode = dns.RcodeRefused
+		return "REFUSED"
+	case ResponseNull:
+		header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: question.Qclass, Ttl: BlockedTTL}
+		switch question.Qtype {
+		case dns.TypeA:
+			response.Answer = append(response.Answer, &dns.A{Hdr: header, A: net.IPv4zero})
+			return "0.0.0.0"
+		case dns.TypeAAAA:
+			response.Answer = append(response.Answer, &dns.AAAA{Hdr: header, AAAA: net.IPv6zero})
+			return "::"
+		}
+		return "NODATA"
+	default:
+		response.Rcode = dns.RcodeNameError
+		return "NXDOMAIN"
+	}
+}
@@ -0,0 +1,125 @@
+package blocklist
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Rules is the parsed content of one blocklist.
+type Rules struct {
+	// Exact holds names that are blocked themselves.
+	Exact map[string]struct{}
+	// Suffix holds domains that are blocked together with every name below
+	// them.
+	Suffix map[string]struct{}
+	// Wildcard holds domains whose subdomains are blocked, but not the
+	// domain itself.
+	Wildcard map[string]struct{}
+}
+
+// Len returns the number of rules.
+func (r *Rules) Len() int {
+	return len(r.Exact) + len(r.Suffix) + len(r.Wildcard)
+}
+
+// hostsIgnored are names found in most hosts files that must never be
+// blocked.
+var hostsIgnored = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+	"ip6-localnet.":          true,
+	"ip6-mcastprefix.":       true,
+	"ip6-allnodes.":          true,
+	"ip6-allrouters.":        true,
+	"ip6-allhosts.":          true,
+	"0.0.0.0.":               true,
+}
+
+// Parse reads a blocklist. The format is detected per line, so lists may mix
+// them:
+//
+//	0.0.0.0 ads.example.com    hosts format, blocks the name
+//	ads.example.com            plain domain, blocks the name
+//	*.ads.example.com          wildcard, blocks every name below the domain
+//	||ads.example.com^         Adblock style, blocks the domain and below
+//
+// Comments (#, !), Adblock headers and rules that are not plain domain rules,
+// such as exceptions (@@) or rules with options or paths, are skipped.
+func Parse(reader io.Reader) (*Rules, error) {
+	rules := &Rules{Exact: make(map[string]struct{}), Suffix: make(map[string]struct{}), Wildcard: make(map[string]struct{})}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		parseLine(rules, scanner.Text())
+	}
+	return rules, scanner.Err()
+}
+
+func parseLine(rules *Rules, line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' || strings.HasPrefix(line, "@@") {
+		return
+	}
+	if strings.HasPrefix(line, "||") {
+		domain, ok := strings.CutSuffix(line[2:], "^")
+		if !ok {
+			return
+		}
+		addRule(rules.Suffix, domain)
+		return
+	}
+	if index := strings.IndexByte(line, '#'); index >= 0 {
+		// Inline comments follow whitespace. A # within a field marks an
+		// Adblock element hiding rule such as example.com##.ad.
+		if line[index-1] != ' ' && line[index-1] != '\t' {
+			return
+		}
+		line = line[:index]
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 0:
+	case len(fields) > 1 && net.ParseIP(fields[0]) != nil:
+		for _, name := range fields[1:] {
+			addRule(rules.Exact, name)
+		}
+	case len(fields) == 1 && strings.HasPrefix(fields[0], "*."):
+		addRule(rules.Wildcard, fields[0][2:])
+	case len(fields) == 1:
+		addRule(rules.Exact, fields[0])
+	}
+}
+
+func addRule(set map[string]struct{}, name string) {
+	if strings.ContainsAny(name, "/*$|^:") {
+		return
+	}
+	name = dns.CanonicalName(name)
+	if name == "." || hostsIgnored[name] {
+		return
+	}
+	if _, ok := dns.IsDomainName(name); !ok || !hostnameChars(name) {
+		return
+	}
+	set[name] = struct{}{}
+}
+
+// hostnameChars reports whether name only holds characters found in host
+// names, which keeps markup from error pages out of downloaded lists.
+func hostnameChars(name string) bool {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
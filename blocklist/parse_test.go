@@ -0,0 +1,121 @@
+package blocklist
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"dnsplane/config"
+)
+
+func names(set map[string]struct{}) []string {
+	list := make([]string, 0, len(set))
+	for name := range set {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		exact    []string
+		suffix   []string
+		wildcard []string
+	}{
+		{name: "comment", line: "# 0.0.0.0 ads.example.com"},
+		{name: "adblock comment", line: "! Title: Example list"},
+		{name: "adblock header", line: "[Adblock Plus 2.0]"},
+		{name: "blank", line: "   "},
+		{name: "hosts 0.0.0.0", line: "0.0.0.0 ads.example.com", exact: []string{"ads.example.com."}},
+		{name: "hosts 127.0.0.1", line: "127.0.0.1\tAds.Example.COM", exact: []string{"ads.example.com."}},
+		{name: "hosts IPv6", line: ":: ads.example.com", exact: []string{"ads.example.com."}},
+		{name: "hosts several names", line: "0.0.0.0 a.example.com b.example.com", exact: []string{"a.example.com.", "b.example.com."}},
+		{name: "hosts inline comment", line: "0.0.0.0 ads.example.com # tracker", exact: []string{"ads.example.com."}},
+		{name: "hosts localhost", line: "127.0.0.1 localhost"},
+		{name: "hosts IP without name", line: "0.0.0.0"},
+		{name: "plain domain", line: "ads.example.com", exact: []string{"ads.example.com."}},
+		{name: "plain domain inline comment", line: "ads.example.com #ads", exact: []string{"ads.example.com."}},
+		{name: "wildcard", line: "*.ads.example.com", wildcard: []string{"ads.example.com."}},
+		{name: "adblock domain", line: "||ads.example.com^", suffix: []string{"ads.example.com."}},
+		{name: "adblock exception", line: "@@||ads.example.com^"},
+		{name: "adblock options", line: "||ads.example.com^$third-party"},
+		{name: "adblock path", line: "||example.com/ads^"},
+		{name: "adblock without separator", line: "||ads.example.com"},
+		{name: "element hiding", line: "example.com##.ad"},
+		{name: "markup", line: "<html>"},
+		{name: "url", line: "https://ads.example.com/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := Parse(strings.NewReader(tt.line + "\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(rules.Exact); len(got)+len(tt.exact) > 0 && !reflect.DeepEqual(got, tt.exact) {
+				t.Errorf("exact = %v, want %v", got, tt.exact)
+			}
+			if got := names(rules.Suffix); len(got)+len(tt.suffix) > 0 && !reflect.DeepEqual(got, tt.suffix) {
+				t.Errorf("suffix = %v, want %v", got, tt.suffix)
+			}
+			if got := names(rules.Wildcard); len(got)+len(tt.wildcard) > 0 && !reflect.DeepEqual(got, tt.wildcard) {
+				t.Errorf("wildcard = %v, want %v", got, tt.wildcard)
+			}
+		})
+	}
+}
+
+func TestMatchByRuleKind(t *testing.T) {
+	list := strings.Join([]string{
+		"# mixed formats",
+		"0.0.0.0 hosts.example.com",
+		"plain.example.com",
+		"*.wild.example.com",
+		"||adblock.example.com^",
+		"@@||allowed.adblock.example.com^",
+	}, "\n")
+	path := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(path, []byte(list), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	b := New(t.TempDir())
+	status := b.Load(config.BlocklistSettings{Files: []string{path}})
+	if status[0].Error != "" || status[0].Rules != 4 {
+		t.Fatalf("status = %+v, want 4 rules", status[0])
+	}
+
+	tests := []struct {
+		name string
+		rule string
+	}{
+		{name: "hosts.example.com.", rule: "hosts.example.com."},
+		{name: "www.hosts.example.com."},
+		{name: "plain.example.com.", rule: "plain.example.com."},
+		{name: "PLAIN.example.com", rule: "plain.example.com."},
+		{name: "www.plain.example.com."},
+		{name: "wild.example.com."},
+		{name: "a.wild.example.com.", rule: "*.wild.example.com."},
+		{name: "a.b.wild.example.com.", rule: "*.wild.example.com."},
+		{name: "adblock.example.com.", rule: "adblock.example.com."},
+		{name: "www.adblock.example.com.", rule: "adblock.example.com."},
+		// Exceptions are skipped rather than applied.
+		{name: "allowed.adblock.example.com.", rule: "adblock.example.com."},
+		{name: "example.com."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, ok := b.Match(tt.name)
+			if ok != (tt.rule != "") || match.Rule != tt.rule {
+				t.Errorf("Match(%s) = %q, %t, want %q", tt.name, match.Rule, ok, tt.rule)
+			}
+			if ok && match.Source != path {
+				t.Errorf("source = %q, want %q", match.Source, path)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package blocklist
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dnsplane/config"
+)
+
+const (
+	// downloadTimeout bounds a single list download.
+	downloadTimeout = 2 * time.Minute
+	// maxDownloadSize caps the size of a downloaded list.
+	maxDownloadSize = 64 << 20
+	// failedRetryInterval is how soon a failed download is retried when the
+	// list's refresh interval is longer.
+	failedRetryInterval = 15 * time.Minute
+)
+
+// IsURL reports whether source names a list downloaded over HTTP(S).
+func IsURL(source string) bool {
+	lower := strings.ToLower(source)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// download is stored next to a downloaded list and holds the validators used
+// for conditional requests.
+type download struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Checked      time.Time `json:"checked,omitempty"`
+	Updated      time.Time `json:"updated,omitempty"`
+}
+
+// cachePaths returns where the list downloaded from url and its validators
+// are stored.
+func (b *Blocklist) cachePaths(url string) (listPath, metaPath string) {
+	sum := sha256.Sum256([]byte(url))
+	name := hex.EncodeToString(sum[:8])
+	return filepath.Join(b.cacheDir, name+".txt"), filepath.Join(b.cacheDir, name+".json")
+}
+
+func readDownload(path string) download {
+	var meta download
+	if content, err := os.ReadFile(path); err == nil {
+		_ = json.Unmarshal(content, &meta)
+	}
+	return meta
+}
+
+// loadDownloaded reads the copy of the list at url saved by the last
+// successful download.
+func (b *Blocklist) loadDownloaded(url string) *list {
+	listPath, metaPath := b.cachePaths(url)
+	meta := readDownload(metaPath)
+	if _, err := os.Stat(listPath); errors.Is(err, os.ErrNotExist) {
+		return &list{status: Status{Source: url, URL: true, Checked: meta.Checked, Error: "not downloaded yet"}}
+	}
+	loaded := loadFile(listPath)
+	loaded.status.Source = url
+	loaded.status.URL = true
+	loaded.status.Checked = meta.Checked
+	if loaded.rules != nil && !meta.Updated.IsZero() {
+		loaded.status.Loaded = meta.Updated
+	}
+	return loaded
+}
+
+// RefreshDue refreshes every list in urls whose refresh interval has passed
+// since it was last checked, and returns the state of those lists.
+func (b *Blocklist) RefreshDue(urls []config.BlocklistURL) []Status {
+	var refreshed []Status
+	for _, subscription := range urls {
+		status, ok := b.status(subscription.URL)
+		if !ok {
+			continue
+		}
+		wait := time.Duration(subscription.RefreshInterval) * time.Second
+		if status.Error != "" && wait > failedRetryInterval {
+			wait = failedRetryInterval
+		}
+		if !status.Checked.IsZero() && time.Since(status.Checked) < wait {
+			continue
+		}
+		refreshed = append(refreshed, b.Refresh(subscription.URL))
+	}
+	return refreshed
+}
+
+// Refresh downloads the list at url unless it is unchanged since the last
+// download, and swaps in its rules. A failed download keeps the rules the
+// list had and reports the error in its status. A list that was stored but
+// whose validators could not be saved is swapped in and reports the error.
+func (b *Blocklist) Refresh(url string) Status {
+	b.refreshMu.Lock()
+	defer b.refreshMu.Unlock()
+	if _, ok := b.status(url); !ok {
+		return Status{Source: url, URL: true, Error: "not a configured blocklist"}
+	}
+	rules, meta, err := b.fetch(url)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	current, ok := b.lists[url]
+	if !ok {
+		return Status{Source: url, URL: true, Error: "not a configured blocklist"}
+	}
+	current.status.Checked = meta.Checked
+	current.status.Error = ""
+	if err != nil {
+		current.status.Error = err.Error()
+	}
+	if rules != nil {
+		current.rules = rules
+		current.status.Rules = rules.Len()
+		current.status.Loaded = meta.Updated
+		b.rebuild()
+	}
+	return current.status
+}
+
+func (b *Blocklist) status(source string) (Status, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	current, ok := b.lists[source]
+	if !ok {
+		return Status{}, false
+	}
+	return current.status, true
+}
+
+// fetch downloads the list at url into the cache directory. It returns nil
+// rules when the server reports the list unchanged. Once a new list has
+// replaced the cached copy its rules are returned even if saving the
+// validators fails, so that they match the file a restart would load.
+func (b *Blocklist) fetch(url string) (*Rules, download, error) {
+	listPath, metaPath := b.cachePaths(url)
+	meta := readDownload(metaPath)
+	meta.URL = url
+	meta.Checked = time.Now()
+
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, meta, err
+	}
+	request.Header.Set("User-Agent", "dnsplane")
+	if _, err := os.Stat(listPath); err == nil {
+		if meta.ETag != "" {
+			request.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			request.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+	response, err := b.client.Do(request)
+	if err != nil {
+		return nil, meta, b.saveDownload(metaPath, meta, err)
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, meta, b.saveDownload(metaPath, meta, nil)
+	default:
+		return nil, meta, b.saveDownload(metaPath, meta, fmt.Errorf("unexpected response %s", response.Status))
+	}
+
+	rules, err := b.store(listPath, response.Body)
+	if err != nil {
+		return nil, meta, b.saveDownload(metaPath, meta, err)
+	}
+	meta.ETag = response.Header.Get("ETag")
+	meta.LastModified = response.Header.Get("Last-Modified")
+	meta.Updated = meta.Checked
+	if err := b.saveDownload(metaPath, meta, nil); err != nil {
+		return rules, meta, fmt.Errorf("save download state: %w", err)
+	}
+	return rules, meta, nil
+}
+
+// store parses body while writing it to path. The file is only replaced once
+// the whole list was read and contains rules, so an interrupted download or
+// an error page never replaces a good copy.
+func (b *Blocklist) store(path string, body io.Reader) (*Rules, error) {
+	if err := os.MkdirAll(b.cacheDir, 0o755); err != nil {
+		return nil, err
+	}
+	temp, err := os.CreateTemp(b.cacheDir, ".download-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	limited := &io.LimitedReader{R: body, N: maxDownloadSize + 1}
+	rules, err := Parse(io.TeeReader(limited, temp))
+	if err != nil {
+		return nil, err
+	}
+	if limited.N == 0 {
+		return nil, fmt.Errorf("list is larger than %d MiB", maxDownloadSize>>20)
+	}
+	if rules.Len() == 0 {
+		return nil, errors.New("downloaded list contains no rules")
+	}
+	if err := temp.Chmod(0o644); err != nil {
+		return nil, err
+	}
+	if err := temp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// saveDownload writes meta to path and returns cause, or the write error if
+// there is no cause.
+func (b *Blocklist) saveDownload(path string, meta download, cause error) error {
+	err := writeJSON(path, meta)
+	if cause != nil {
+		return cause
+	}
+	return err
+}
+
+func writeJSON(path string, value any) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), ".meta-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(content); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
@@ -0,0 +1,248 @@
+package blocklist
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"dnsplane/config"
+)
+
+// listServer serves a blocklist with an ETag and Last-Modified date and
+// answers conditional requests for the current version with 304.
+type listServer struct {
+	mu           sync.Mutex
+	body         string
+	etag         string
+	lastModified string
+	// status, when set, is returned instead of the list.
+	status int
+	// requests records the conditional headers of every request.
+	requests []http.Header
+}
+
+func (s *listServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Header.Clone())
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		_, _ = w.Write([]byte(s.body))
+		return
+	}
+	if r.Header.Get("If-None-Match") == s.etag || r.Header.Get("If-Modified-Since") == s.lastModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", s.etag)
+	w.Header().Set("Last-Modified", s.lastModified)
+	_, _ = w.Write([]byte(s.body))
+}
+
+func (s *listServer) set(status int, body, etag, lastModified string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.body, s.etag, s.lastModified = status, body, etag, lastModified
+}
+
+func (s *listServer) lastRequest() http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[len(s.requests)-1]
+}
+
+const (
+	firstList  = "0.0.0.0 ads.example.com\n0.0.0.0 tracker.example.com\n"
+	secondList = "||metrics.example.net^\n"
+	firstDate  = "Mon, 05 Oct 2026 10:00:00 GMT"
+	secondDate = "Tue, 06 Oct 2026 10:00:00 GMT"
+)
+
+// newRemoteBlocklist subscribes a blocklist in a temporary cache directory to
+// a list served by a new listServer.
+func newRemoteBlocklist(t *testing.T) (*Blocklist, *listServer, string) {
+	t.Helper()
+	server := &listServer{body: firstList, etag: `"v1"`, lastModified: firstDate}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	url := httpServer.URL + "/hosts.txt"
+	b := New(t.TempDir())
+	b.Load(config.BlocklistSettings{URLs: []config.BlocklistURL{{URL: url, RefreshInterval: 3600}}})
+	return b, server, url
+}
+
+func checkBlocked(t *testing.T, b *Blocklist, name string, want bool) {
+	t.Helper()
+	if _, blocked := b.Match(name); blocked != want {
+		t.Errorf("%s blocked = %t, want %t", name, blocked, want)
+	}
+}
+
+func refreshOK(t *testing.T, b *Blocklist, url string) Status {
+	t.Helper()
+	status := b.Refresh(url)
+	if status.Error != "" {
+		t.Fatalf("refresh failed: %s", status.Error)
+	}
+	return status
+}
+
+func TestRefreshConditionalGet(t *testing.T) {
+	b, server, url := newRemoteBlocklist(t)
+	checkBlocked(t, b, "ads.example.com.", false)
+
+	status := refreshOK(t, b, url)
+	if status.Rules != 2 {
+		t.Errorf("rules = %d, want 2", status.Rules)
+	}
+	if got := server.lastRequest().Get("If-None-Match"); got != "" {
+		t.Errorf("first download sent If-None-Match %q", got)
+	}
+	checkBlocked(t, b, "ads.example.com.", true)
+	loaded := status.Loaded
+
+	// Unchanged: the validators are sent back and the list is kept.
+	status = refreshOK(t, b, url)
+	request := server.lastRequest()
+	if got := request.Get("If-None-Match"); got != `"v1"` {
+		t.Errorf("If-None-Match = %q, want %q", got, `"v1"`)
+	}
+	if got := request.Get("If-Modified-Since"); got != firstDate {
+		t.Errorf("If-Modified-Since = %q, want %q", got, firstDate)
+	}
+	if status.Rules != 2 || !status.Loaded.Equal(loaded) {
+		t.Errorf("304 changed the list: %+v", status)
+	}
+	checkBlocked(t, b, "ads.example.com.", true)
+
+	// Changed: the new rules replace the old ones as a whole.
+	server.set(0, secondList, `"v2"`, secondDate)
+	status = refreshOK(t, b, url)
+	if status.Rules != 1 {
+		t.Errorf("rules = %d, want 1", status.Rules)
+	}
+	checkBlocked(t, b, "ads.example.com.", false)
+	checkBlocked(t, b, "cdn.metrics.example.net.", true)
+
+	// The downloaded copy is loaded on restart without a download.
+	requests := len(server.requests)
+	restarted := New(b.cacheDir)
+	statuses := restarted.Load(config.BlocklistSettings{URLs: []config.BlocklistURL{{URL: url, RefreshInterval: 3600}}})
+	if len(statuses) != 1 || statuses[0].Rules != 1 || statuses[0].Error != "" {
+		t.Errorf("restart loaded %+v", statuses)
+	}
+	checkBlocked(t, restarted, "cdn.metrics.example.net.", true)
+	if len(server.requests) != requests {
+		t.Error("Load downloaded the list")
+	}
+	refreshOK(t, restarted, url)
+	if got := server.lastRequest().Get("If-None-Match"); got != `"v2"` {
+		t.Errorf("If-None-Match after restart = %q, want %q", got, `"v2"`)
+	}
+}
+
+func TestRefreshFailureKeepsRules(t *testing.T) {
+	b, server, url := newRemoteBlocklist(t)
+	refreshOK(t, b, url)
+
+	server.set(http.StatusInternalServerError, "", "", "")
+	status := b.Refresh(url)
+	if !strings.Contains(status.Error, "500") {
+		t.Errorf("error = %q, want the 500 response", status.Error)
+	}
+	if status.Rules != 2 {
+		t.Errorf("rules = %d after a failed download, want 2", status.Rules)
+	}
+	checkBlocked(t, b, "ads.example.com.", true)
+
+	// A successful download clears the error.
+	server.set(0, firstList, `"v1"`, firstDate)
+	refreshOK(t, b, url)
+}
+
+func TestRefreshUnreachableKeepsRules(t *testing.T) {
+	server := httptest.NewServer(&listServer{body: firstList, etag: `"v1"`, lastModified: firstDate})
+	url := server.URL + "/hosts.txt"
+	b := New(t.TempDir())
+	b.Load(config.BlocklistSettings{URLs: []config.BlocklistURL{{URL: url, RefreshInterval: 3600}}})
+	refreshOK(t, b, url)
+
+	server.Close()
+	status := b.Refresh(url)
+	if status.Error == "" {
+		t.Error("refresh of an unreachable list reported no error")
+	}
+	if status.Checked.IsZero() {
+		t.Error("failed refresh did not record when it was checked")
+	}
+	checkBlocked(t, b, "ads.example.com.", true)
+}
+
+func TestRefreshKeepsGoodCopy(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{name: "empty list", body: "", wantErr: "no rules"},
+		{name: "comments only", body: "# moved to another host\n", wantErr: "no rules"},
+		{name: "error page", body: "<html>\n<head><title>502 Bad Gateway</title></head>\n<body>\n<h1>Bad Gateway</h1>\n</body>\n</html>\n", wantErr: "no rules"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, server, url := newRemoteBlocklist(t)
+			refreshOK(t, b, url)
+			listPath, _ := b.cachePaths(url)
+			saved, err := os.ReadFile(listPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			server.set(0, tt.body, `"v2"`, secondDate)
+			status := b.Refresh(url)
+			if !strings.Contains(status.Error, tt.wantErr) {
+				t.Errorf("error = %q, want %q", status.Error, tt.wantErr)
+			}
+			checkBlocked(t, b, "ads.example.com.", true)
+			if current, _ := os.ReadFile(listPath); string(current) != string(saved) {
+				t.Error("the downloaded copy was replaced")
+			}
+
+			// The validators still describe the copy on disk, so the next
+			// request asks for the list again.
+			server.set(0, firstList, `"v1"`, firstDate)
+			refreshOK(t, b, url)
+			if got := server.lastRequest().Get("If-None-Match"); got != `"v1"` {
+				t.Errorf("If-None-Match = %q, want %q", got, `"v1"`)
+			}
+		})
+	}
+}
+
+func TestRefreshUsesListWhenStateCannotBeSaved(t *testing.T) {
+	b, _, url := newRemoteBlocklist(t)
+	// A directory in place of the state file makes saving it fail.
+	_, metaPath := b.cachePaths(url)
+	if err := os.MkdirAll(metaPath+"/blocked", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	status := b.Refresh(url)
+	if !strings.Contains(status.Error, "save download state") {
+		t.Errorf("error = %q, want the state save error", status.Error)
+	}
+	if status.Rules != 2 {
+		t.Errorf("rules = %d, want 2", status.Rules)
+	}
+	checkBlocked(t, b, "ads.example.com.", true)
+}
+
+func TestRefreshUnknownList(t *testing.T) {
+	b := New(t.TempDir())
+	if status := b.Refresh("https://blocklist.example/hosts.txt"); status.Error != "not a configured blocklist" {
+		t.Errorf("error = %q, want %q", status.Error, "not a configured blocklist")
+	}
+}
@@ -0,0 +1,204 @@
+package blocklist
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"dnsplane/cliutil"
+	"dnsplane/config"
+)
+
+var (
+	ErrHelpRequested = errors.New("help requested")
+	ErrInvalidArgs   = errors.New("invalid arguments")
+)
+
+type Level string
+
+const (
+	LevelInfo  Level = "info"
+	LevelWarn  Level = "warn"
+	LevelError Level = "error"
+)
+
+type Message struct {
+	Level Level
+	Text  string
+}
+
+// ResolvePath makes a list path absolute. Relative paths are taken relative
+// to baseDir, the directory holding the config file.
+func ResolvePath(path, baseDir string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
+
+// DefaultRefreshInterval is how often a list added by URL is checked for
+// changes unless a refresh interval is given.
+const DefaultRefreshInterval = 24 * time.Hour
+
+// minRefreshInterval keeps subscriptions from polling list hosts too often.
+const minRefreshInterval = time.Minute
+
+// Add returns settings with the list named in fullCommand added. A list file
+// must exist; relative paths are resolved against baseDir. An http(s) URL is
+// added as a subscription that accepts a refresh=<duration> option.
+func Add(fullCommand []string, settings config.BlocklistSettings, baseDir string) (config.BlocklistSettings, []Message, error) {
+	if cliutil.IsHelpRequest(fullCommand) {
+		return settings, usageAdd(), ErrHelpRequested
+	}
+	if len(fullCommand) == 0 || len(fullCommand) > 2 {
+		msgs := append([]Message{{Level: LevelError, Text: "a single list file or URL is required"}}, usageAdd()...)
+		return settings, msgs, ErrInvalidArgs
+	}
+	if IsURL(fullCommand[0]) {
+		return addURL(fullCommand, settings)
+	}
+	if len(fullCommand) > 1 {
+		msgs := append([]Message{{Level: LevelError, Text: "options are only supported for lists added by URL"}}, usageAdd()...)
+		return settings, msgs, ErrInvalidArgs
+	}
+	path := ResolvePath(fullCommand[0], baseDir)
+	for _, existing := range settings.Files {
+		if existing == path {
+			return settings, []Message{{Level: LevelWarn, Text: fmt.Sprintf("%s is already a blocklist", path)}}, nil
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		msgs := append([]Message{{Level: LevelError, Text: fmt.Sprintf("cannot read %s: %v", path, err)}}, usageAdd()...)
+		return settings, msgs, ErrInvalidArgs
+	}
+	if info.IsDir() {
+		msgs := append([]Message{{Level: LevelError, Text: fmt.Sprintf("%s is a directory", path)}}, usageAdd()...)
+		return settings, msgs, ErrInvalidArgs
+	}
+	settings.Files = append(append([]string(nil), settings.Files...), path)
+	return settings, []Message{{Level: LevelInfo, Text: fmt.Sprintf("Added blocklist %s", path)}}, nil
+}
+
+func addURL(fullCommand []string, settings config.BlocklistSettings) (config.BlocklistSettings, []Message, error) {
+	parsed, err := url.Parse(fullCommand[0])
+	if err != nil || parsed.Host == "" {
+		msgs := append([]Message{{Level: LevelError, Text: fmt.Sprintf("invalid URL: %s", fullCommand[0])}}, usageAdd()...)
+		return settings, msgs, ErrInvalidArgs
+	}
+	subscription := config.BlocklistURL{URL: parsed.String(), RefreshInterval: int(DefaultRefreshInterval / time.Second)}
+	if len(fullCommand) == 2 {
+		key, value, _ := strings.Cut(fullCommand[1], "=")
+		if strings.ToLower(strings.TrimSpace(key)) != "refresh" {
+			msgs := append([]Message{{Level: LevelError, Text: fmt.Sprintf("unknown option: %s", key)}}, usageAdd()...)
+			return settings, msgs, ErrInvalidArgs
+		}
+		interval, err := parseInterval(strings.TrimSpace(value))
+		if err != nil {
+			msgs := append([]Message{{Level: LevelError, Text: err.Error()}}, usageAdd()...)
+			return settings, msgs, ErrInvalidArgs
+		}
+		subscription.RefreshInterval = int(interval / time.Second)
+	}
+	updated := make([]config.BlocklistURL, 0, len(settings.URLs)+1)
+	replaced := false
+	for _, existing := range settings.URLs {
+		if existing.URL == subscription.URL {
+			existing.RefreshInterval = subscription.RefreshInterval
+			replaced = true
+		}
+		updated = append(updated, existing)
+	}
+	if !replaced {
+		updated = append(updated, subscription)
+	}
+	settings.URLs = updated
+	interval := time.Duration(subscription.RefreshInterval) * time.Second
+	if replaced {
+		return settings, []Message{{Level: LevelInfo, Text: fmt.Sprintf("Updated blocklist %s, refreshed every %s", subscription.URL, interval)}}, nil
+	}
+	return settings, []Message{{Level: LevelInfo, Text: fmt.Sprintf("Added blocklist %s, refreshed every %s", subscription.URL, interval)}}, nil
+}
+
+// parseInterval accepts a Go duration ("12h") or a bare number of seconds.
+func parseInterval(value string) (time.Duration, error) {
+	interval, err := time.ParseDuration(value)
+	if seconds, convErr := strconv.Atoi(value); convErr == nil {
+		interval, err = time.Duration(seconds)*time.Second, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid refresh interval: %s", value)
+	}
+	if interval < minRefreshInterval {
+		return 0, fmt.Errorf("refresh interval must be at least %s", minRefreshInterval)
+	}
+	return interval, nil
+}
+
+// Remove returns settings without the list file or URL named in fullCommand.
+func Remove(fullCommand []string, settings config.BlocklistSettings, baseDir string) (config.BlocklistSettings, []Message, error) {
+	if cliutil.IsHelpRequest(fullCommand) {
+		return settings, usageRemove(), ErrHelpRequested
+	}
+	if len(fullCommand) != 1 {
+		msgs := append([]Message{{Level: LevelError, Text: "a single list file or URL is required"}}, usageRemove()...)
+		return settings, msgs, ErrInvalidArgs
+	}
+	source := fullCommand[0]
+	removed := false
+	if IsURL(source) {
+		urls := make([]config.BlocklistURL, 0, len(settings.URLs))
+		for _, existing := range settings.URLs {
+			if existing.URL == source {
+				removed = true
+				continue
+			}
+			urls = append(urls, existing)
+		}
+		settings.URLs = urls
+	} else {
+		source = ResolvePath(source, baseDir)
+		files := make([]string, 0, len(settings.Files))
+		for _, existing := range settings.Files {
+			if existing == source {
+				removed = true
+				continue
+			}
+			files = append(files, existing)
+		}
+		settings.Files = files
+	}
+	if !removed {
+		msgs := append([]Message{{Level: LevelWarn, Text: fmt.Sprintf("Blocklist not found: %s", source)}}, usageRemove()...)
+		return settings, msgs, ErrInvalidArgs
+	}
+	return settings, []Message{{Level: LevelInfo, Text: fmt.Sprintf("Removed blocklist %s", source)}}, nil
+}
+
+func usageAdd() []Message {
+	msgs := []Message{
+		{Level: LevelInfo, Text: "Usage  : blocklist add <File|URL> [refresh=<Duration>]"},
+		{Level: LevelInfo, Text: "Example: blocklist add /etc/dnsplane/ads.txt"},
+		{Level: LevelInfo, Text: "Example: blocklist add https://example.com/hosts.txt refresh=12h"},
+		{Level: LevelInfo, Text: "Lists added by URL are downloaded in the background and checked for changes every refresh interval (default 24h)."},
+		{Level: LevelInfo, Text: "Hosts lines (0.0.0.0 ads.example.com) and plain domains (ads.example.com) block only that name. Use *.ads.example.com for the names below it, or ||ads.example.com^ for the domain and every name below it."},
+	}
+	return append(msgs, helpHint())
+}
+
+func usageRemove() []Message {
+	msgs := []Message{
+		{Level: LevelInfo, Text: "Usage  : blocklist remove <File|URL>"},
+		{Level: LevelInfo, Text: "Example: blocklist remove /etc/dnsplane/ads.txt"},
+	}
+	return append(msgs, helpHint())
+}
+
+func helpHint() Message {
+	return Message{Level: LevelInfo, Text: "Hint: append '?', 'help', or 'h' after the command to view this usage."}
+}
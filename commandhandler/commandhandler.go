@@ -3,15 +3,24 @@ package commandhandler
 
 import (
 	"bytes"
+	"dnsplane/acl"
+	"dnsplane/blocklist"
 	"dnsplane/cliutil"
+	"dnsplane/config"
 	"dnsplane/data"
 	"dnsplane/dnsrecordcache"
 	"dnsplane/dnsrecords"
 	"dnsplane/dnsservers"
+	"dnsplane/ipvalidator"
+	"dnsplane/policy"
+	"dnsplane/rpz"
+	"dnsplane/upstream"
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -26,12 +35,21 @@ var (
 	getServerStatusFunc    func() bool
 	startGinAPIFunc        func(string)
 	getServerListenersFunc func() ServerListenerInfo
+	startListenerFunc      func(string) error
+	stopListenerFunc       func(string) error
 )
 
+// DNSListener describes a single protocol listener serving DNS queries.
+type DNSListener struct {
+	Protocol string
+	Address  string
+	Enabled  bool
+	Running  bool
+}
+
 // ServerListenerInfo describes runtime listener configuration for status output.
 type ServerListenerInfo struct {
-	DNSProtocol         string
-	DNSListeners        []string
+	DNSListeners        []DNSListener
 	APIEndpoint         string
 	APIEnabled          bool
 	APIRunning          bool
@@ -42,12 +60,15 @@ type ServerListenerInfo struct {
 }
 
 // RegisterServerControlHooks wires runtime control functions for server commands.
-func RegisterServerControlHooks(stop func(), restart func(string), status func() bool, startAPI func(string), listeners func() ServerListenerInfo) {
+// startListener and stopListener control the encrypted listeners by name (e.g. "dot").
+func RegisterServerControlHooks(stop func(), restart func(string), status func() bool, startAPI func(string), listeners func() ServerListenerInfo, startListener func(string) error, stopListener func(string) error) {
 	stopDNSServerFunc = stop
 	restartDNSServerFunc = restart
 	getServerStatusFunc = status
 	startGinAPIFunc = startAPI
 	getServerListenersFunc = listeners
+	startListenerFunc = startListener
+	stopListenerFunc = stopListener
 }
 
 var captureMu sync.Mutex
@@ -217,6 +238,84 @@ func commandErrorFromCacheErr(err error) *tui.CommandError {
 	return &tui.CommandError{Err: err, Message: err.Error(), Severity: severity}
 }
 
+func convertBlocklistMessages(msgs []blocklist.Message) []tui.OutputMessage {
+	converted := make([]tui.OutputMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		level := tui.SeverityInfo
+		switch msg.Level {
+		case blocklist.LevelWarn:
+			level = tui.SeverityWarning
+		case blocklist.LevelError:
+			level = tui.SeverityError
+		}
+		converted = append(converted, tui.OutputMessage{Level: level, Content: msg.Text})
+	}
+	return converted
+}
+
+func commandErrorFromBlocklistErr(err error) *tui.CommandError {
+	if err == nil {
+		return nil
+	}
+	severity := tui.SeverityError
+	if errors.Is(err, blocklist.ErrInvalidArgs) {
+		severity = tui.SeverityWarning
+	}
+	return &tui.CommandError{Err: err, Message: err.Error(), Severity: severity}
+}
+
+func convertPolicyMessages(msgs []policy.Message) []tui.OutputMessage {
+	converted := make([]tui.OutputMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		level := tui.SeverityInfo
+		switch msg.Level {
+		case policy.LevelWarn:
+			level = tui.SeverityWarning
+		case policy.LevelError:
+			level = tui.SeverityError
+		}
+		converted = append(converted, tui.OutputMessage{Level: level, Content: msg.Text})
+	}
+	return converted
+}
+
+func commandErrorFromPolicyErr(err error) *tui.CommandError {
+	if err == nil {
+		return nil
+	}
+	severity := tui.SeverityError
+	if errors.Is(err, policy.ErrInvalidArgs) {
+		severity = tui.SeverityWarning
+	}
+	return &tui.CommandError{Err: err, Message: err.Error(), Severity: severity}
+}
+
+func convertRPZMessages(msgs []rpz.Message) []tui.OutputMessage {
+	converted := make([]tui.OutputMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		level := tui.SeverityInfo
+		switch msg.Level {
+		case rpz.LevelWarn:
+			level = tui.SeverityWarning
+		case rpz.LevelError:
+			level = tui.SeverityError
+		}
+		converted = append(converted, tui.OutputMessage{Level: level, Content: msg.Text})
+	}
+	return converted
+}
+
+func commandErrorFromRPZErr(err error) *tui.CommandError {
+	if err == nil {
+		return nil
+	}
+	severity := tui.SeverityError
+	if errors.Is(err, rpz.ErrInvalidArgs) {
+		severity = tui.SeverityWarning
+	}
+	return &tui.CommandError{Err: err, Message: err.Error(), Severity: severity}
+}
+
 func commandErrorFromServerErr(err error) *tui.CommandError {
 	if err == nil {
 		return nil
@@ -266,6 +365,9 @@ func registerContexts() {
 		{name: "record", description: "- Record Management", tags: []string{"dns", "records"}},
 		{name: "cache", description: "- Cache Management", tags: []string{"cache"}},
 		{name: "dns", description: "- DNS Server Management", tags: []string{"dns", "servers"}},
+		{name: "blocklist", description: "- Blocklist Management", tags: []string{"blocklist", "filtering"}},
+		{name: "policy", description: "- Allow/Deny Policy Management", tags: []string{"policy", "filtering"}},
+		{name: "rpz", description: "- Response Policy Zone Management", tags: []string{"rpz", "filtering"}},
 		{name: "server", description: "- Server Management", tags: []string{"server"}},
 	}
 	for _, ctx := range contexts {
@@ -412,7 +514,7 @@ func runCacheList() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult
 			)
 			return tui.CommandResult{Status: tui.StatusSuccess, Messages: msgs}
 		}
-		cache := dnsrecordcache.List(data.GetInstance().CacheRecords)
+		cache := data.GetInstance().GetCache().Records()
 		result := tui.CommandResult{Status: tui.StatusSuccess, Payload: cache}
 		rt.Session().Set("cache:last_count", len(cache))
 		renderCacheTable(rt.Output(), cache)
@@ -425,8 +527,7 @@ func runCacheList() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult
 
 func runCacheRemove() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult {
 	return func(rt tui.CommandRuntime, input tui.CommandInput) tui.CommandResult {
-		dnsData := data.GetInstance()
-		updated, msgs, err := dnsrecordcache.Remove(input.Raw, dnsData.CacheRecords)
+		msgs, err := dnsrecordcache.Remove(input.Raw, data.GetInstance().GetCache())
 		result := tui.CommandResult{Status: tui.StatusSuccess, Messages: convertRecordMessages(msgs)}
 		if errors.Is(err, dnsrecordcache.ErrHelpRequested) {
 			return result
@@ -436,8 +537,6 @@ func runCacheRemove() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResu
 			result.Error = commandErrorFromCacheErr(err)
 			return result
 		}
-		dnsData.UpdateCacheRecordsInMemory(updated)
-		result.Payload = updated
 		return result
 	}
 }
@@ -456,8 +555,7 @@ func runCacheClear() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResul
 			msgs := append(warnMessages("cache clear does not accept arguments."), infoMessages("Usage: cache clear")...)
 			return tui.CommandResult{Status: tui.StatusFailed, Messages: msgs, Error: &tui.CommandError{Message: "unexpected arguments", Severity: tui.SeverityWarning}}
 		}
-		dnsData := data.GetInstance()
-		dnsData.UpdateCacheRecordsInMemory([]dnsrecordcache.CacheRecord{})
+		data.GetInstance().GetCache().Clear()
 		return tui.CommandResult{Status: tui.StatusSuccess, Messages: infoMessages("Cache cleared.")}
 	}
 }
@@ -476,9 +574,8 @@ func runCacheLoad() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult
 			msgs := append(warnMessages("cache load does not accept arguments."), infoMessages("Usage: cache load")...)
 			return tui.CommandResult{Status: tui.StatusFailed, Messages: msgs, Error: &tui.CommandError{Message: "unexpected arguments", Severity: tui.SeverityWarning}}
 		}
-		dnsData := data.GetInstance()
 		cache := data.LoadCacheRecords()
-		dnsData.UpdateCacheRecordsInMemory(cache)
+		data.GetInstance().GetCache().Load(cache)
 		return tui.CommandResult{Status: tui.StatusSuccess, Payload: cache, Messages: infoMessages("Cache records loaded.")}
 	}
 }
@@ -497,8 +594,7 @@ func runCacheSave() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult
 			msgs := append(warnMessages("cache save does not accept arguments."), infoMessages("Usage: cache save")...)
 			return tui.CommandResult{Status: tui.StatusFailed, Messages: msgs, Error: &tui.CommandError{Message: "unexpected arguments", Severity: tui.SeverityWarning}}
 		}
-		dnsData := data.GetInstance()
-		if err := data.SaveCacheRecords(dnsData.CacheRecords); err != nil {
+		if err := data.GetInstance().SaveCache(); err != nil {
 			return tui.CommandResult{Status: tui.StatusFailed, Error: &tui.CommandError{Err: err, Message: err.Error(), Severity: tui.SeverityError}}
 		}
 		return tui.CommandResult{Status: tui.StatusSuccess, Messages: infoMessages("Cache records saved.")}
@@ -580,6 +676,51 @@ func runDNSUpdate() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult
 	}
 }
 
+func runDNSRoute() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult {
+	return func(rt tui.CommandRuntime, input tui.CommandInput) tui.CommandResult {
+		usage := infoMessages(
+			"Usage: dns route <add|remove|list> [address] [domain]",
+			"Description: Forward queries under a domain suffix only to the given upstream server.",
+			"Hint: append '?', 'help', or 'h' after the command to view this usage.",
+		)
+		if len(input.Raw) == 0 || cliutil.IsHelpRequest(input.Raw) {
+			return tui.CommandResult{Status: tui.StatusSuccess, Messages: usage}
+		}
+
+		dnsData := data.GetInstance()
+		action := strings.ToLower(input.Raw[0])
+		args := input.Raw[1:]
+		switch action {
+		case "list", "ls":
+			listResult := dnsservers.ListRoutes(dnsData.GetServers())
+			rt.Session().Set("dns:last_route_count", len(listResult.Routes))
+			renderDNSRouteTable(rt.Output(), listResult.Routes)
+			return tui.CommandResult{Status: tui.StatusSuccess, Payload: listResult.Routes, Messages: convertServerMessages(listResult.Messages)}
+		case "add", "remove":
+			apply := dnsservers.AddRoute
+			if action == "remove" {
+				apply = dnsservers.RemoveRoute
+			}
+			updated, msgs, err := apply(args, dnsData.GetServers())
+			result := tui.CommandResult{Status: tui.StatusSuccess, Messages: convertServerMessages(msgs)}
+			if errors.Is(err, dnsservers.ErrHelpRequested) {
+				return result
+			}
+			if err != nil {
+				result.Status = tui.StatusFailed
+				result.Error = commandErrorFromServerErr(err)
+				return result
+			}
+			dnsData.UpdateServers(updated)
+			result.Payload = updated
+			return result
+		default:
+			msgs := append(warnMessages(fmt.Sprintf("Unknown route action: %s", input.Raw[0])), usage...)
+			return tui.CommandResult{Status: tui.StatusFailed, Messages: msgs, Error: &tui.CommandError{Message: "unknown action", Severity: tui.SeverityWarning}}
+		}
+	}
+}
+
 func runDNSClear() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult {
 	return func(rt tui.CommandRuntime, input tui.CommandInput) tui.CommandResult {
 		if cliutil.IsHelpRequest(input.Raw) {
@@ -643,6 +784,368 @@ func runDNSSave() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult {
 	}
 }
 
+func runBlocklistList() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult {
+	return func(rt tui.CommandRuntime, input tui.CommandInput) tui.CommandResult {
+		if cliutil.IsHelpRequest(input.Raw) {
+			msgs := infoMessages(
+				"Usage: blocklist list",
+				"Description: Show the configured blocklists with their rule counts and load status.",
+				"Hint: append '?', 'help', or 'h' after the command to view this usage.",
+			)
+			return tui.CommandResult{Status: tui.StatusSuccess, Messages: msgs}
+		}
+		dnsData := data.GetInstance()
+		statuses := dnsData.GetBlocklist().Status()
+		rt.Session().Set("blocklist:last_count", len(statuses))
+		renderBlocklistTable(rt.Output(), statuses)
+		result := tui.CommandResult{Status: tui.StatusSuccess, Payload: statuses}
+		if len(statuses) == 0 {
+			result.Messages = infoMessages("No blocklists configured.")
+			return result
+		}
+		result.Messages = infoMessages(fmt.Sprintf("%d rules in use; blocked queries are answered with %s.", dnsData.GetBlocklist().Len(), dnsData.GetResolverSettings().Blocklist.Response))
+		return result
+	}
+}
+
+// runBlocklistChange adds or removes a blocklist, saves the settings and
+// reloads the lists. Lists added by URL are downloaded in the background.
+func runBlocklistChange(apply func([]string, config.BlocklistSettings, string) (config.BlocklistSettings, []blocklist.Message, error)) func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult {
+	return func(rt tui.CommandRuntime, input tui.CommandInput) tui.CommandResult {
+		dnsData := data.GetInstance()
+		settings := dnsData.GetResolverSettings()
+		updated, msgs, err := apply(input.Raw, settings.Blocklist, data.ConfigDir())
+		result := tui.CommandResult{Status: tui.StatusSuccess, Messages: convertBlocklistMessages(msgs)}
+		if errors.Is(err, blocklist.ErrHelpRequested) {
+			return result
+		}
+		if err != nil {
+			result.Status = tui.StatusFailed
+			result.Error = commandErrorFromBlocklistErr(err)
+			return result
+		}
+		settings.Blocklist = updated
+		dnsData.UpdateSettings(settings)
+		statuses := dnsData.GetBlocklist().Load(updated)
+		go dnsData.RefreshBlocklists()
+		renderBlocklistTable(rt.Output(), statuses)
+		result.Payload = statuses
+		return result
+	}
+}
+
+func runBlocklistReload() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult {
+	return func(rt tui.CommandRuntime, input tui.CommandInput) tui.CommandResult {
+		if cliutil.IsHelpRequest(input.Raw) {
+			msgs := infoMessages(
+				"Usage: blocklist reload",
+				"Description: Read every blocklist file and the downloaded copies of URL lists again. Lists that cannot be read keep their previous rules.",
+				"Hint: append '?', 'help', or 'h' after the command to view this usage.",
+			)
+			return tui.CommandResult{Status: tui.StatusSuccess, Messages: msgs}
+		}
+		if len(input.Raw) > 0 {
+			msgs := append(warnMessages("blocklist reload does not accept arguments."), infoMessages("Usage: blocklist reload")...)
+			return tui.CommandResult{Status: tui.StatusFailed, Messages: msgs, Error: &tui.CommandError{Message: "unexpected arguments", Severity: tui.SeverityWarning}}
+		}
+		dnsData := data.GetInstance()
+		statuses := dnsData.GetBlocklist().Load(dnsData.GetResolverSettings().Blocklist)
+		renderBlocklistTable(rt.Output(), statuses)
+		return tui.CommandResult{Status: tui.StatusSuccess, Payload: statuses, Messages: infoMessages(fmt.Sprintf("Blocklists reloaded: %d rules in use.", dnsData.GetBlocklist().Len()))}
+	}
+}
+
+func runBlocklistRefresh() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult {
+	return func(rt tui.CommandRuntime, input tui.CommandInput) tui.CommandResult {
+		usage := infoMessages(
+			"Usage: blocklist refresh [URL]",
+			"Description: Check blocklists added by URL for changes now, or only the given one. Lists whose download fails keep their previous rules.",
+			"Hint: append '?', 'help', or 'h' after the command to view this usage.",
+		)
+		if cliutil.IsHelpRequest(input.Raw) {
+			return tui.CommandResult{Status: tui.StatusSuccess, Messages: usage}
+		}
+		if len(input.Raw) > 1 {
+			msgs := append(warnMessages("blocklist refresh accepts at most one URL."), usage...)
+			return tui.CommandResult{Status: tui.StatusFailed, Messages: msgs, Error: &tui.CommandError{Message: "unexpected arguments", Severity: tui.SeverityWarning}}
+		}
+		dnsData := data.GetInstance()
+		var sources []string
+		for _, subscription := range dnsData.GetResolverSettings().Blocklist.URLs {
+			if len(input.Raw) == 0 || input.Raw[0] == subscription.URL {
+				sources = append(sources, subscription.URL)
+			}
+		}
+		if len(sources) == 0 {
+			msgs := warnMessages("No blocklists added by URL to refresh.")
+			if len(input.Raw) == 1 {
+				msgs = warnMessages(fmt.Sprintf("Blocklist not found: %s", input.Raw[0]))
+			}
+			return tui.CommandResult{Status: tui.StatusFailed, Messages: msgs, Error: &tui.CommandError{Message: "no blocklist to refresh", Severity: tui.SeverityWarning}}
+		}
+		statuses := make([]blocklist.Status, 0, len(sources))
+		failed := 0
+		for _, source := range sources {
+			status := dnsData.GetBlocklist().Refresh(source)
+			if status.Error != "" {
+				failed++
+			}
+			statuses = append(statuses, status)
+		}
+		renderBlocklistTable(rt.Output(), statuses)
+		result := tui.CommandResult{Status: tui.StatusSuccess, Payload: statuses, Messages: infoMessages(fmt.Sprintf("Blocklists refreshed: %d rules in use.", dnsData.GetBlocklist().Len()))}
+		if failed > 0 {
+			result.Messages = warnMessages(fmt.Sprintf("%d of %d blocklists failed to refresh and keep their previous rules.", failed, len(sources)))
+		}
+		return result
+	}
+}
+
+func runPolicyList() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult {
+	return func(rt tui.CommandRuntime, input tui.CommandInput) tui.CommandResult {
+		if cliutil.IsHelpRequest(input.Raw) {
+			msgs := infoMessages(
+				"Usage: policy list",
+				"Description: Show the allow and deny rules with their numbers.",
+				"Hint: append '?', 'help', or 'h' after the command to view this usage.",
+			)
+			return tui.CommandResult{Status: tui.StatusSuccess, Messages: msgs}
+		}
+		rules := data.GetInstance().GetPolicyRules()
+		rt.Session().Set("policy:last_count", len(rules))
+		renderPolicyTable(rt.Output(), rules)
+		result := tui.CommandResult{Status: tui.StatusSuccess, Payload: rules}
+		if len(rules) == 0 {
+			result.Messages = infoMessages("No policy rules configured.")
+		}
+		return result
+	}
+}
+
+// runPolicyChange adds or removes a policy rule and saves the rules.
+func runPolicyChange(apply func([]string, []policy.Rule) ([]policy.Rule, []policy.Message, error)) func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult {
+	return func(rt tui.CommandRuntime, input tui.CommandInput) tui.CommandResult {
+		dnsData := data.GetInstance()
+		updated, msgs, err := apply(input.Raw, dnsData.GetPolicyRules())
+		result := tui.CommandResult{Status: tui.StatusSuccess, Messages: convertPolicyMessages(msgs)}
+		if errors.Is(err, policy.ErrHelpRequested) {
+			return result
+		}
+		if err != nil {
+			result.Status = tui.StatusFailed
+			result.Error = commandErrorFromPolicyErr(err)
+			return result
+		}
+		result.Payload = updated
+		if err := dnsData.UpdatePolicyRules(updated); err != nil {
+			result.Status = tui.StatusFailed
+			result.Error = &tui.CommandError{Err: err, Message: "rules are in use but could not be saved: " + err.Error(), Severity: tui.SeverityError}
+		}
+		return result
+	}
+}
+
+func runPolicyTest() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult {
+	return func(rt tui.CommandRuntime, input tui.CommandInput) tui.CommandResult {
+		name, qtype, msgs, err := policy.ParseTest(input.Raw)
+		result := tui.CommandResult{Status: tui.StatusSuccess, Messages: convertPolicyMessages(msgs)}
+		if errors.Is(err, policy.ErrHelpRequested) {
+			return result
+		}
+		if err != nil {
+			result.Status = tui.StatusFailed
+			result.Error = commandErrorFromPolicyErr(err)
+			return result
+		}
+		decision := data.GetInstance().TestPolicy(name, qtype)
+		result.Payload = decision
+		result.Messages = infoMessages(decision.String())
+		return result
+	}
+}
+
+func runRPZList() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult {
+	return func(rt tui.CommandRuntime, input tui.CommandInput) tui.CommandResult {
+		if cliutil.IsHelpRequest(input.Raw) {
+			msgs := infoMessages(
+				"Usage: rpz list",
+				"Description: Show the response policy zones in order of precedence with their serials, rule counts and status.",
+				"Hint: append '?', 'help', or 'h' after the command to view this usage.",
+			)
+			return tui.CommandResult{Status: tui.StatusSuccess, Messages: msgs}
+		}
+		dnsData := data.GetInstance()
+		statuses := dnsData.GetRPZ().Status()
+		rt.Session().Set("rpz:last_count", len(statuses))
+		renderRPZTable(rt.Output(), statuses)
+		result := tui.CommandResult{Status: tui.StatusSuccess, Payload: statuses}
+		if len(statuses) == 0 {
+			result.Messages = infoMessages("No response policy zones configured.")
+			return result
+		}
+		result.Messages = infoMessages(fmt.Sprintf("%d rules in use.", dnsData.GetRPZ().Len()))
+		return result
+	}
+}
+
+// runRPZChange adds or removes a response policy zone, saves the settings
+// and reloads the zones. Zones with a primary are transferred in the
+// background.
+func runRPZChange(apply func([]string, []config.RPZZone, string) ([]config.RPZZone, []rpz.Message, error)) func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult {
+	return func(rt tui.CommandRuntime, input tui.CommandInput) tui.CommandResult {
+		dnsData := data.GetInstance()
+		settings := dnsData.GetResolverSettings()
+		updated, msgs, err := apply(input.Raw, settings.RPZ, data.ConfigDir())
+		result := tui.CommandResult{Status: tui.StatusSuccess, Messages: convertRPZMessages(msgs)}
+		if errors.Is(err, rpz.ErrHelpRequested) {
+			return result
+		}
+		if err != nil {
+			result.Status = tui.StatusFailed
+			result.Error = commandErrorFromRPZErr(err)
+			return result
+		}
+		settings.RPZ = updated
+		dnsData.UpdateSettings(settings)
+		statuses := dnsData.GetRPZ().Load(updated)
+		go dnsData.RefreshRPZ()
+		renderRPZTable(rt.Output(), statuses)
+		result.Payload = statuses
+		return result
+	}
+}
+
+func runRPZReload() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult {
+	return func(rt tui.CommandRuntime, input tui.CommandInput) tui.CommandResult {
+		if cliutil.IsHelpRequest(input.Raw) {
+			msgs := infoMessages(
+				"Usage: rpz reload",
+				"Description: Read every zone file again. Zones that cannot be read keep their previous rules.",
+				"Hint: append '?', 'help', or 'h' after the command to view this usage.",
+			)
+			return tui.CommandResult{Status: tui.StatusSuccess, Messages: msgs}
+		}
+		if len(input.Raw) > 0 {
+			msgs := append(warnMessages("rpz reload does not accept arguments."), infoMessages("Usage: rpz reload")...)
+			return tui.CommandResult{Status: tui.StatusFailed, Messages: msgs, Error: &tui.CommandError{Message: "unexpected arguments", Severity: tui.SeverityWarning}}
+		}
+		dnsData := data.GetInstance()
+		statuses := dnsData.GetRPZ().Load(dnsData.GetResolverSettings().RPZ)
+		renderRPZTable(rt.Output(), statuses)
+		return tui.CommandResult{Status: tui.StatusSuccess, Payload: statuses, Messages: infoMessages(fmt.Sprintf("Response policy zones reloaded: %d rules in use.", dnsData.GetRPZ().Len()))}
+	}
+}
+
+func runRPZRefresh() func(tui.CommandRuntime, tui.CommandInput) tui.CommandResult {
+	return func(rt tui.CommandRuntime, input tui.CommandInput) tui.CommandResult {
+		usage := infoMessages(
+			"Usage: rpz refresh [Name]",
+			"Description: Ask the primaries of the response policy zones, or only the named zone, for a new serial now and transfer zones that changed.",
+			"Hint: append '?', 'help', or 'h' after the command to view this usage.",
+		)
+		if cliutil.IsHelpRequest(input.Raw) {
+			return tui.CommandResult{Status: tui.StatusSuccess, Messages: usage}
+		}
+		if len(input.Raw) > 1 {
+			msgs := append(warnMessages("rpz refresh accepts at most one zone name."), usage...)
+			return tui.CommandResult{Status: tui.StatusFailed, Messages: msgs, Error: &tui.CommandError{Message: "unexpected arguments", Severity: tui.SeverityWarning}}
+		}
+		dnsData := data.GetInstance()
+		var zones []config.RPZZone
+		for _, zone := range dnsData.GetResolverSettings().RPZ {
+			if zone.Primary != "" && (len(input.Raw) == 0 || strings.TrimSuffix(strings.ToLower(input.Raw[0]), ".") == zone.Name) {
+				zones = append(zones, zone)
+			}
+		}
+		if len(zones) == 0 {
+			msgs := warnMessages("No response policy zones with a primary to refresh.")
+			if len(input.Raw) == 1 {
+				msgs = warnMessages(fmt.Sprintf("Response policy zone with a primary not found: %s", input.Raw[0]))
+			}
+			return tui.CommandResult{Status: tui.StatusFailed, Messages: msgs, Error: &tui.CommandError{Message: "no zone to refresh", Severity: tui.SeverityWarning}}
+		}
+		statuses := make([]rpz.Status, 0, len(zones))
+		failed := 0
+		for _, zone := range zones {
+			status := dnsData.GetRPZ().Transfer(zone)
+			if status.Error != "" {
+				failed++
+			}
+			statuses = append(statuses, status)
+		}
+		renderRPZTable(rt.Output(), statuses)
+		result := tui.CommandResult{Status: tui.StatusSuccess, Payload: statuses, Messages: infoMessages(fmt.Sprintf("Response policy zones refreshed: %d rules in use.", dnsData.GetRPZ().Len()))}
+		if failed > 0 {
+			result.Messages = warnMessages(fmt.Sprintf("%d of %d zones failed to transfer and keep their previous rules.", failed, len(zones)))
+		}
+		return result
+	}
+}
+
+func renderRPZTable(out tui.OutputChannel, statuses []rpz.Status) {
+	if len(statuses) == 0 {
+		return
+	}
+	rows := make([][]string, 0, len(statuses))
+	for _, status := range statuses {
+		loaded, checked := "", ""
+		if !status.Loaded.IsZero() {
+			loaded = status.Loaded.Format(time.RFC3339)
+		}
+		if !status.Checked.IsZero() {
+			checked = status.Checked.Format(time.RFC3339)
+		}
+		state := "ok"
+		if status.Error != "" {
+			state = status.Error
+		} else if status.Skipped > 0 {
+			state = fmt.Sprintf("ok, %d unsupported records skipped", status.Skipped)
+		}
+		rows = append(rows, []string{status.Name, status.Source, fmt.Sprintf("%d", status.Serial), fmt.Sprintf("%d", status.Rules), loaded, checked, state})
+	}
+	out.WriteTable([]string{"Zone", "Source", "Serial", "Rules", "Loaded", "Checked", "Status"}, rows)
+	tui.EnsureLineBreak(out)
+}
+
+func renderPolicyTable(out tui.OutputChannel, rules []policy.Rule) {
+	if len(rules) == 0 {
+		return
+	}
+	rows := make([][]string, 0, len(rules))
+	for i, rule := range rules {
+		types := "any"
+		if len(rule.Types) > 0 {
+			types = strings.Join(rule.Types, ", ")
+		}
+		rows = append(rows, []string{fmt.Sprintf("%d", i+1), rule.Action, rule.Match, rule.Pattern, types})
+	}
+	out.WriteTable([]string{"#", "Action", "Match", "Pattern", "Types"}, rows)
+	tui.EnsureLineBreak(out)
+}
+
+func renderBlocklistTable(out tui.OutputChannel, statuses []blocklist.Status) {
+	if len(statuses) == 0 {
+		return
+	}
+	rows := make([][]string, 0, len(statuses))
+	for _, status := range statuses {
+		loaded, checked := "", ""
+		if !status.Loaded.IsZero() {
+			loaded = status.Loaded.Format(time.RFC3339)
+		}
+		if !status.Checked.IsZero() {
+			checked = status.Checked.Format(time.RFC3339)
+		}
+		state := "ok"
+		if status.Error != "" {
+			state = status.Error
+		}
+		rows = append(rows, []string{status.Source, fmt.Sprintf("%d", status.Rules), loaded, checked, state})
+	}
+	out.WriteTable([]string{"Source", "Rules", "Loaded", "Checked", "Status"}, rows)
+	tui.EnsureLineBreak(out)
+}
+
 func renderRecordTable(out tui.OutputChannel, records []dnsrecords.DNSRecord) {
 	if len(records) == 0 {
 		return
@@ -693,13 +1196,32 @@ func renderCacheTable(out tui.OutputChannel, cache []dnsrecordcache.CacheRecord)
 		expires := ""
 		if !record.Expiry.IsZero() {
 			expires = record.Expiry.Format(time.RFC3339)
+			if time.Now().After(record.Expiry) {
+				expires += " (stale)"
+			}
+		}
+		values := record.Values()
+		if record.Negative {
+			values = []string{formatNegativeCacheValue(record)}
+		}
+		for _, value := range values {
+			rows = append(rows, []string{record.DNSRecord.Name, record.DNSRecord.Type, value, fmt.Sprintf("%d", record.DNSRecord.TTL), expires})
 		}
-		rows = append(rows, []string{record.DNSRecord.Name, record.DNSRecord.Type, record.DNSRecord.Value, fmt.Sprintf("%d", record.DNSRecord.TTL), expires})
 	}
 	out.WriteTable([]string{"Name", "Type", "Value", "TTL", "Expires"}, rows)
 	tui.EnsureLineBreak(out)
 }
 
+// formatNegativeCacheValue marks a cached NXDOMAIN or NODATA answer and names
+// the zone whose SOA supplied its TTL.
+func formatNegativeCacheValue(record dnsrecordcache.CacheRecord) string {
+	label := "!" + record.NegativeLabel()
+	if soa := record.SOA(0); soa != nil {
+		return fmt.Sprintf("%s (SOA %s)", label, soa.Header().Name)
+	}
+	return label
+}
+
 func renderDNSServerTable(out tui.OutputChannel, servers []dnsservers.DNSServer) {
 	if len(servers) == 0 {
 		return
@@ -709,12 +1231,61 @@ func renderDNSServerTable(out tui.OutputChannel, servers []dnsservers.DNSServer)
 		rows = append(rows, []string{
 			server.Address,
 			server.Port,
+			formatServerProtocol(server),
 			fmt.Sprintf("%t", server.Active),
 			fmt.Sprintf("%t", server.LocalResolver),
 			fmt.Sprintf("%t", server.AdBlocker),
+			strings.Join(server.Domains, ", "),
+			formatServerHealth(server),
+			formatServerRTT(server),
 		})
 	}
-	out.WriteTable([]string{"Address", "Port", "Active", "Local", "AdBlocker"}, rows)
+	out.WriteTable([]string{"Address", "Port", "Protocol", "Active", "Local", "AdBlocker", "Domains", "Health", "Last RTT"}, rows)
+	tui.EnsureLineBreak(out)
+}
+
+func formatServerProtocol(server dnsservers.DNSServer) string {
+	protocol := server.Protocol
+	if protocol == "" {
+		protocol = upstream.ProtocolUDP
+	}
+	if protocol == upstream.ProtocolHTTPS {
+		if parsed, err := url.Parse(server.URL); err == nil {
+			return protocol + " " + parsed.RequestURI()
+		}
+	}
+	if server.ServerName != "" {
+		return fmt.Sprintf("%s (%s)", protocol, server.ServerName)
+	}
+	return protocol
+}
+
+func formatServerHealth(server dnsservers.DNSServer) string {
+	if !server.Active {
+		return "-"
+	}
+	if server.Health == "" {
+		return "unknown"
+	}
+	return server.Health
+}
+
+func formatServerRTT(server dnsservers.DNSServer) string {
+	if server.LastRTT <= 0 {
+		return "-"
+	}
+	return server.LastRTT.Round(time.Microsecond * 10).String()
+}
+
+func renderDNSRouteTable(out tui.OutputChannel, routes []dnsservers.Route) {
+	if len(routes) == 0 {
+		return
+	}
+	rows := make([][]string, 0, len(routes))
+	for _, route := range routes {
+		rows = append(rows, []string{route.Domain, strings.Join(route.Servers, ", ")})
+	}
+	out.WriteTable([]string{"Domain", "Servers"}, rows)
 	tui.EnsureLineBreak(out)
 }
 
@@ -878,9 +1449,12 @@ func RegisterCommands() {
 			Name:        "add",
 			Summary:     "Add upstream DNS server",
 			Description: "Adds an upstream DNS server definition.",
-			Usage:       "dns add <address> [port]",
+			Usage:       "dns add <address> [port] [timeout=<duration>] [retries=<n>]",
 			Category:    "Upstream Servers",
 			Tags:        []string{"dns", "servers", "add"},
+			Args: []tui.ArgSpec{
+				{Name: "params", Description: "Address [Port] [Active] [LocalResolver] [AdBlocker] [options]", Repeatable: true},
+			},
 		}, runDNSAdd()),
 		newLegacyFactory(tui.CommandSpec{
 			Context:     "dns",
@@ -890,15 +1464,21 @@ func RegisterCommands() {
 			Usage:       "dns remove <address> [port]",
 			Category:    "Upstream Servers",
 			Tags:        []string{"dns", "servers", "remove"},
+			Args: []tui.ArgSpec{
+				{Name: "params", Description: "Address", Repeatable: true},
+			},
 		}, runDNSRemove()),
 		newLegacyFactory(tui.CommandSpec{
 			Context:     "dns",
 			Name:        "update",
 			Summary:     "Update upstream DNS server",
 			Description: "Updates an existing upstream DNS server definition.",
-			Usage:       "dns update <address> [port]",
+			Usage:       "dns update <address> [port] [timeout=<duration>] [retries=<n>]",
 			Category:    "Upstream Servers",
 			Tags:        []string{"dns", "servers", "update"},
+			Args: []tui.ArgSpec{
+				{Name: "params", Description: "Address [Port] [Active] [LocalResolver] [AdBlocker] [options]", Repeatable: true},
+			},
 		}, runDNSUpdate()),
 		newLegacyFactory(tui.CommandSpec{
 			Context:     "dns",
@@ -909,6 +1489,23 @@ func RegisterCommands() {
 			Category:    "Upstream Servers",
 			Tags:        []string{"dns", "servers", "list"},
 		}, runDNSList()),
+		newLegacyFactory(tui.CommandSpec{
+			Context:     "dns",
+			Name:        "route",
+			Summary:     "Manage conditional forwarding",
+			Description: "Routes queries under a domain suffix to specific upstream servers. The longest matching suffix wins; other queries use servers without routes.",
+			Usage:       "dns route <add|remove|list> [address] [domain]",
+			Category:    "Upstream Servers",
+			Tags:        []string{"dns", "servers", "route"},
+			Args: []tui.ArgSpec{
+				{Name: "action", Description: "add, remove or list", Required: false},
+				{Name: "params", Description: "Address Domain", Repeatable: true},
+			},
+			Examples: []tui.Example{
+				{Description: "Send corp queries to the VPN resolver", Command: "dns route add 10.8.0.1 corp.example.com"},
+				{Description: "List routes", Command: "dns route list"},
+			},
+		}, runDNSRoute()),
 		newLegacyFactory(tui.CommandSpec{
 			Context:     "dns",
 			Name:        "clear",
@@ -937,12 +1534,180 @@ func RegisterCommands() {
 			Tags:        []string{"dns", "servers", "save"},
 		}, runDNSSave()),
 
+		newLegacyFactory(tui.CommandSpec{
+			Context:     "blocklist",
+			Name:        "add",
+			Summary:     "Add a blocklist file or URL",
+			Description: "Adds a hosts, plain domain or Adblock style (||domain^) list and reloads the blocklists. Lists added by URL are downloaded in the background and checked for changes every refresh interval.",
+			Usage:       "blocklist add <file|url> [refresh=<duration>]",
+			Category:    "Blocklists",
+			Tags:        []string{"blocklist", "add"},
+			Args: []tui.ArgSpec{
+				{Name: "file|url", Description: "List file, relative paths are resolved against the config directory, or http(s) URL", Required: false},
+				{Name: "refresh", Description: "How often a URL list is checked for changes (default 24h)", Required: false},
+			},
+			Examples: []tui.Example{
+				{Description: "Block ads", Command: "blocklist add /etc/dnsplane/ads.txt"},
+				{Description: "Subscribe to a list", Command: "blocklist add https://example.com/hosts.txt refresh=12h"},
+			},
+		}, runBlocklistChange(blocklist.Add)),
+		newLegacyFactory(tui.CommandSpec{
+			Context:     "blocklist",
+			Name:        "remove",
+			Summary:     "Remove a blocklist file or URL",
+			Description: "Stops using a blocklist and reloads the blocklists.",
+			Usage:       "blocklist remove <file|url>",
+			Category:    "Blocklists",
+			Tags:        []string{"blocklist", "remove"},
+			Args:        []tui.ArgSpec{{Name: "file|url", Description: "List file or URL", Required: false}},
+		}, runBlocklistChange(blocklist.Remove)),
+		newLegacyFactory(tui.CommandSpec{
+			Context:     "blocklist",
+			Name:        "list",
+			Summary:     "List blocklists",
+			Description: "Shows the configured blocklists with their rule counts, when they were loaded and last checked for changes, and their status.",
+			Usage:       "blocklist list",
+			Category:    "Blocklists",
+			Tags:        []string{"blocklist", "list"},
+		}, runBlocklistList()),
+		newLegacyFactory(tui.CommandSpec{
+			Context:     "blocklist",
+			Name:        "reload",
+			Summary:     "Reload blocklists",
+			Description: "Reads every blocklist file and the downloaded copies of URL lists again.",
+			Usage:       "blocklist reload",
+			Category:    "Blocklists",
+			Tags:        []string{"blocklist", "reload"},
+		}, runBlocklistReload()),
+		newLegacyFactory(tui.CommandSpec{
+			Context:     "blocklist",
+			Name:        "refresh",
+			Summary:     "Refresh blocklists added by URL",
+			Description: "Checks blocklists added by URL for changes now instead of waiting for their refresh interval.",
+			Usage:       "blocklist refresh [url]",
+			Category:    "Blocklists",
+			Tags:        []string{"blocklist", "refresh", "download"},
+			Args:        []tui.ArgSpec{{Name: "url", Description: "Only refresh this list", Required: false}},
+		}, runBlocklistRefresh()),
+
+		newLegacyFactory(tui.CommandSpec{
+			Context:     "policy",
+			Name:        "add",
+			Summary:     "Add an allow or deny rule",
+			Description: "Adds a rule matching names exactly, by wildcard, by domain suffix or by regex, optionally only for some query types. Deny rules answer like blocked queries; allow rules override blocklists and deny rules.",
+			Usage:       "policy add <allow|deny> <exact|wildcard|suffix|regex> <pattern> [type...]",
+			Category:    "Policy",
+			Tags:        []string{"policy", "add", "allow", "deny"},
+			Args: []tui.ArgSpec{
+				{Name: "action", Description: "allow or deny", Required: false},
+				{Name: "match", Description: "exact, wildcard, suffix or regex", Required: false},
+				{Name: "pattern", Description: "Name, wildcard, domain or regex", Required: false},
+				{Name: "type", Description: "Query types the rule applies to (default: all)", Required: false},
+			},
+			Examples: []tui.Example{
+				{Description: "Deny a domain and its subdomains", Command: "policy add deny suffix tracker.example.com"},
+				{Description: "Allow one name despite a blocklist", Command: "policy add allow exact cdn.example.com"},
+				{Description: "Deny AAAA lookups for a pattern", Command: "policy add deny wildcard *.ipv6.example.com AAAA"},
+			},
+		}, runPolicyChange(policy.Add)),
+		newLegacyFactory(tui.CommandSpec{
+			Context:     "policy",
+			Name:        "remove",
+			Summary:     "Remove a policy rule",
+			Description: "Removes a rule by its number in policy list, or by its action, match and pattern.",
+			Usage:       "policy remove <number> | <allow|deny> <match> <pattern>",
+			Category:    "Policy",
+			Tags:        []string{"policy", "remove"},
+			Args:        []tui.ArgSpec{{Name: "number", Description: "Rule number shown by policy list", Required: false}},
+		}, runPolicyChange(policy.Remove)),
+		newLegacyFactory(tui.CommandSpec{
+			Context:     "policy",
+			Name:        "list",
+			Summary:     "List policy rules",
+			Description: "Shows the allow and deny rules with their numbers.",
+			Usage:       "policy list",
+			Category:    "Policy",
+			Tags:        []string{"policy", "list"},
+		}, runPolicyList()),
+		newLegacyFactory(tui.CommandSpec{
+			Context:     "policy",
+			Name:        "test",
+			Summary:     "Show how a query would be filtered",
+			Description: "Shows which policy rule or blocklist entry matches a name and query type, and whether the query would be denied, allowed or blocked.",
+			Usage:       "policy test <name> [type]",
+			Category:    "Policy",
+			Tags:        []string{"policy", "test"},
+			Args: []tui.ArgSpec{
+				{Name: "name", Description: "Name to test", Required: false},
+				{Name: "type", Description: "Query type (default A)", Required: false},
+			},
+			Examples: []tui.Example{{Description: "Test an AAAA query", Command: "policy test ads.example.com AAAA"}},
+		}, runPolicyTest()),
+
+		newLegacyFactory(tui.CommandSpec{
+			Context:     "rpz",
+			Name:        "add",
+			Summary:     "Add a response policy zone",
+			Description: "Adds a response policy zone from a zone file, or transferred with AXFR from a primary and saved to the file, and reloads the zones. Zones are applied in the order they were added.",
+			Usage:       "rpz add <name> [file=<file>] [primary=<host[:port]>] [refresh=<duration>]",
+			Category:    "Response Policy Zones",
+			Tags:        []string{"rpz", "add"},
+			Args: []tui.ArgSpec{
+				{Name: "name", Description: "Policy name, the zone's origin", Required: false},
+				{Name: "file", Description: "Zone file; relative paths are resolved against the config directory", Required: false},
+				{Name: "primary", Description: "Server to transfer the zone from", Required: false},
+				{Name: "refresh", Description: "How often the primary is checked for a new serial (default: the SOA refresh)", Required: false},
+			},
+			Examples: []tui.Example{
+				{Description: "Load a zone file", Command: "rpz add rpz.example.net file=/etc/dnsplane/rpz.example.net.zone"},
+				{Description: "Transfer a zone", Command: "rpz add threats.rpz.example.net primary=192.0.2.53"},
+			},
+		}, runRPZChange(rpz.Add)),
+		newLegacyFactory(tui.CommandSpec{
+			Context:     "rpz",
+			Name:        "remove",
+			Summary:     "Remove a response policy zone",
+			Description: "Stops using a response policy zone and reloads the zones.",
+			Usage:       "rpz remove <name>",
+			Category:    "Response Policy Zones",
+			Tags:        []string{"rpz", "remove"},
+			Args:        []tui.ArgSpec{{Name: "name", Description: "Policy name", Required: false}},
+		}, runRPZChange(rpz.Remove)),
+		newLegacyFactory(tui.CommandSpec{
+			Context:     "rpz",
+			Name:        "list",
+			Summary:     "List response policy zones",
+			Description: "Shows the response policy zones in order of precedence with their serials, rule counts and status.",
+			Usage:       "rpz list",
+			Category:    "Response Policy Zones",
+			Tags:        []string{"rpz", "list"},
+		}, runRPZList()),
+		newLegacyFactory(tui.CommandSpec{
+			Context:     "rpz",
+			Name:        "reload",
+			Summary:     "Reload response policy zones",
+			Description: "Reads every zone file again.",
+			Usage:       "rpz reload",
+			Category:    "Response Policy Zones",
+			Tags:        []string{"rpz", "reload"},
+		}, runRPZReload()),
+		newLegacyFactory(tui.CommandSpec{
+			Context:     "rpz",
+			Name:        "refresh",
+			Summary:     "Transfer response policy zones",
+			Description: "Checks the primaries for new serials now instead of waiting for the refresh interval, and transfers zones that changed.",
+			Usage:       "rpz refresh [name]",
+			Category:    "Response Policy Zones",
+			Tags:        []string{"rpz", "refresh", "axfr"},
+			Args:        []tui.ArgSpec{{Name: "name", Description: "Only refresh this zone", Required: false}},
+		}, runRPZRefresh()),
+
 		newLegacyFactory(tui.CommandSpec{
 			Context:     "server",
 			Name:        "start",
 			Summary:     "Start server component",
-			Description: "Starts DNS or API server components.",
-			Usage:       "server start <dns|api>",
+			Description: "Starts DNS, API or encrypted (DoT, DoH, DoQ) server components.",
+			Usage:       "server start <dns|api|dot|doh|doq>",
 			Category:    "Server",
 			Tags:        []string{"server", "start"},
 			Args:        []tui.ArgSpec{{Name: "component", Description: "Component to start", Required: false}},
@@ -951,8 +1716,8 @@ func RegisterCommands() {
 			Context:     "server",
 			Name:        "stop",
 			Summary:     "Stop server component",
-			Description: "Stops DNS or API server components.",
-			Usage:       "server stop <dns|api>",
+			Description: "Stops DNS, API or encrypted (DoT, DoH, DoQ) server components.",
+			Usage:       "server stop <dns|api|dot|doh|doq>",
 			Category:    "Server",
 			Tags:        []string{"server", "stop"},
 			Args:        []tui.ArgSpec{{Name: "component", Description: "Component to stop", Required: false}},
@@ -962,7 +1727,7 @@ func RegisterCommands() {
 			Name:        "status",
 			Summary:     "Show server status",
 			Description: "Displays listener details for DNS, API, and CLI clients.",
-			Usage:       "server status [dns|api|client]",
+			Usage:       "server status [dns|api|dot|doh|doq|client]",
 			Category:    "Server",
 			Tags:        []string{"server", "status"},
 			Args:        []tui.ArgSpec{{Name: "component", Description: "Component to inspect", Required: false}},
@@ -1063,6 +1828,9 @@ func handleServerStart(args []string) {
 			}
 			fmt.Println("API server started.")
 		},
+		"dot": func() { controlListener(startListenerFunc, "dot", "DoT", "start", "started") },
+		"doh": func() { controlListener(startListenerFunc, "doh", "DoH", "start", "started") },
+		"doq": func() { controlListener(startListenerFunc, "doq", "DoQ", "start", "started") },
 	}
 	component := strings.ToLower(args[0])
 	if cmd, ok := startCommands[component]; ok {
@@ -1074,6 +1842,19 @@ func handleServerStart(args []string) {
 	}
 }
 
+// controlListener starts or stops a named encrypted listener through the
+// registered hook and reports the outcome.
+func controlListener(control func(string) error, name, label, verb, done string) {
+	if control == nil {
+		return
+	}
+	if err := control(name); err != nil {
+		fmt.Printf("Failed to %s %s listener: %v\n", verb, label, err)
+		return
+	}
+	fmt.Printf("%s listener %s.\n", label, done)
+}
+
 func handleServerStop(args []string) {
 	if cliutil.IsHelpRequest(args) {
 		printServerStopUsage()
@@ -1095,6 +1876,9 @@ func handleServerStop(args []string) {
 		"api": func() {
 			fmt.Println("API server stop not implemented yet.")
 		},
+		"dot": func() { controlListener(stopListenerFunc, "dot", "DoT", "stop", "stopped") },
+		"doh": func() { controlListener(stopListenerFunc, "doh", "DoH", "stop", "stopped") },
+		"doq": func() { controlListener(stopListenerFunc, "doq", "DoQ", "stop", "stopped") },
 	}
 	component := strings.ToLower(args[0])
 	if cmd, ok := stopCommands[component]; ok {
@@ -1125,17 +1909,18 @@ func handleServerStatus(args []string) {
 		}
 	}
 
-	info := ServerListenerInfo{DNSProtocol: "udp"}
+	info := ServerListenerInfo{}
 	if getServerListenersFunc != nil {
 		info = getServerListenersFunc()
-		if info.DNSProtocol == "" {
-			info.DNSProtocol = "udp"
-		}
 	}
 
 	settings := data.GetInstance().GetResolverSettings()
 	if len(info.DNSListeners) == 0 {
-		info.DNSListeners = []string{fmt.Sprintf("0.0.0.0:%s", settings.DNSPort)}
+		address := fmt.Sprintf("0.0.0.0:%s", settings.DNSPort)
+		info.DNSListeners = []DNSListener{
+			{Protocol: "udp", Address: address, Enabled: true},
+			{Protocol: "tcp", Address: address, Enabled: true},
+		}
 	}
 	if info.APIEndpoint == "" {
 		info.APIEndpoint = fmt.Sprintf("0.0.0.0:%s", settings.RESTPort)
@@ -1161,11 +1946,25 @@ func handleServerStatus(args []string) {
 		return value
 	}
 
+	printListener := func(listener DNSListener) {
+		label := strings.ToUpper(listener.Protocol) + ":"
+		if !listener.Enabled {
+			fmt.Printf("  %-6s %s\n", label, formatEndpoint(listener.Address, false))
+			return
+		}
+		state := "stopped"
+		if listener.Running {
+			state = "running"
+		}
+		fmt.Printf("  %-6s %s (%s)\n", label, formatEndpoint(listener.Address, true), state)
+	}
+
 	printDNS := func() {
-		fmt.Println("DNS Listener:")
-		fmt.Printf("  Protocol: %s\n", strings.ToUpper(info.DNSProtocol))
-		fmt.Printf("  Address:  %s\n", strings.Join(info.DNSListeners, ", "))
-		fmt.Printf("  Status:   %s\n", dnsStatus)
+		fmt.Println("DNS Listeners:")
+		for _, listener := range info.DNSListeners {
+			printListener(listener)
+		}
+		fmt.Printf("  Status: %s\n", dnsStatus)
 	}
 
 	printAPI := func() {
@@ -1202,6 +2001,12 @@ func handleServerStatus(args []string) {
 		printAPI()
 	case "client", "clients":
 		printClients()
+	case "dot", "doh", "doq":
+		for _, listener := range info.DNSListeners {
+			if listener.Protocol == component {
+				printListener(listener)
+			}
+		}
 	default:
 		display := original
 		if display == "" {
@@ -1223,8 +2028,32 @@ func handleServerConfigure(args []string) {
 		fmt.Println("Current Server Configuration:")
 		fmt.Printf("DNS Port: %s\n", settings.DNSPort)
 		fmt.Printf("API Port: %s\n", settings.RESTPort)
-		fmt.Printf("Fallback Server IP: %s\n", settings.FallbackServerIP)
-		fmt.Printf("Fallback Server Port: %s\n", settings.FallbackServerPort)
+		fmt.Printf("Fallback Servers: %s\n", formatFallbackServers(settings.FallbackServers))
+		fmt.Printf("Fallback Mode: %s\n", settings.FallbackMode)
+		fmt.Printf("Upstream Strategy: %s\n", upstream.NormalizeStrategy(settings.UpstreamStrategy))
+		fmt.Printf("Upstream Timeout: %ds\n", settings.Timeout)
+		if settings.QueryDeadlineMs > 0 {
+			fmt.Printf("Query Deadline: %s\n", time.Duration(settings.QueryDeadlineMs)*time.Millisecond)
+		} else {
+			fmt.Println("Query Deadline: none")
+		}
+		fmt.Printf("Cache Max Entries: %d\n", settings.Cache.MaxEntries)
+		fmt.Printf("Cache Janitor Interval: %ds\n", settings.Cache.JanitorInterval)
+		fmt.Printf("Negative Cache Max TTL: %ds\n", settings.Cache.NegativeMaxTTL)
+		fmt.Printf("Cache Save Interval: %ds\n", settings.Cache.SaveInterval)
+		fmt.Printf("Serve Stale: %t (window: %ds, TTL: %ds)\n", settings.Cache.ServeStale, settings.Cache.StaleWindow, settings.Cache.StaleTTL)
+		fmt.Printf("Prefetch: %t (below %d%% TTL left, min hits: %d)\n", settings.Cache.Prefetch, settings.Cache.PrefetchThreshold, settings.Cache.PrefetchMinHits)
+		fmt.Printf("Blocklist Response: %s\n", settings.Blocklist.Response)
+		fmt.Printf("EDNS UDP Size: %d\n", settings.EDNS.UDPSize)
+		fmt.Printf("EDNS Client Subnet: %s\n", settings.EDNS.ClientSubnet)
+		fmt.Printf("DoT Port: %s (enabled: %t)\n", settings.DoT.Port, settings.DoT.Enabled)
+		fmt.Printf("DoH Port: %s (enabled: %t, on API: %t)\n", settings.DoH.Port, settings.DoH.Enabled, settings.DoH.OnAPI)
+		fmt.Printf("DoQ Port: %s (enabled: %t, idle timeout: %ds)\n", settings.DoQ.Port, settings.DoQ.Enabled, settings.DoQ.IdleTimeout)
+		fmt.Printf("TLS Certificate: %s\n", valueOrNone(settings.TLS.CertFile))
+		fmt.Printf("TLS Key: %s\n", valueOrNone(settings.TLS.KeyFile))
+		fmt.Printf("DNS ACL: %s\n", formatACL(settings.ACL.DNS))
+		fmt.Printf("TUI ACL: %s\n", formatACL(settings.ACL.TUI))
+		fmt.Printf("API ACL: %s\n", formatACL(settings.ACL.API))
 		return
 	}
 	if len(args) < 2 {
@@ -1246,12 +2075,212 @@ func handleServerConfigure(args []string) {
 	case "api_port":
 		settings.RESTPort = value
 		fmt.Printf("API Port set to %s\n", value)
-	case "fallback_ip":
-		settings.FallbackServerIP = value
-		fmt.Printf("Fallback Server IP set to %s\n", value)
-	case "fallback_port":
-		settings.FallbackServerPort = value
-		fmt.Printf("Fallback Server Port set to %s\n", value)
+	case "fallback":
+		servers, err := config.ParseFallbackServers(value)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		settings.FallbackServers = servers
+		fmt.Printf("Fallback Servers set to %s\n", formatFallbackServers(servers))
+	case "fallback_mode":
+		mode := strings.ToLower(value)
+		if mode != config.FallbackModeSequential && mode != config.FallbackModeParallel {
+			fmt.Printf("Unknown fallback mode: %s (available: %s, %s)\n", value, config.FallbackModeSequential, config.FallbackModeParallel)
+			return
+		}
+		settings.FallbackMode = mode
+		fmt.Printf("Fallback Mode set to %s\n", mode)
+	case "strategy":
+		if !upstream.IsValidStrategy(value) {
+			fmt.Printf("Unknown strategy: %s (available: %s)\n", value, strings.Join(upstream.Strategies, ", "))
+			return
+		}
+		settings.UpstreamStrategy = upstream.NormalizeStrategy(value)
+		fmt.Printf("Upstream Strategy set to %s\n", settings.UpstreamStrategy)
+	case "timeout":
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			fmt.Printf("Invalid timeout: %s (expected a positive number of seconds)\n", value)
+			return
+		}
+		settings.Timeout = seconds
+		fmt.Printf("Upstream Timeout set to %ds\n", seconds)
+	case "query_deadline":
+		ms, err := dnsservers.ParseMilliseconds(value)
+		if err != nil {
+			fmt.Printf("Invalid query deadline: %s (expected e.g. 1500ms, 3s or 0 to disable)\n", value)
+			return
+		}
+		settings.QueryDeadlineMs = ms
+		if ms == 0 {
+			fmt.Println("Query Deadline disabled")
+		} else {
+			fmt.Printf("Query Deadline set to %s\n", time.Duration(ms)*time.Millisecond)
+		}
+	case "cache_max_entries":
+		entries, err := strconv.Atoi(value)
+		if err != nil || entries <= 0 {
+			fmt.Printf("Invalid cache max entries: %s (expected a positive number)\n", value)
+			return
+		}
+		settings.Cache.MaxEntries = entries
+		dnsData.GetCache().SetMaxEntries(entries)
+		fmt.Printf("Cache Max Entries set to %d\n", entries)
+	case "cache_janitor_interval":
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			fmt.Printf("Invalid cache janitor interval: %s (expected a positive number of seconds)\n", value)
+			return
+		}
+		settings.Cache.JanitorInterval = seconds
+		fmt.Printf("Cache Janitor Interval set to %ds (applies after restart)\n", seconds)
+	case "cache_negative_max_ttl":
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			fmt.Printf("Invalid negative cache max TTL: %s (expected a positive number of seconds)\n", value)
+			return
+		}
+		settings.Cache.NegativeMaxTTL = seconds
+		fmt.Printf("Negative Cache Max TTL set to %ds\n", seconds)
+	case "cache_save_interval":
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			fmt.Printf("Invalid cache save interval: %s (expected a positive number of seconds)\n", value)
+			return
+		}
+		settings.Cache.SaveInterval = seconds
+		fmt.Printf("Cache Save Interval set to %ds (applies after restart)\n", seconds)
+	case "cache_serve_stale":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			fmt.Printf("Invalid cache serve stale value: %s (expected true or false)\n", value)
+			return
+		}
+		settings.Cache.ServeStale = enabled
+		dnsData.GetCache().SetStaleWindow(settings.Cache.StaleRetention())
+		fmt.Printf("Serve Stale set to %t\n", enabled)
+	case "cache_stale_window":
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			fmt.Printf("Invalid cache stale window: %s (expected a positive number of seconds)\n", value)
+			return
+		}
+		settings.Cache.StaleWindow = seconds
+		dnsData.GetCache().SetStaleWindow(settings.Cache.StaleRetention())
+		fmt.Printf("Cache Stale Window set to %ds\n", seconds)
+	case "cache_stale_ttl":
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			fmt.Printf("Invalid cache stale TTL: %s (expected a positive number of seconds)\n", value)
+			return
+		}
+		settings.Cache.StaleTTL = seconds
+		fmt.Printf("Cache Stale TTL set to %ds\n", seconds)
+	case "cache_prefetch":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			fmt.Printf("Invalid cache prefetch value: %s (expected true or false)\n", value)
+			return
+		}
+		settings.Cache.Prefetch = enabled
+		fmt.Printf("Prefetch set to %t\n", enabled)
+	case "cache_prefetch_threshold":
+		percent, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+		if err != nil || percent <= 0 || percent >= 100 {
+			fmt.Printf("Invalid cache prefetch threshold: %s (expected a percentage between 1 and 99)\n", value)
+			return
+		}
+		settings.Cache.PrefetchThreshold = percent
+		fmt.Printf("Prefetch Threshold set to %d%%\n", percent)
+	case "cache_prefetch_min_hits":
+		hits, err := strconv.Atoi(value)
+		if err != nil || hits <= 0 {
+			fmt.Printf("Invalid cache prefetch min hits: %s (expected a positive number)\n", value)
+			return
+		}
+		settings.Cache.PrefetchMinHits = hits
+		fmt.Printf("Prefetch Min Hits set to %d\n", hits)
+	case "blocklist_response":
+		response := strings.ToLower(value)
+		if !blocklist.IsValidResponse(response) {
+			fmt.Printf("Invalid blocklist response: %s (expected %s)\n", value, strings.Join(blocklist.Responses, ", "))
+			return
+		}
+		settings.Blocklist.Response = response
+		fmt.Printf("Blocklist Response set to %s\n", response)
+	case "edns_udp_size":
+		size, err := strconv.ParseUint(value, 10, 16)
+		if err != nil || size < 512 {
+			fmt.Printf("Invalid EDNS UDP size: %s (expected 512-65535, 1232 is recommended)\n", value)
+			return
+		}
+		settings.EDNS.UDPSize = uint16(size)
+		fmt.Printf("EDNS UDP Size set to %d\n", size)
+	case "edns_client_subnet":
+		mode := strings.ToLower(value)
+		if mode != config.ClientSubnetStrip && mode != config.ClientSubnetPassthrough {
+			fmt.Printf("Unknown client subnet mode: %s (available: %s, %s)\n", value, config.ClientSubnetStrip, config.ClientSubnetPassthrough)
+			return
+		}
+		settings.EDNS.ClientSubnet = mode
+		fmt.Printf("EDNS Client Subnet set to %s\n", mode)
+	case "dot_port":
+		settings.DoT.Port = value
+		fmt.Printf("DoT Port set to %s\n", value)
+	case "dot_enabled":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			fmt.Printf("Invalid value for dot_enabled: %s (expected true or false)\n", value)
+			return
+		}
+		settings.DoT.Enabled = enabled
+		fmt.Printf("DoT listener at startup set to %t\n", enabled)
+	case "doh_port":
+		settings.DoH.Port = value
+		fmt.Printf("DoH Port set to %s\n", value)
+	case "doh_enabled", "doh_on_api":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			fmt.Printf("Invalid value for %s: %s (expected true or false)\n", setting, value)
+			return
+		}
+		if setting == "doh_enabled" {
+			settings.DoH.Enabled = enabled
+			fmt.Printf("DoH listener at startup set to %t\n", enabled)
+		} else {
+			settings.DoH.OnAPI = enabled
+			fmt.Printf("DoH on the API set to %t (applies when the API starts)\n", enabled)
+		}
+	case "doq_port":
+		settings.DoQ.Port = value
+		fmt.Printf("DoQ Port set to %s\n", value)
+	case "doq_enabled":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			fmt.Printf("Invalid value for doq_enabled: %s (expected true or false)\n", value)
+			return
+		}
+		settings.DoQ.Enabled = enabled
+		fmt.Printf("DoQ listener at startup set to %t\n", enabled)
+	case "doq_idle_timeout":
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			fmt.Printf("Invalid DoQ idle timeout: %s (expected a positive number of seconds)\n", value)
+			return
+		}
+		settings.DoQ.IdleTimeout = seconds
+		fmt.Printf("DoQ idle timeout set to %ds\n", seconds)
+	case "tls_cert":
+		settings.TLS.CertFile = value
+		fmt.Printf("TLS Certificate set to %s\n", value)
+	case "tls_key":
+		settings.TLS.KeyFile = value
+		fmt.Printf("TLS Key set to %s\n", value)
+	case "dns_acl", "dns_acl_allow", "dns_acl_deny", "tui_acl", "tui_acl_allow", "tui_acl_deny", "api_acl", "api_acl_allow", "api_acl_deny":
+		if !configureACL(&settings, setting, value) {
+			return
+		}
 	default:
 		fmt.Printf("Unknown setting: %s\n", setting)
 		printServerConfigureUsage()
@@ -1261,6 +2290,70 @@ func handleServerConfigure(args []string) {
 	fmt.Println("Server configuration updated.")
 }
 
+// configureACL applies one of the <listener>_acl settings, which set the mode
+// of a listener's access control list or replace its allow or deny entries.
+func configureACL(settings *data.DNSResolverSettings, setting, value string) bool {
+	listener, field, _ := strings.Cut(setting, "_acl")
+	target := map[string]*config.ACL{"dns": &settings.ACL.DNS, "tui": &settings.ACL.TUI, "api": &settings.ACL.API}[listener]
+	name := strings.ToUpper(listener) + " ACL"
+	if field == "" {
+		mode := acl.NormalizeMode(value)
+		if !acl.IsValidMode(mode) {
+			fmt.Printf("Unknown ACL mode: %s (available: %s)\n", value, strings.Join(acl.Modes, ", "))
+			return false
+		}
+		target.Mode = mode
+		fmt.Printf("%s Mode set to %s\n", name, mode)
+		return true
+	}
+	entries := []string{}
+	if strings.ToLower(value) != "none" {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if _, err := ipvalidator.ParseRanges(entries); err != nil {
+		fmt.Printf("Invalid %s entries: %v\n", strings.TrimPrefix(field, "_"), err)
+		return false
+	}
+	if field == "_allow" {
+		target.Allow = entries
+		fmt.Printf("%s Allow set to %s\n", name, formatACLEntries(entries))
+	} else {
+		target.Deny = entries
+		fmt.Printf("%s Deny set to %s\n", name, formatACLEntries(entries))
+	}
+	return true
+}
+
+func formatACL(list config.ACL) string {
+	return fmt.Sprintf("%s (allow: %s, deny: %s)", list.Mode, formatACLEntries(list.Allow), formatACLEntries(list.Deny))
+}
+
+func formatACLEntries(entries []string) string {
+	if len(entries) == 0 {
+		return "none"
+	}
+	return strings.Join(entries, ", ")
+}
+
+func valueOrNone(value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "none"
+	}
+	return value
+}
+
+func formatFallbackServers(servers []config.FallbackServer) string {
+	parts := make([]string, 0, len(servers))
+	for _, server := range servers {
+		parts = append(parts, server.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
 // Stats command
 func handleStats(args []string) {
 	if cliutil.IsHelpRequest(args) {
@@ -1278,12 +2371,21 @@ func handleStats(args []string) {
 	fmt.Println()
 	fmt.Println("Total Records:", len(dnsData.DNSRecords))
 	fmt.Println("Total DNS Servers:", len(dnsData.DNSServers))
-	fmt.Println("Total Cache Records:", len(dnsData.CacheRecords))
+	fmt.Println("Total Cache Records:", dnsData.GetCache().Len())
+	fmt.Println("Total Blocklist Rules:", dnsData.GetBlocklist().Len())
+	fmt.Println("Total Policy Rules:", dnsData.GetPolicy().Len())
+	fmt.Println("Total RPZ Rules:", dnsData.GetRPZ().Len())
 	fmt.Println()
 	fmt.Println("Total queries received:", dnsData.Stats.TotalQueries)
 	fmt.Println("Total queries answered:", dnsData.Stats.TotalQueriesAnswered)
 	fmt.Println("Total cache hits:", dnsData.Stats.TotalCacheHits)
+	fmt.Println("Total blocked queries:", dnsData.Stats.TotalBlocks)
+	fmt.Println("Total stale answers:", dnsData.Stats.TotalStaleAnswers)
+	fmt.Println("Total prefetches:", dnsData.Stats.TotalPrefetches)
+	fmt.Println("Total prefetch failures:", dnsData.Stats.TotalPrefetchFailures)
 	fmt.Println("Total queries forwarded:", dnsData.Stats.TotalQueriesForwarded)
+	fmt.Println("Total queries coalesced:", dnsData.Stats.TotalQueriesCoalesced)
+	fmt.Println("Total ACL denials:", dnsData.Stats.TotalACLDenials)
 }
 
 // Helper for formatting uptime
@@ -1309,29 +2411,44 @@ func serverUpTimeFormat(startTime time.Time) string {
 }
 
 func printServerStartUsage() {
-	fmt.Println("Usage: server start <dns|api>")
+	fmt.Println("Usage: server start <dns|api|dot|doh|doq>")
 	fmt.Println("Description: Start the specified server component.")
 	printHelpAliasesHint()
 }
 
 func printServerStopUsage() {
-	fmt.Println("Usage: server stop <dns|api>")
+	fmt.Println("Usage: server stop <dns|api|dot|doh|doq>")
 	fmt.Println("Description: Stop the specified server component.")
 	printHelpAliasesHint()
 }
 
 func printServerStatusUsage() {
-	fmt.Println("Usage: server status [dns|api|client]")
+	fmt.Println("Usage: server status [dns|api|dot|doh|doq|client]")
 	fmt.Println("Description: Show listener details for DNS, API, and CLI clients. Defaults to all when omitted.")
 	printHelpAliasesHint()
 }
 
 func printServerComponentHint() {
-	fmt.Println("Available components: dns, api")
+	fmt.Println("Available components: dns, api, dot, doh, doq")
 }
 
 func printServerConfigureUsage() {
-	fmt.Println("Usage: server configure <dns_port|api_port|fallback_ip|fallback_port> <value>")
+	fmt.Println("Usage: server configure <dns_port|api_port|fallback|fallback_mode|strategy|timeout|query_deadline|cache_max_entries|cache_janitor_interval|cache_negative_max_ttl|cache_save_interval|cache_serve_stale|cache_stale_window|cache_stale_ttl|cache_prefetch|cache_prefetch_threshold|cache_prefetch_min_hits|blocklist_response|edns_udp_size|edns_client_subnet|dot_port|dot_enabled|doh_port|doh_enabled|doh_on_api|doq_port|doq_enabled|doq_idle_timeout|tls_cert|tls_key|dns_acl|dns_acl_allow|dns_acl_deny|tui_acl|tui_acl_allow|tui_acl_deny|api_acl|api_acl_allow|api_acl_deny> <value>")
+	fmt.Printf("Strategies: %s\n", strings.Join(upstream.Strategies, ", "))
+	fmt.Println("fallback takes a comma separated, ordered list such as 1.1.1.1,9.9.9.9:53; fallback_mode is sequential or parallel.")
+	fmt.Println("timeout is the per-upstream exchange timeout in seconds; query_deadline bounds a whole query (e.g. 1500ms, 0 disables).")
+	fmt.Println("cache_max_entries bounds the cache (least recently used entries are evicted); cache_janitor_interval purges expired entries every N seconds.")
+	fmt.Println("cache_negative_max_ttl caps how long NXDOMAIN and NODATA answers are cached, in seconds.")
+	fmt.Println("cache_save_interval writes a changed cache to disk every N seconds.")
+	fmt.Println("cache_serve_stale answers from entries expired less than cache_stale_window seconds ago, with TTL cache_stale_ttl, when no upstream responds.")
+	fmt.Println("cache_prefetch refreshes entries with at least cache_prefetch_min_hits lookups once less than cache_prefetch_threshold percent of their TTL is left.")
+	fmt.Printf("blocklist_response is how blocked queries are answered: %s.\n", strings.Join(blocklist.Responses, ", "))
+	fmt.Println("edns_udp_size is the EDNS0 buffer size advertised to clients and upstreams; edns_client_subnet is strip or passthrough.")
+	fmt.Printf("dns_acl, tui_acl and api_acl set who may use a listener: %s.\n", strings.Join(acl.Modes, ", "))
+	fmt.Println("  Clients in the allow list are always served and clients in the deny list never are. For everyone else,")
+	fmt.Println("  allow serves them, allow-list-only refuses them, and allow-local-only serves only loopback, private and")
+	fmt.Println("  link-local addresses. deny is accepted as the old name of allow-list-only.")
+	fmt.Println("<listener>_acl_allow and <listener>_acl_deny take a comma separated list of addresses, CIDR blocks and ranges such as 192.0.2.0/24,10.0.0.5-10.0.0.9, or none.")
 	fmt.Println("Description: Update a server configuration setting. Run without arguments to view current settings.")
 	printHelpAliasesHint()
 }
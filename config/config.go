@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -21,6 +24,11 @@ type FileLocations struct {
 	DNSServerFile  string `json:"dnsserver_file"`
 	DNSRecordsFile string `json:"dnsrecords_file"`
 	CacheFile      string `json:"cache_file"`
+	// BlocklistDir holds the downloaded copies of blocklists subscribed to
+	// by URL.
+	BlocklistDir string `json:"blocklist_dir"`
+	// PolicyFile holds the allow and deny rules.
+	PolicyFile string `json:"policy_file"`
 }
 
 // DNSRecordSettings mirrors record handling settings persisted in the config.
@@ -30,15 +38,220 @@ type DNSRecordSettings struct {
 	AddUpdatesRecords bool `json:"add_updates_records,omitempty"`
 }
 
+// HealthCheck controls background probing of upstream servers.
+type HealthCheck struct {
+	// Interval between probe rounds in seconds; 0 disables probing.
+	Interval int `json:"interval"`
+	// FailureThreshold is the number of consecutive failures that takes a
+	// server out of rotation.
+	FailureThreshold int `json:"failure_threshold"`
+}
+
+// TLSSettings holds the certificate served by the encrypted DNS listeners.
+type TLSSettings struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// DoTSettings controls the DNS-over-TLS listener (RFC 7858).
+type DoTSettings struct {
+	// Enabled starts the listener together with the daemon.
+	Enabled bool   `json:"enabled"`
+	Port    string `json:"port"`
+}
+
+// DoHSettings controls the DNS-over-HTTPS endpoint (RFC 8484).
+type DoHSettings struct {
+	// Enabled starts the dedicated TLS listener together with the daemon.
+	Enabled bool   `json:"enabled"`
+	Port    string `json:"port"`
+	// OnAPI also serves /dns-query on the management API.
+	OnAPI bool `json:"on_api"`
+}
+
+// DoQSettings controls the DNS-over-QUIC listener (RFC 9250).
+type DoQSettings struct {
+	// Enabled starts the listener together with the daemon.
+	Enabled bool   `json:"enabled"`
+	Port    string `json:"port"`
+	// IdleTimeout closes connections without traffic after this many seconds.
+	IdleTimeout int `json:"idle_timeout"`
+}
+
+// CacheSettings tunes the answer cache.
+type CacheSettings struct {
+	// MaxEntries bounds the number of cached answers; the least recently
+	// used are evicted first.
+	MaxEntries int `json:"max_entries"`
+	// JanitorInterval is how often, in seconds, expired entries are purged.
+	JanitorInterval int `json:"janitor_interval"`
+	// NegativeMaxTTL caps, in seconds, how long NXDOMAIN and NODATA answers
+	// are cached.
+	NegativeMaxTTL int `json:"negative_max_ttl"`
+	// SaveInterval is how often, in seconds, a changed cache is written to
+	// the cache file.
+	SaveInterval int `json:"save_interval"`
+	// ServeStale answers from expired entries when every upstream fails
+	// (RFC 8767).
+	ServeStale bool `json:"serve_stale"`
+	// StaleWindow is how long, in seconds, expired entries are kept for
+	// serving stale.
+	StaleWindow int `json:"stale_window"`
+	// StaleTTL is the TTL, in seconds, given to stale answers.
+	StaleTTL int `json:"stale_ttl"`
+	// Prefetch re-resolves popular entries in the background shortly before
+	// they expire.
+	Prefetch bool `json:"prefetch"`
+	// PrefetchThreshold is the percentage of the original TTL left below
+	// which an entry is prefetched.
+	PrefetchThreshold int `json:"prefetch_threshold"`
+	// PrefetchMinHits is how many lookups an entry must have answered to be
+	// prefetched.
+	PrefetchMinHits int `json:"prefetch_min_hits"`
+}
+
+// StaleRetention returns how long expired entries are kept, which is zero
+// unless serving stale is enabled.
+func (c CacheSettings) StaleRetention() time.Duration {
+	if !c.ServeStale {
+		return 0
+	}
+	return time.Duration(c.StaleWindow) * time.Second
+}
+
+// EDNS client subnet handling modes.
+const (
+	// ClientSubnetStrip removes EDNS Client Subnet options before queries are
+	// forwarded, so upstreams never learn the client's network.
+	ClientSubnetStrip = "strip"
+	// ClientSubnetPassthrough forwards EDNS Client Subnet options unchanged.
+	ClientSubnetPassthrough = "passthrough"
+)
+
+// Access control modes decide which clients a listener serves.
+const (
+	// ACLModeAllow serves every client except those in the deny list.
+	ACLModeAllow = "allow"
+	// ACLModeAllowListOnly serves only the clients in the allow list.
+	ACLModeAllowListOnly = "allow-list-only"
+	// ACLModeDeny is the former name of ACLModeAllowListOnly. It is still
+	// accepted and read as ACLModeAllowListOnly.
+	ACLModeDeny = "deny"
+	// ACLModeLocalOnly serves clients on loopback, private and link-local
+	// addresses, and those in the allow list.
+	ACLModeLocalOnly = "allow-local-only"
+)
+
+// ACL restricts which clients may use a listener. Entries are addresses,
+// CIDR blocks such as 192.0.2.0/24 or ranges such as 192.0.2.10-192.0.2.20.
+// A client in Allow is always served and a client in Deny never is;
+// everyone else is decided by Mode.
+type ACL struct {
+	Mode  string   `json:"mode"`
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// ACLSettings holds the access control lists of the listeners.
+type ACLSettings struct {
+	// DNS applies to queries over every DNS transport: UDP, TCP, DoT, DoH
+	// and DoQ.
+	DNS ACL `json:"dns"`
+	// TUI applies to connections to the TCP TUI listener. The UNIX socket is
+	// protected by its file permissions instead.
+	TUI ACL `json:"tui"`
+	// API applies to connections to the REST API.
+	API ACL `json:"api"`
+}
+
+// RPZZone is a response policy zone. Zones are applied in the order they
+// are configured.
+type RPZZone struct {
+	// Name is the policy name, which is also the zone's origin.
+	Name string `json:"name"`
+	// File is the zone file. Zones transferred from Primary are saved to it.
+	File string `json:"file,omitempty"`
+	// Primary is the host:port the zone is transferred from with AXFR.
+	Primary string `json:"primary,omitempty"`
+	// RefreshInterval is how often, in seconds, the primary is checked for
+	// a new serial. Zero uses the refresh value of the zone's SOA.
+	RefreshInterval int `json:"refresh_interval,omitempty"`
+}
+
+// BlocklistSettings configures blocking of ad and tracker domains.
+type BlocklistSettings struct {
+	// Files lists the blocklist files to load. Relative paths are resolved
+	// against the config directory.
+	Files []string `json:"files"`
+	// URLs lists the blocklists downloaded over HTTP(S).
+	URLs []BlocklistURL `json:"urls"`
+	// Response is how blocked queries are answered: nxdomain, null
+	// (0.0.0.0 or ::) or refused.
+	Response string `json:"response"`
+}
+
+// BlocklistURL is a blocklist subscribed to by URL.
+type BlocklistURL struct {
+	URL string `json:"url"`
+	// RefreshInterval is how often, in seconds, the list is checked for
+	// changes.
+	RefreshInterval int `json:"refresh_interval"`
+}
+
+// EDNSSettings controls EDNS0 (RFC 6891) negotiation.
+type EDNSSettings struct {
+	// UDPSize is the payload size advertised to clients and upstreams.
+	UDPSize uint16 `json:"udp_size"`
+	// ClientSubnet is either "strip" or "passthrough".
+	ClientSubnet string `json:"client_subnet"`
+}
+
+// Fallback modes control how the fallback servers are queried.
+const (
+	// FallbackModeSequential tries fallback servers one at a time in order.
+	FallbackModeSequential = "sequential"
+	// FallbackModeParallel queries all fallback servers at once and uses the
+	// first usable reply.
+	FallbackModeParallel = "parallel"
+)
+
+// FallbackServer is an upstream consulted when the primary servers do not
+// produce an authoritative answer.
+type FallbackServer struct {
+	Address string `json:"address"`
+	Port    string `json:"port"`
+}
+
+// String returns the server as host:port.
+func (f FallbackServer) String() string {
+	return net.JoinHostPort(f.Address, f.Port)
+}
+
 // Config captures all persisted settings for dnsplane.
 type Config struct {
-	FallbackServerIP   string            `json:"fallback_server_ip"`
-	FallbackServerPort string            `json:"fallback_server_port"`
+	// FallbackServerIP and FallbackServerPort are the legacy single fallback
+	// server. They are migrated into FallbackServers when the config is loaded.
+	FallbackServerIP   string            `json:"fallback_server_ip,omitempty"`
+	FallbackServerPort string            `json:"fallback_server_port,omitempty"`
+	FallbackServers    []FallbackServer  `json:"fallback_servers"`
+	FallbackMode       string            `json:"fallback_mode"`
 	Timeout            int               `json:"timeout"`
+	QueryDeadlineMs    int               `json:"query_deadline_ms,omitempty"`
+	UpstreamStrategy   string            `json:"upstream_strategy"`
+	HealthCheck        HealthCheck       `json:"health_check"`
+	EDNS               EDNSSettings      `json:"edns"`
+	TLS                TLSSettings       `json:"tls"`
+	DoT                DoTSettings       `json:"dot"`
+	DoH                DoHSettings       `json:"doh"`
+	DoQ                DoQSettings       `json:"doq"`
 	DNSPort            string            `json:"dns_port"`
 	RESTPort           string            `json:"rest_port"`
 	APIEnabled         bool              `json:"api_enabled"`
 	CacheRecords       bool              `json:"cache_records"`
+	Cache              CacheSettings     `json:"cache"`
+	Blocklist          BlocklistSettings `json:"blocklist"`
+	RPZ                []RPZZone         `json:"rpz"`
+	ACL                ACLSettings       `json:"acl"`
 	ClientSocketPath   string            `json:"client_socket_path"`
 	ClientTCPAddress   string            `json:"client_tcp_address"`
 	FileLocations      FileLocations     `json:"file_locations"`
@@ -182,19 +395,34 @@ func writeConfig(path string, cfg *Config) error {
 
 func defaultConfig(baseDir string) *Config {
 	return &Config{
-		FallbackServerIP:   "1.1.1.1",
-		FallbackServerPort: "53",
-		Timeout:            2,
-		DNSPort:            "53",
-		RESTPort:           "8080",
-		APIEnabled:         false,
-		CacheRecords:       true,
-		ClientSocketPath:   defaultSocketPath(),
-		ClientTCPAddress:   "0.0.0.0:8053",
+		FallbackServers:  []FallbackServer{{Address: "1.1.1.1", Port: "53"}},
+		FallbackMode:     FallbackModeSequential,
+		Timeout:          2,
+		UpstreamStrategy: "authoritative-first",
+		HealthCheck: HealthCheck{
+			Interval:         30,
+			FailureThreshold: 3,
+		},
+		EDNS:             EDNSSettings{UDPSize: 1232, ClientSubnet: ClientSubnetStrip},
+		Blocklist:        BlocklistSettings{Files: []string{}, URLs: []BlocklistURL{}, Response: "nxdomain"},
+		RPZ:              []RPZZone{},
+		ACL:              ACLSettings{DNS: defaultACL(), TUI: defaultACL(), API: defaultACL()},
+		DoT:              DoTSettings{Port: "853"},
+		DoH:              DoHSettings{Port: "443"},
+		DoQ:              DoQSettings{Port: "853", IdleTimeout: 30},
+		DNSPort:          "53",
+		RESTPort:         "8080",
+		APIEnabled:       false,
+		CacheRecords:     true,
+		Cache:            CacheSettings{MaxEntries: 10000, JanitorInterval: 60, NegativeMaxTTL: 3600, SaveInterval: 60, StaleWindow: 86400, StaleTTL: 30, PrefetchThreshold: 10, PrefetchMinHits: 3},
+		ClientSocketPath: defaultSocketPath(),
+		ClientTCPAddress: "0.0.0.0:8053",
 		FileLocations: FileLocations{
 			DNSServerFile:  filepath.Join(baseDir, "dnsservers.json"),
 			DNSRecordsFile: filepath.Join(baseDir, "dnsrecords.json"),
 			CacheFile:      filepath.Join(baseDir, "dnscache.json"),
+			BlocklistDir:   filepath.Join(baseDir, "blocklists"),
+			PolicyFile:     filepath.Join(baseDir, "policy.json"),
 		},
 		DNSRecordSettings: DNSRecordSettings{
 			AutoBuildPTRFromA: true,
@@ -204,11 +432,68 @@ func defaultConfig(baseDir string) *Config {
 }
 
 func (c *Config) applyDefaults(configDir string) {
-	if c.FallbackServerIP == "" {
-		c.FallbackServerIP = "1.1.1.1"
+	c.migrateFallbackServer()
+	if len(c.FallbackServers) == 0 {
+		c.FallbackServers = []FallbackServer{{Address: "1.1.1.1", Port: "53"}}
+	}
+	for i := range c.FallbackServers {
+		if c.FallbackServers[i].Port == "" {
+			c.FallbackServers[i].Port = "53"
+		}
+	}
+	if c.FallbackMode != FallbackModeParallel {
+		c.FallbackMode = FallbackModeSequential
+	}
+	if c.UpstreamStrategy == "" {
+		c.UpstreamStrategy = "authoritative-first"
+	}
+	if c.HealthCheck.FailureThreshold <= 0 {
+		c.HealthCheck.FailureThreshold = 3
+	}
+	if c.HealthCheck.Interval < 0 {
+		c.HealthCheck.Interval = 0
+	}
+	if c.EDNS.UDPSize < 512 {
+		c.EDNS.UDPSize = 1232
+	}
+	if c.EDNS.ClientSubnet != ClientSubnetPassthrough {
+		c.EDNS.ClientSubnet = ClientSubnetStrip
 	}
-	if c.FallbackServerPort == "" {
-		c.FallbackServerPort = "53"
+	if c.DoT.Port == "" {
+		c.DoT.Port = "853"
+	}
+	if c.DoH.Port == "" {
+		c.DoH.Port = "443"
+	}
+	if c.DoQ.Port == "" {
+		c.DoQ.Port = "853"
+	}
+	if c.DoQ.IdleTimeout <= 0 {
+		c.DoQ.IdleTimeout = 30
+	}
+	if c.Cache.MaxEntries <= 0 {
+		c.Cache.MaxEntries = 10000
+	}
+	if c.Cache.JanitorInterval <= 0 {
+		c.Cache.JanitorInterval = 60
+	}
+	if c.Cache.NegativeMaxTTL <= 0 {
+		c.Cache.NegativeMaxTTL = 3600
+	}
+	if c.Cache.SaveInterval <= 0 {
+		c.Cache.SaveInterval = 60
+	}
+	if c.Cache.StaleWindow <= 0 {
+		c.Cache.StaleWindow = 86400
+	}
+	if c.Cache.StaleTTL <= 0 {
+		c.Cache.StaleTTL = 30
+	}
+	if c.Cache.PrefetchThreshold <= 0 || c.Cache.PrefetchThreshold >= 100 {
+		c.Cache.PrefetchThreshold = 10
+	}
+	if c.Cache.PrefetchMinHits <= 0 {
+		c.Cache.PrefetchMinHits = 3
 	}
 	if c.DNSPort == "" {
 		c.DNSPort = "53"
@@ -223,9 +508,94 @@ func (c *Config) applyDefaults(configDir string) {
 		c.ClientTCPAddress = "0.0.0.0:8053"
 	}
 
+	c.TLS.CertFile = resolveOptionalPath(configDir, c.TLS.CertFile)
+	c.TLS.KeyFile = resolveOptionalPath(configDir, c.TLS.KeyFile)
+
+	if c.Blocklist.Response == "" {
+		c.Blocklist.Response = "nxdomain"
+	}
+	if c.Blocklist.Files == nil {
+		c.Blocklist.Files = []string{}
+	}
+	for i, file := range c.Blocklist.Files {
+		c.Blocklist.Files[i] = resolveOptionalPath(configDir, file)
+	}
+	if c.Blocklist.URLs == nil {
+		c.Blocklist.URLs = []BlocklistURL{}
+	}
+	for i := range c.Blocklist.URLs {
+		if c.Blocklist.URLs[i].RefreshInterval <= 0 {
+			c.Blocklist.URLs[i].RefreshInterval = 86400
+		}
+	}
+	if c.RPZ == nil {
+		c.RPZ = []RPZZone{}
+	}
+	for i, zone := range c.RPZ {
+		if zone.File == "" && zone.Primary != "" {
+			zone.File = filepath.Join("rpz", zone.Name+".zone")
+		}
+		c.RPZ[i].File = resolveOptionalPath(configDir, zone.File)
+	}
+	for _, acl := range []*ACL{&c.ACL.DNS, &c.ACL.TUI, &c.ACL.API} {
+		acl.applyDefaults()
+	}
+
 	c.FileLocations.DNSServerFile = ensureAbsolutePath(configDir, c.FileLocations.DNSServerFile, "dnsservers.json")
 	c.FileLocations.DNSRecordsFile = ensureAbsolutePath(configDir, c.FileLocations.DNSRecordsFile, "dnsrecords.json")
 	c.FileLocations.CacheFile = ensureAbsolutePath(configDir, c.FileLocations.CacheFile, "dnscache.json")
+	c.FileLocations.BlocklistDir = ensureAbsolutePath(configDir, c.FileLocations.BlocklistDir, "blocklists")
+	c.FileLocations.PolicyFile = ensureAbsolutePath(configDir, c.FileLocations.PolicyFile, "policy.json")
+}
+
+// migrateFallbackServer moves the legacy single fallback server into the
+// fallback list, keeping it first so existing behaviour is preserved.
+func (c *Config) migrateFallbackServer() {
+	if c.FallbackServerIP != "" {
+		legacy := FallbackServer{Address: c.FallbackServerIP, Port: c.FallbackServerPort}
+		if legacy.Port == "" {
+			legacy.Port = "53"
+		}
+		found := false
+		for _, server := range c.FallbackServers {
+			if server == legacy {
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.FallbackServers = append([]FallbackServer{legacy}, c.FallbackServers...)
+		}
+	}
+	c.FallbackServerIP = ""
+	c.FallbackServerPort = ""
+}
+
+// ParseFallbackServers parses a comma separated list of addresses with
+// optional ports, e.g. "1.1.1.1,9.9.9.9:53,[2606:4700::1111]:53".
+func ParseFallbackServers(value string) ([]FallbackServer, error) {
+	var servers []FallbackServer
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		server := FallbackServer{Address: item, Port: "53"}
+		if host, port, err := net.SplitHostPort(item); err == nil {
+			server = FallbackServer{Address: host, Port: port}
+		}
+		if net.ParseIP(server.Address) == nil {
+			return nil, fmt.Errorf("invalid fallback server address: %s", item)
+		}
+		if port, err := strconv.Atoi(server.Port); err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid fallback server port: %s", item)
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("at least one fallback server is required")
+	}
+	return servers, nil
 }
 
 func appendIfMissing(paths []string, candidate string) []string {
@@ -248,6 +618,36 @@ func ensureAbsolutePath(configDir, value, fallbackName string) string {
 	return filepath.Join(configDir, value)
 }
 
+// resolveOptionalPath makes a relative path absolute against configDir and
+// leaves empty values empty.
+func resolveOptionalPath(configDir, value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+	return ensureAbsolutePath(configDir, value, "")
+}
+
+func defaultACL() ACL {
+	return ACL{Mode: ACLModeAllow, Allow: []string{}, Deny: []string{}}
+}
+
+func (a *ACL) applyDefaults() {
+	a.Mode = strings.ToLower(strings.TrimSpace(a.Mode))
+	switch a.Mode {
+	case "":
+		a.Mode = ACLModeAllow
+	case ACLModeDeny:
+		a.Mode = ACLModeAllowListOnly
+	}
+	if a.Allow == nil {
+		a.Allow = []string{}
+	}
+	if a.Deny == nil {
+		a.Deny = []string{}
+	}
+}
+
 func defaultSocketPath() string {
 	return filepath.Join(os.TempDir(), "dnsplane.socket")
 }
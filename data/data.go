@@ -2,10 +2,14 @@
 package data
 
 import (
+	"dnsplane/acl"
+	"dnsplane/blocklist"
 	"dnsplane/config"
 	"dnsplane/dnsrecordcache"
 	"dnsplane/dnsrecords"
 	"dnsplane/dnsservers"
+	"dnsplane/policy"
+	"dnsplane/rpz"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,6 +18,8 @@ import (
 	"path/filepath"
 	"sync"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 //USAGE in FUNCTIONS:
@@ -34,21 +40,35 @@ import (
 
 // DNSResolverData holds all the data for the DNS resolver
 type DNSResolverData struct {
-	Settings     DNSResolverSettings
-	Stats        DNSStats
-	DNSServers   []dnsservers.DNSServer
-	DNSRecords   []dnsrecords.DNSRecord
-	CacheRecords []dnsrecordcache.CacheRecord
-	mu           sync.RWMutex
+	Settings   DNSResolverSettings
+	Stats      DNSStats
+	DNSServers []dnsservers.DNSServer
+	DNSRecords []dnsrecords.DNSRecord
+	Cache      *dnsrecordcache.Cache
+	Blocklist  *blocklist.Blocklist
+	RPZ        *rpz.Policies
+	// ACL holds the compiled access control lists of the listeners. It is
+	// rebuilt whenever the settings change.
+	ACL *acl.Set
+	// PolicyRules are the allow and deny rules as stored in policy.json,
+	// and Policy their compiled form used for queries.
+	PolicyRules []policy.Rule
+	Policy      *policy.Policy
+	mu          sync.RWMutex
 }
 
 // DNSStats holds the data for the DNS statistics
 type DNSStats struct {
 	TotalQueries          int       `json:"total_queries"`
 	TotalCacheHits        int       `json:"total_cache_hits"`
+	TotalStaleAnswers     int       `json:"total_stale_answers"`
+	TotalPrefetches       int       `json:"total_prefetches"`
+	TotalPrefetchFailures int       `json:"total_prefetch_failures"`
 	TotalBlocks           int       `json:"total_blocks"`
 	TotalQueriesForwarded int       `json:"total_queries_forwarded"`
 	TotalQueriesAnswered  int       `json:"total_queries_answered"`
+	TotalQueriesCoalesced int       `json:"total_queries_coalesced"`
+	TotalACLDenials       int       `json:"total_acl_denials"`
 	ServerStartTime       time.Time `json:"server_start_time"`
 }
 
@@ -87,6 +107,12 @@ func currentConfig() config.Loaded {
 	return *configState
 }
 
+// ConfigDir returns the directory holding the config file, against which
+// relative paths in the config are resolved.
+func ConfigDir() string {
+	return filepath.Dir(currentConfig().Path)
+}
+
 func updateStoredConfig(cfgPath string, cfg config.Config) {
 	configStateMu.Lock()
 	defer configStateMu.Unlock()
@@ -116,16 +142,34 @@ func GetInstance() *DNSResolverData {
 	return instance
 }
 
-// Initialize loads all data from JSON files
+// Initialize loads all data from JSON files. The cache keeps its in-memory
+// contents when called again.
 func (d *DNSResolverData) Initialize() {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
 	cfg := currentConfig()
 	d.Settings = cfg.Config
+	d.ACL = compileACL(cfg.Config.ACL)
 	d.DNSServers = LoadDNSServers()
 	d.DNSRecords = LoadDNSRecords()
-	d.CacheRecords = LoadCacheRecords()
+	d.PolicyRules = LoadPolicyRules()
+	d.Policy = compilePolicy(d.PolicyRules)
+	// The cache is only loaded once: it is written to disk in the background,
+	// so reloading it would drop answers cached since the last save.
+	if d.Cache == nil {
+		d.Cache = dnsrecordcache.New(cfg.Config.Cache.MaxEntries)
+		d.Cache.SetStaleWindow(cfg.Config.Cache.StaleRetention())
+		d.Cache.Load(LoadCacheRecords())
+	}
+	if d.Blocklist == nil {
+		d.Blocklist = blocklist.New(cfg.Config.FileLocations.BlocklistDir)
+		d.Blocklist.Load(cfg.Config.Blocklist)
+	}
+	if d.RPZ == nil {
+		d.RPZ = rpz.New()
+		d.RPZ.Load(cfg.Config.RPZ)
+	}
 	d.Stats = DNSStats{ServerStartTime: time.Now()}
 }
 
@@ -138,17 +182,39 @@ func (d *DNSResolverData) GetResolverSettings() DNSResolverSettings {
 
 // UpdateSettings updates the DNS server settings
 func (d *DNSResolverData) UpdateSettings(settings DNSResolverSettings) {
+	compiled := compileACL(settings.ACL)
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	d.Settings = settings
+	d.ACL = compiled
 	SaveSettings(settings)
 }
 
 // UpdateSettingsInMemory replaces the settings without persisting them to disk.
 func (d *DNSResolverData) UpdateSettingsInMemory(settings DNSResolverSettings) {
+	compiled := compileACL(settings.ACL)
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	d.Settings = settings
+	d.ACL = compiled
+}
+
+// GetACL returns the compiled access control lists of the listeners
+func (d *DNSResolverData) GetACL() *acl.Set {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.ACL == nil {
+		return &acl.Set{}
+	}
+	return d.ACL
+}
+
+func compileACL(settings config.ACLSettings) *acl.Set {
+	compiled, err := acl.NewSet(settings)
+	if err != nil {
+		log.Printf("Skipping invalid access control entries: %v", err)
+	}
+	return compiled
 }
 
 // GetStats returns the current DNS statistics
@@ -183,6 +249,20 @@ func (d *DNSResolverData) UpdateServers(servers []dnsservers.DNSServer) {
 	}
 }
 
+// ApplyServerStatus updates runtime status fields of every DNS server in
+// memory. The slice is replaced rather than mutated so readers holding the
+// previous slice are unaffected. Nothing is written to disk.
+func (d *DNSResolverData) ApplyServerStatus(apply func(*dnsservers.DNSServer)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	updated := make([]dnsservers.DNSServer, len(d.DNSServers))
+	copy(updated, d.DNSServers)
+	for i := range updated {
+		apply(&updated[i])
+	}
+	d.DNSServers = updated
+}
+
 // GetRecords returns the current DNS records
 func (d *DNSResolverData) GetRecords() []dnsrecords.DNSRecord {
 	d.mu.RLock()
@@ -200,21 +280,218 @@ func (d *DNSResolverData) UpdateRecordsInMemory(records []dnsrecords.DNSRecord)
 	d.storeRecords(records, false)
 }
 
-// GetCacheRecords returns the current cache records
-func (d *DNSResolverData) GetCacheRecords() []dnsrecordcache.CacheRecord {
+// GetPolicyRules returns the allow and deny rules
+func (d *DNSResolverData) GetPolicyRules() []policy.Rule {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.PolicyRules
+}
+
+// GetPolicy returns the compiled allow and deny rules
+func (d *DNSResolverData) GetPolicy() *policy.Policy {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.Policy
+}
+
+// policySaveMu serialises policy updates, so that the saved rules are always
+// the ones in use.
+var policySaveMu sync.Mutex
+
+// UpdatePolicyRules replaces the allow and deny rules and saves them. The
+// rules are in use even when saving them fails. Queries are not held up
+// while the file is written.
+func (d *DNSResolverData) UpdatePolicyRules(rules []policy.Rule) error {
+	compiled := compilePolicy(rules)
+	policySaveMu.Lock()
+	defer policySaveMu.Unlock()
+	d.mu.Lock()
+	d.PolicyRules = rules
+	d.Policy = compiled
+	d.mu.Unlock()
+	return SavePolicyRules(rules)
+}
+
+// PolicyDecision explains how a query would be filtered.
+type PolicyDecision struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Verdict is "deny" or "allow" when a policy rule matched, "block" when
+	// only a blocklist did, and "resolve" otherwise.
+	Verdict string `json:"verdict"`
+	// RuleNumber and Rule identify the matching policy rule.
+	RuleNumber int          `json:"rule_number,omitempty"`
+	Rule       *policy.Rule `json:"rule,omitempty"`
+	// Blocklist and BlocklistRule identify the matching blocklist entry, even
+	// when an allow rule overrides it.
+	Blocklist     string `json:"blocklist,omitempty"`
+	BlocklistRule string `json:"blocklist_rule,omitempty"`
+}
+
+// String describes the decision in a sentence.
+func (p PolicyDecision) String() string {
+	query := fmt.Sprintf("%s %s", p.Name, p.Type)
+	switch p.Verdict {
+	case policy.ActionDeny:
+		return fmt.Sprintf("%s is denied by rule %d (%s).", query, p.RuleNumber, p.Rule)
+	case policy.ActionAllow:
+		if p.Blocklist != "" {
+			return fmt.Sprintf("%s is allowed by rule %d (%s), overriding blocklist %s (%s).", query, p.RuleNumber, p.Rule, p.Blocklist, p.BlocklistRule)
+		}
+		return fmt.Sprintf("%s is allowed by rule %d (%s).", query, p.RuleNumber, p.Rule)
+	case "block":
+		return fmt.Sprintf("%s matches no policy rule and is blocked by %s (%s).", query, p.Blocklist, p.BlocklistRule)
+	}
+	return fmt.Sprintf("%s matches no policy rule or blocklist and is resolved normally.", query)
+}
+
+// TestPolicy reports how a query for name and qtype would be filtered by the
+// policy rules and blocklists.
+func (d *DNSResolverData) TestPolicy(name string, qtype uint16) PolicyDecision {
+	decision := PolicyDecision{Name: dns.CanonicalName(name), Type: dns.TypeToString[qtype], Verdict: "resolve"}
+	if match, ok := d.GetBlocklist().Match(name); ok {
+		decision.Verdict = "block"
+		decision.Blocklist = match.Source
+		decision.BlocklistRule = match.Rule
+	}
+	if match, ok := d.GetPolicy().Evaluate(name, qtype); ok {
+		decision.Verdict = match.Rule.Action
+		decision.RuleNumber = match.Number
+		decision.Rule = &match.Rule
+	}
+	return decision
+}
+
+func compilePolicy(rules []policy.Rule) *policy.Policy {
+	compiled, err := policy.Compile(rules)
+	if err != nil {
+		log.Printf("Skipping invalid policy rules: %v", err)
+	}
+	return compiled
+}
+
+// GetBlocklist returns the loaded blocklists
+func (d *DNSResolverData) GetBlocklist() *blocklist.Blocklist {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.Blocklist
+}
+
+// GetCache returns the answer cache
+func (d *DNSResolverData) GetCache() *dnsrecordcache.Cache {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.Cache
+}
+
+// cacheSaveMu serialises cache writes so that periodic, manual and shutdown
+// saves never interleave.
+var cacheSaveMu sync.Mutex
+
+// SaveCache writes the current cache contents to the dnscache.json file
+func (d *DNSResolverData) SaveCache() error {
+	return d.saveCache(true)
+}
+
+// SaveCacheIfModified writes the cache to the dnscache.json file when entries
+// changed since the last save.
+func (d *DNSResolverData) SaveCacheIfModified() error {
+	return d.saveCache(false)
+}
+
+func (d *DNSResolverData) saveCache(force bool) error {
+	cacheSaveMu.Lock()
+	defer cacheSaveMu.Unlock()
+	cache := d.GetCache()
+	// The flag is cleared before the snapshot is taken, so changes made while
+	// writing are picked up by the next save.
+	if !cache.Modified() && !force {
+		return nil
+	}
+	if err := SaveCacheRecords(cache.Records()); err != nil {
+		cache.MarkModified()
+		return err
+	}
+	return nil
+}
+
+// RunCachePersistence saves the cache every interval, when it changed, until
+// stop is closed. Queries only update the in-memory cache and never wait for
+// the disk.
+func (d *DNSResolverData) RunCachePersistence(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := d.SaveCacheIfModified(); err != nil {
+				log.Printf("Failed to save cache records: %v", err)
+			}
+		}
+	}
+}
+
+// RefreshBlocklists downloads the blocklists subscribed to by URL whose
+// refresh interval has passed and logs those that failed.
+func (d *DNSResolverData) RefreshBlocklists() {
+	for _, status := range d.GetBlocklist().RefreshDue(d.GetResolverSettings().Blocklist.URLs) {
+		if status.Error != "" {
+			log.Printf("Failed to refresh blocklist %s: %s", status.Source, status.Error)
+		}
+	}
+}
+
+// RunBlocklistRefresh refreshes the blocklists subscribed to by URL right away
+// and then checks every interval for lists that are due, until stop is
+// closed. Each list keeps its previous rules when a download fails.
+func (d *DNSResolverData) RunBlocklistRefresh(stop <-chan struct{}, interval time.Duration) {
+	d.RefreshBlocklists()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			d.RefreshBlocklists()
+		}
+	}
+}
+
+// GetRPZ returns the loaded response policy zones
+func (d *DNSResolverData) GetRPZ() *rpz.Policies {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
-	return d.CacheRecords
+	return d.RPZ
 }
 
-// UpdateCacheRecords updates the cache records
-func (d *DNSResolverData) UpdateCacheRecords(records []dnsrecordcache.CacheRecord) {
-	d.storeCacheRecords(records, true)
+// RefreshRPZ transfers the response policy zones whose primary is due to be
+// checked for a new serial and logs those that failed.
+func (d *DNSResolverData) RefreshRPZ() {
+	for _, status := range d.GetRPZ().RefreshDue(d.GetResolverSettings().RPZ) {
+		if status.Error != "" {
+			log.Printf("Failed to transfer response policy zone %s from %s: %s", status.Name, status.Source, status.Error)
+		}
+	}
 }
 
-// UpdateCacheRecordsInMemory replaces cache records without writing to disk.
-func (d *DNSResolverData) UpdateCacheRecordsInMemory(records []dnsrecordcache.CacheRecord) {
-	d.storeCacheRecords(records, false)
+// RunRPZRefresh transfers the response policy zones with a primary right away
+// and then checks every interval for zones that are due, until stop is
+// closed. Each zone keeps its previous rules when a transfer fails.
+func (d *DNSResolverData) RunRPZRefresh(stop <-chan struct{}, interval time.Duration) {
+	d.RefreshRPZ()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			d.RefreshRPZ()
+		}
+	}
 }
 
 // IncrementTotalQueries increments the total queries count
@@ -231,6 +508,30 @@ func (d *DNSResolverData) IncrementCacheHits() {
 	d.Stats.TotalCacheHits++
 }
 
+// IncrementStaleAnswers increments the count of expired cache entries served
+// because no upstream answered
+func (d *DNSResolverData) IncrementStaleAnswers() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Stats.TotalStaleAnswers++
+}
+
+// IncrementPrefetches increments the count of entries refreshed before they
+// expired
+func (d *DNSResolverData) IncrementPrefetches() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Stats.TotalPrefetches++
+}
+
+// IncrementPrefetchFailures increments the count of prefetches no upstream
+// answered
+func (d *DNSResolverData) IncrementPrefetchFailures() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Stats.TotalPrefetchFailures++
+}
+
 // IncrementTotalBlocks increments the total blocks count
 func (d *DNSResolverData) IncrementTotalBlocks() {
 	d.mu.Lock()
@@ -245,6 +546,22 @@ func (d *DNSResolverData) IncrementQueriesForwarded() {
 	d.Stats.TotalQueriesForwarded++
 }
 
+// IncrementQueriesCoalesced increments the count of queries answered from an
+// identical upstream query already in flight
+func (d *DNSResolverData) IncrementQueriesCoalesced() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Stats.TotalQueriesCoalesced++
+}
+
+// IncrementACLDenials increments the count of queries and connections
+// refused by an access control list
+func (d *DNSResolverData) IncrementACLDenials() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Stats.TotalACLDenials++
+}
+
 // IncrementQueriesAnswered increments the queries answered count
 func (d *DNSResolverData) IncrementQueriesAnswered() {
 	d.mu.Lock()
@@ -268,20 +585,38 @@ func LoadFromJSON[T any](filePath string) T {
 	return result
 }
 
-// SaveToJSON marshals data and saves it to a JSON file
+// SaveToJSON marshals data and saves it to a JSON file. The data is written
+// to a temporary file in the same directory which then replaces filePath, so
+// readers and crashes never see a partially written file.
 func SaveToJSON[T any](filePath string, data T) error {
-	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return err
 	}
-	file, err := os.Create(filePath)
+	file, err := os.CreateTemp(dir, "."+filepath.Base(filePath)+".*.tmp")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	tmpPath := file.Name()
+	defer os.Remove(tmpPath)
 
 	encoder := json.NewEncoder(file)
 	encoder.SetIndent("", "  ")
-	return encoder.Encode(data)
+	if err := encoder.Encode(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
 }
 
 // LoadDNSServers reads the dnsservers.json file and returns the list of DNS servers
@@ -337,6 +672,28 @@ func LoadCacheRecords() []dnsrecordcache.CacheRecord {
 	return cache.Cache
 }
 
+// LoadPolicyRules reads the policy.json file and returns the allow and deny
+// rules
+func LoadPolicyRules() []policy.Rule {
+	type policyType struct {
+		Rules []policy.Rule `json:"rules"`
+	}
+	paths := currentConfig().Config.FileLocations
+	rules := LoadFromJSON[policyType](paths.PolicyFile)
+	return rules.Rules
+}
+
+// SavePolicyRules saves the allow and deny rules to the policy.json file
+func SavePolicyRules(rules []policy.Rule) error {
+	type policyType struct {
+		Rules []policy.Rule `json:"rules"`
+	}
+
+	data := policyType{Rules: rules}
+	paths := currentConfig().Config.FileLocations
+	return SaveToJSON(paths.PolicyFile, data)
+}
+
 // SaveCacheRecords saves the cache records to the dnscache.json file
 func SaveCacheRecords(cacheRecords []dnsrecordcache.CacheRecord) error {
 	type cacheType struct {
@@ -344,7 +701,6 @@ func SaveCacheRecords(cacheRecords []dnsrecordcache.CacheRecord) error {
 	}
 
 	data := cacheType{Cache: cacheRecords}
-	_ = data
 	paths := currentConfig().Config.FileLocations
 	return SaveToJSON(paths.CacheFile, data)
 }
@@ -360,23 +716,13 @@ func (d *DNSResolverData) storeRecords(records []dnsrecords.DNSRecord, persist b
 	}
 }
 
-func (d *DNSResolverData) storeCacheRecords(records []dnsrecordcache.CacheRecord, persist bool) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	d.CacheRecords = records
-	if persist {
-		if err := SaveCacheRecords(records); err != nil {
-			fmt.Println("Failed to save cache records:", err)
-		}
-	}
-}
-
 // InitializeJSONFiles creates the JSON files if they don't exist
 func InitializeJSONFiles() {
 	paths := currentConfig().Config.FileLocations
 	CreateFileIfNotExists(paths.DNSServerFile, `{"dnsservers":[{"address": "1.1.1.1","port": "53","active": false,"local_resolver": false,"adblocker": false }]}`)
 	CreateFileIfNotExists(paths.DNSRecordsFile, `{"records": [{"name": "example.com.", "type": "A", "value": "93.184.216.34", "ttl": 3600, "last_query": "0001-01-01T00:00:00Z"}]}`)
 	CreateFileIfNotExists(paths.CacheFile, `{"cache": [{"dns_record": {"name": "example.com","type": "A","value": "192.168.1.1","ttl": 3600,"added_on": "2024-05-01T12:00:00Z","updated_on": "2024-05-05T18:30:00Z","mac": "00:1A:2B:3C:4D:5E","last_query": "2024-05-07T15:45:00Z"},"expiry": "2024-05-10T12:00:00Z","timestamp": "2024-05-07T12:30:00Z","last_query": "2024-05-07T14:00:00Z"}]}`)
+	CreateFileIfNotExists(paths.PolicyFile, `{"rules": []}`)
 }
 
 // CreateFileIfNotExists creates a file with the given filename and content if it does not exist
@@ -0,0 +1,493 @@
+package dnsrecordcache
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultMaxEntries bounds the cache when no limit is configured.
+const DefaultMaxEntries = 10000
+
+// shardCount is the number of independently locked partitions. Keys are
+// spread over the shards by hash so that concurrent queries for different
+// names rarely contend on the same lock.
+const shardCount = 32
+
+// Key identifies a cached RRset.
+type Key struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	// DNSSEC marks answers to queries with the DO bit set. They carry
+	// signatures that other clients did not ask for, so they are cached apart
+	// from answers without them.
+	DNSSEC bool
+}
+
+// NewKey builds the key for name, rrtype and class. Names are compared
+// case-insensitively and always fully qualified.
+func NewKey(name string, rrtype, class uint16) Key {
+	return Key{Name: dns.CanonicalName(name), Type: rrtype, Class: class}
+}
+
+// String formats the key as "name type class".
+func (k Key) String() string {
+	return k.Name + " " + dns.TypeToString[k.Type] + " " + dns.ClassToString[k.Class]
+}
+
+// Entry is a cached answer to one (name, type, class) question. Positive
+// entries hold the complete answer, including any CNAME chain leading to the
+// RRset; negative entries hold the rcode and SOA of an NXDOMAIN or NODATA
+// reply.
+type Entry struct {
+	Key       Key
+	RRs       []dns.RR
+	Negative  bool
+	Rcode     int
+	SOA       dns.RR
+	Expiry    time.Time
+	Timestamp time.Time
+	LastQuery time.Time
+	// Hits counts the lookups answered by the entry since it was stored.
+	Hits int
+}
+
+// TTL returns the seconds left until the entry expires, or zero.
+func (e Entry) TTL(now time.Time) uint32 {
+	if !now.Before(e.Expiry) {
+		return 0
+	}
+	return uint32(e.Expiry.Sub(now) / time.Second)
+}
+
+// LifetimeLeft returns the share of the entry's original TTL that is left at
+// now, between 0 and 1.
+func (e Entry) LifetimeLeft(now time.Time) float64 {
+	lifetime := e.Expiry.Sub(e.Timestamp)
+	if lifetime <= 0 || !now.Before(e.Expiry) {
+		return 0
+	}
+	return float64(e.Expiry.Sub(now)) / float64(lifetime)
+}
+
+// clone returns a deep copy of the entry.
+func (e Entry) clone() Entry {
+	copied := e
+	copied.RRs = copyRRs(e.RRs)
+	if e.SOA != nil {
+		copied.SOA = dns.Copy(e.SOA)
+	}
+	return copied
+}
+
+// withTTL returns a deep copy of the entry whose records carry ttl.
+func (e Entry) withTTL(ttl uint32) Entry {
+	copied := e.clone()
+	for _, rr := range copied.RRs {
+		rr.Header().Ttl = ttl
+	}
+	if copied.SOA != nil {
+		copied.SOA.Header().Ttl = ttl
+	}
+	return copied
+}
+
+type shard struct {
+	mu      sync.Mutex
+	entries map[Key]*list.Element
+	// lru orders entries from most (front) to least recently used.
+	lru *list.List
+	// size is the entry count of the whole cache, shared by every shard.
+	size *atomic.Int64
+}
+
+// Cache is a bounded, concurrency safe store of RRsets keyed by name, type
+// and class. When full, the least recently used entry of the shard receiving
+// a new key is evicted, or of the next shards when that one holds nothing
+// else, so the bound holds for the cache as a whole.
+type Cache struct {
+	shards [shardCount]*shard
+	size   atomic.Int64
+	max    atomic.Int64
+	// modified is set whenever entries are added or removed, so that
+	// persistence can skip writes when nothing changed.
+	modified atomic.Bool
+	// staleWindow is how long, in nanoseconds, expired entries are kept so
+	// they can still be served when every upstream fails (RFC 8767).
+	staleWindow atomic.Int64
+}
+
+// New returns an empty cache holding at most maxEntries entries. A
+// non-positive maxEntries selects DefaultMaxEntries.
+func New(maxEntries int) *Cache {
+	c := &Cache{}
+	for i := range c.shards {
+		c.shards[i] = &shard{entries: make(map[Key]*list.Element), lru: list.New(), size: &c.size}
+	}
+	c.SetMaxEntries(maxEntries)
+	return c
+}
+
+// SetMaxEntries changes the capacity, evicting entries when it shrinks.
+func (c *Cache) SetMaxEntries(maxEntries int) {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	c.max.Store(int64(maxEntries))
+	// Shrink every shard in turn so that the oldest entries of each go first.
+	for c.size.Load() > c.max.Load() {
+		for _, s := range c.shards {
+			s.mu.Lock()
+			if back := s.lru.Back(); back != nil && c.size.Load() > c.max.Load() {
+				s.removeElement(back)
+				c.modified.Store(true)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// SetStaleWindow keeps expired entries for window so that GetStale can serve
+// them. Zero removes entries as soon as they expire.
+func (c *Cache) SetStaleWindow(window time.Duration) {
+	if window < 0 {
+		window = 0
+	}
+	c.staleWindow.Store(int64(window))
+}
+
+// retained reports whether entry is still kept at now, either because it is
+// fresh or because it expired less than the stale window ago.
+func (c *Cache) retained(entry *Entry, now time.Time) bool {
+	return now.Before(entry.Expiry.Add(time.Duration(c.staleWindow.Load())))
+}
+
+// shardFor picks the shard by an FNV-1a hash of the name, so that every type
+// of a name, including its NXDOMAIN entry, lives in the same shard.
+func (c *Cache) shardFor(key Key) *shard {
+	return c.shards[shardIndex(key)]
+}
+
+func shardIndex(key Key) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key.Name); i++ {
+		hash ^= uint32(key.Name[i])
+		hash *= 16777619
+	}
+	return int(hash % shardCount)
+}
+
+// Get returns the unexpired entry for key with record TTLs set to the time
+// left. A cached NXDOMAIN for the name answers every type, since the name
+// does not exist at all.
+func (c *Cache) Get(key Key) (Entry, bool) {
+	now := time.Now()
+	if entry, ok := c.get(key, now); ok {
+		return entry, true
+	}
+	return c.get(nxdomainKey(key), now)
+}
+
+// GetStale returns the entry for key even if it has expired, as long as it is
+// within the stale window, with record TTLs set to ttl. It is meant for
+// answering when no upstream can be reached.
+func (c *Cache) GetStale(key Key, ttl uint32) (Entry, bool) {
+	now := time.Now()
+	if entry, ok := c.getStale(key, ttl, now); ok {
+		return entry, true
+	}
+	return c.getStale(nxdomainKey(key), ttl, now)
+}
+
+func (c *Cache) getStale(key Key, ttl uint32, now time.Time) (Entry, bool) {
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.entries[key]
+	if !ok {
+		return Entry{}, false
+	}
+	entry := element.Value.(*Entry)
+	if !c.retained(entry, now) {
+		s.removeElement(element)
+		c.modified.Store(true)
+		return Entry{}, false
+	}
+	entry.LastQuery = now
+	s.lru.MoveToFront(element)
+	return entry.withTTL(ttl), true
+}
+
+// nxdomainKey is where the NXDOMAIN entry for the name of key is stored.
+// NXDOMAIN applies to the name rather than to one type, so it is kept under
+// the reserved type 0.
+func nxdomainKey(key Key) Key {
+	return Key{Name: key.Name, Type: dns.TypeNone, Class: key.Class, DNSSEC: key.DNSSEC}
+}
+
+func (c *Cache) get(key Key, now time.Time) (Entry, bool) {
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.entries[key]
+	if !ok {
+		return Entry{}, false
+	}
+	entry := element.Value.(*Entry)
+	if !now.Before(entry.Expiry) {
+		if !c.retained(entry, now) {
+			s.removeElement(element)
+			c.modified.Store(true)
+		}
+		return Entry{}, false
+	}
+	entry.LastQuery = now
+	entry.Hits++
+	s.lru.MoveToFront(element)
+	return entry.withTTL(entry.TTL(now)), true
+}
+
+// Set stores entry, replacing any entry with the same key.
+func (c *Cache) Set(entry Entry) {
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	if entry.LastQuery.IsZero() {
+		entry.LastQuery = entry.Timestamp
+	}
+	index := shardIndex(entry.Key)
+	s := c.shards[index]
+	s.mu.Lock()
+	c.modified.Store(true)
+	if element, ok := s.entries[entry.Key]; ok {
+		stored := element.Value.(*Entry)
+		entry.LastQuery = stored.LastQuery
+		*stored = entry
+		s.lru.MoveToFront(element)
+		s.mu.Unlock()
+		return
+	}
+	stored := entry
+	element := s.lru.PushFront(&stored)
+	s.entries[entry.Key] = element
+	c.size.Add(1)
+	s.mu.Unlock()
+	c.evict(index, element)
+}
+
+// evict removes least recently used entries until the cache is within its
+// bound. It starts with the shard at start and moves on to the next shards
+// once that one is empty. added, the entry that was just stored, is kept.
+func (c *Cache) evict(start int, added *list.Element) {
+	for i := 0; i < shardCount && c.size.Load() > c.max.Load(); {
+		s := c.shards[(start+i)%shardCount]
+		s.mu.Lock()
+		if back := s.lru.Back(); back != nil && back != added {
+			s.removeElement(back)
+		} else {
+			i++
+		}
+		s.mu.Unlock()
+	}
+}
+
+// AddAnswer caches the answer section of a reply under key. The entry expires
+// with the smallest TTL among the records.
+func (c *Cache) AddAnswer(key Key, rrs []dns.RR) {
+	if len(rrs) == 0 {
+		return
+	}
+	now := time.Now()
+	ttl := minTTL(rrs)
+	if ttl == 0 {
+		return
+	}
+	// A positive answer proves the name exists.
+	nxdomain := nxdomainKey(key)
+	c.Delete(nxdomain)
+	nxdomain.DNSSEC = !nxdomain.DNSSEC
+	c.Delete(nxdomain)
+	c.Set(Entry{
+		Key:       key,
+		RRs:       copyRRs(rrs),
+		Expiry:    now.Add(time.Duration(ttl) * time.Second),
+		Timestamp: now,
+	})
+}
+
+// Add caches rrs grouped into RRsets by owner name, type and class.
+func (c *Cache) Add(rrs []dns.RR) {
+	sets := make(map[Key][]dns.RR)
+	var order []Key
+	for _, rr := range rrs {
+		header := rr.Header()
+		key := NewKey(header.Name, header.Rrtype, header.Class)
+		if _, ok := sets[key]; !ok {
+			order = append(order, key)
+		}
+		sets[key] = append(sets[key], rr)
+	}
+	for _, key := range order {
+		c.AddAnswer(key, sets[key])
+	}
+}
+
+// AddNegative caches an NXDOMAIN or NODATA answer under key. As RFC 2308
+// requires, the entry lives for the smaller of the SOA's TTL and its MINIMUM
+// field, capped at maxTTL seconds when maxTTL is positive. NXDOMAIN entries
+// are stored for the name rather than for the queried type.
+func (c *Cache) AddNegative(key Key, rcode int, soa *dns.SOA, maxTTL uint32) {
+	ttl := soa.Hdr.Ttl
+	if soa.Minttl < ttl {
+		ttl = soa.Minttl
+	}
+	if maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	if ttl == 0 {
+		return
+	}
+	if rcode == dns.RcodeNameError {
+		key = nxdomainKey(key)
+	}
+	stored := dns.Copy(soa)
+	stored.Header().Ttl = ttl
+	now := time.Now()
+	c.Set(Entry{
+		Key:       key,
+		Negative:  true,
+		Rcode:     rcode,
+		SOA:       stored,
+		Expiry:    now.Add(time.Duration(ttl) * time.Second),
+		Timestamp: now,
+	})
+}
+
+// Delete removes the entry for key and reports whether it existed.
+func (c *Cache) Delete(key Key) bool {
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.entries[key]
+	if ok {
+		s.removeElement(element)
+		c.modified.Store(true)
+	}
+	return ok
+}
+
+// Clear removes every entry.
+func (c *Cache) Clear() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		c.size.Add(-int64(s.lru.Len()))
+		s.entries = make(map[Key]*list.Element)
+		s.lru.Init()
+		s.mu.Unlock()
+	}
+	c.modified.Store(true)
+}
+
+// Len returns the number of entries, including expired ones that are not yet
+// purged or are kept for serving stale.
+func (c *Cache) Len() int {
+	return int(c.size.Load())
+}
+
+// Entries returns a copy of every entry sorted by name and type. Record TTLs
+// are left as they were stored.
+func (c *Cache) Entries() []Entry {
+	var entries []Entry
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for element := s.lru.Front(); element != nil; element = element.Next() {
+			entries = append(entries, element.Value.(*Entry).clone())
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Key.Name != entries[j].Key.Name {
+			return entries[i].Key.Name < entries[j].Key.Name
+		}
+		if entries[i].Key.Type != entries[j].Key.Type {
+			return entries[i].Key.Type < entries[j].Key.Type
+		}
+		return !entries[i].Key.DNSSEC && entries[j].Key.DNSSEC
+	})
+	return entries
+}
+
+// PurgeExpired removes every entry that expired longer than the stale window
+// ago and returns how many were removed.
+func (c *Cache) PurgeExpired() int {
+	now := time.Now()
+	removed := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for _, element := range s.entries {
+			if !c.retained(element.Value.(*Entry), now) {
+				s.removeElement(element)
+				removed++
+			}
+		}
+		s.mu.Unlock()
+	}
+	if removed > 0 {
+		c.modified.Store(true)
+	}
+	return removed
+}
+
+// Modified reports whether entries were added or removed since the last call
+// and clears the flag.
+func (c *Cache) Modified() bool {
+	return c.modified.Swap(false)
+}
+
+// MarkModified flags the cache as changed, e.g. after a failed save.
+func (c *Cache) MarkModified() {
+	c.modified.Store(true)
+}
+
+// RunJanitor purges entries past the stale window every interval until stop is closed.
+func (c *Cache) RunJanitor(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.PurgeExpired()
+		}
+	}
+}
+
+func (s *shard) removeElement(element *list.Element) {
+	delete(s.entries, element.Value.(*Entry).Key)
+	s.lru.Remove(element)
+	s.size.Add(-1)
+}
+
+func minTTL(rrs []dns.RR) uint32 {
+	var ttl uint32
+	for i, rr := range rrs {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+func copyRRs(rrs []dns.RR) []dns.RR {
+	copied := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		copied[i] = dns.Copy(rr)
+	}
+	return copied
+}
@@ -0,0 +1,298 @@
+package dnsrecordcache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"dnsplane/dnsrecords"
+
+	"github.com/miekg/dns"
+)
+
+func aRecord(t testing.TB, name string, ttl uint32) []dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN A 192.0.2.1", name, ttl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []dns.RR{rr}
+}
+
+func testSOA(t testing.TB) *dns.SOA {
+	t.Helper()
+	rr, err := dns.NewRR("example.test. 300 IN SOA ns.example.test. admin.example.test. 1 3600 600 86400 300")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr.(*dns.SOA)
+}
+
+// sameShardNames returns count names that are stored in the same shard, so
+// that eviction order within it can be checked.
+func sameShardNames(count int) []string {
+	var names []string
+	shard := -1
+	for i := 0; len(names) < count; i++ {
+		name := fmt.Sprintf("host%d.example.test.", i)
+		index := shardIndex(NewKey(name, dns.TypeA, dns.ClassINET))
+		if shard == -1 {
+			shard = index
+		}
+		if index == shard {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	names := sameShardNames(4)
+	cache := New(3)
+	for _, name := range names[:3] {
+		cache.AddAnswer(NewKey(name, dns.TypeA, dns.ClassINET), aRecord(t, name, 300))
+	}
+	// Using the oldest entry makes the second one the least recently used.
+	if _, ok := cache.Get(NewKey(names[0], dns.TypeA, dns.ClassINET)); !ok {
+		t.Fatalf("%s missing before eviction", names[0])
+	}
+	cache.AddAnswer(NewKey(names[3], dns.TypeA, dns.ClassINET), aRecord(t, names[3], 300))
+
+	if got := cache.Len(); got != 3 {
+		t.Errorf("Len() = %d, want 3", got)
+	}
+	for i, name := range names {
+		_, ok := cache.Get(NewKey(name, dns.TypeA, dns.ClassINET))
+		if want := i != 1; ok != want {
+			t.Errorf("%s cached = %t, want %t", name, ok, want)
+		}
+	}
+}
+
+func TestCacheMaxEntriesBelowShardCount(t *testing.T) {
+	cache := New(5)
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("host%d.example.test.", i)
+		cache.AddAnswer(NewKey(name, dns.TypeA, dns.ClassINET), aRecord(t, name, 300))
+		if got := cache.Len(); got > 5 {
+			t.Fatalf("Len() = %d after %d adds, want at most 5", got, i+1)
+		}
+	}
+	if got := len(cache.Entries()); got != 5 {
+		t.Errorf("%d entries, want 5", got)
+	}
+	if _, ok := cache.Get(NewKey("host99.example.test.", dns.TypeA, dns.ClassINET)); !ok {
+		t.Error("newest entry was evicted")
+	}
+
+	cache.SetMaxEntries(2)
+	if got := cache.Len(); got != 2 {
+		t.Errorf("Len() = %d after shrinking, want 2", got)
+	}
+	if got := len(cache.Entries()); got != 2 {
+		t.Errorf("%d entries after shrinking, want 2", got)
+	}
+}
+
+func TestCacheJanitorPurgesExpiredEntries(t *testing.T) {
+	cache := New(0)
+	now := time.Now()
+	cache.Set(Entry{Key: NewKey("old.example.test.", dns.TypeA, dns.ClassINET), RRs: aRecord(t, "old.example.test.", 1), Expiry: now.Add(20 * time.Millisecond)})
+	cache.Set(Entry{Key: NewKey("fresh.example.test.", dns.TypeA, dns.ClassINET), RRs: aRecord(t, "fresh.example.test.", 300), Expiry: now.Add(time.Hour)})
+	cache.Modified()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go cache.RunJanitor(stop, 10*time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for cache.Len() > 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expired entry not purged, %d entries left", cache.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := cache.Get(NewKey("fresh.example.test.", dns.TypeA, dns.ClassINET)); !ok {
+		t.Error("fresh entry was purged")
+	}
+	if !cache.Modified() {
+		t.Error("purge did not mark the cache modified")
+	}
+}
+
+func TestCacheStaleWindowKeepsExpiredEntries(t *testing.T) {
+	cache := New(0)
+	cache.SetStaleWindow(time.Hour)
+	key := NewKey("stale.example.test.", dns.TypeA, dns.ClassINET)
+	cache.Set(Entry{Key: key, RRs: aRecord(t, key.Name, 60), Expiry: time.Now().Add(-time.Minute)})
+
+	if removed := cache.PurgeExpired(); removed != 0 {
+		t.Errorf("PurgeExpired() removed %d entries within the stale window", removed)
+	}
+	if _, ok := cache.Get(key); ok {
+		t.Error("Get returned an expired entry")
+	}
+	entry, ok := cache.GetStale(key, 30)
+	if !ok {
+		t.Fatal("GetStale found nothing")
+	}
+	if ttl := entry.RRs[0].Header().Ttl; ttl != 30 {
+		t.Errorf("stale TTL = %d, want 30", ttl)
+	}
+}
+
+func TestCacheNXDOMAINCoversEveryType(t *testing.T) {
+	cache := New(0)
+	name := "missing.example.test."
+	cache.AddNegative(NewKey(name, dns.TypeA, dns.ClassINET), dns.RcodeNameError, testSOA(t), 0)
+
+	for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeMX} {
+		entry, ok := cache.Get(NewKey(name, rrtype, dns.ClassINET))
+		if !ok {
+			t.Fatalf("%s: NXDOMAIN entry not found", dns.TypeToString[rrtype])
+		}
+		if !entry.Negative || entry.Rcode != dns.RcodeNameError {
+			t.Errorf("%s: got negative=%t rcode=%d, want NXDOMAIN", dns.TypeToString[rrtype], entry.Negative, entry.Rcode)
+		}
+		if ttl := entry.SOA.Header().Ttl; ttl == 0 || ttl > 300 {
+			t.Errorf("%s: SOA TTL = %d, want 1-300", dns.TypeToString[rrtype], ttl)
+		}
+	}
+	if records := cache.Records(); len(records) != 1 || records[0].DNSRecord.Type != "ANY" {
+		t.Errorf("persisted as %+v, want one ANY record", records)
+	}
+
+	// A positive answer proves the name exists.
+	cache.AddAnswer(NewKey(name, dns.TypeA, dns.ClassINET), aRecord(t, name, 300))
+	if entry, ok := cache.Get(NewKey(name, dns.TypeAAAA, dns.ClassINET)); ok {
+		t.Errorf("AAAA still answered by %+v after a positive answer", entry)
+	}
+}
+
+func TestCacheNODATACoversOneType(t *testing.T) {
+	cache := New(0)
+	name := "v4only.example.test."
+	cache.AddNegative(NewKey(name, dns.TypeAAAA, dns.ClassINET), dns.RcodeSuccess, testSOA(t), 0)
+
+	if entry, ok := cache.Get(NewKey(name, dns.TypeAAAA, dns.ClassINET)); !ok || entry.NegativeLabel() != "NODATA" {
+		t.Errorf("AAAA: got %+v, %t, want a NODATA entry", entry, ok)
+	}
+	if _, ok := cache.Get(NewKey(name, dns.TypeA, dns.ClassINET)); ok {
+		t.Error("NODATA for AAAA answered A")
+	}
+}
+
+func TestCacheNegativeTTLIsCapped(t *testing.T) {
+	cache := New(0)
+	key := NewKey("capped.example.test.", dns.TypeA, dns.ClassINET)
+	cache.AddNegative(key, dns.RcodeNameError, testSOA(t), 60)
+	entry, ok := cache.Get(key)
+	if !ok {
+		t.Fatal("entry not found")
+	}
+	if ttl := entry.SOA.Header().Ttl; ttl > 60 {
+		t.Errorf("SOA TTL = %d, want at most 60", ttl)
+	}
+}
+
+// sliceCache is the cache this package replaced: a single list of records
+// searched from the start on every lookup. It is kept for the benchmarks.
+type sliceCache struct {
+	mu      sync.RWMutex
+	records []CacheRecord
+}
+
+func (c *sliceCache) get(name, recordType string) (CacheRecord, bool) {
+	now := time.Now()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, record := range c.records {
+		if dnsrecords.NormalizeRecordNameKey(record.DNSRecord.Name) == dnsrecords.NormalizeRecordNameKey(name) &&
+			dnsrecords.NormalizeRecordType(record.DNSRecord.Type) == dnsrecords.NormalizeRecordType(recordType) &&
+			now.Before(record.Expiry) {
+			return record, true
+		}
+	}
+	return CacheRecord{}, false
+}
+
+func (c *sliceCache) add(record CacheRecord) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, existing := range c.records {
+		if existing.DNSRecord.Name == record.DNSRecord.Name && existing.DNSRecord.Type == record.DNSRecord.Type && existing.DNSRecord.Value == record.DNSRecord.Value {
+			c.records[i] = record
+			return
+		}
+	}
+	c.records = append(c.records, record)
+}
+
+const benchmarkEntries = 10000
+
+func benchmarkName(i int) string {
+	return fmt.Sprintf("host%d.example.test.", i%benchmarkEntries)
+}
+
+func benchmarkRecord(b *testing.B, name string) CacheRecord {
+	return Entry{Key: NewKey(name, dns.TypeA, dns.ClassINET), RRs: aRecord(b, name, 300), Expiry: time.Now().Add(time.Hour)}.Record()
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	b.Run("sharded", func(b *testing.B) {
+		cache := New(benchmarkEntries)
+		keys := make([]Key, benchmarkEntries)
+		for i := range keys {
+			keys[i] = NewKey(benchmarkName(i), dns.TypeA, dns.ClassINET)
+			cache.AddAnswer(keys[i], aRecord(b, keys[i].Name, 300))
+		}
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				if _, ok := cache.Get(keys[i%len(keys)]); !ok {
+					b.Fatal("miss")
+				}
+			}
+		})
+	})
+	b.Run("slice", func(b *testing.B) {
+		cache := &sliceCache{}
+		for i := 0; i < benchmarkEntries; i++ {
+			cache.add(benchmarkRecord(b, benchmarkName(i)))
+		}
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				if _, ok := cache.get(benchmarkName(i), "A"); !ok {
+					b.Fatal("miss")
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkCacheAdd(b *testing.B) {
+	b.Run("sharded", func(b *testing.B) {
+		cache := New(benchmarkEntries)
+		rrs := make([][]dns.RR, benchmarkEntries)
+		for i := range rrs {
+			rrs[i] = aRecord(b, benchmarkName(i), 300)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			cache.AddAnswer(NewKey(benchmarkName(i), dns.TypeA, dns.ClassINET), rrs[i%benchmarkEntries])
+		}
+	})
+	b.Run("slice", func(b *testing.B) {
+		cache := &sliceCache{}
+		records := make([]CacheRecord, benchmarkEntries)
+		for i := range records {
+			records[i] = benchmarkRecord(b, benchmarkName(i))
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			cache.add(records[i%benchmarkEntries])
+		}
+	})
+}
@@ -1,4 +1,4 @@
-// Package dnsrecordcache provides a simple in-memory cache
+// Package dnsrecordcache provides an in-memory cache of DNS answers
 package dnsrecordcache
 
 import (
@@ -12,12 +12,24 @@ import (
 	"github.com/miekg/dns"
 )
 
-// CacheRecord holds the data for the cache records
+// CacheRecord is the persisted form of a cache entry, as stored in
+// dnscache.json
 type CacheRecord struct {
+	// DNSRecord holds the cached name and type. Its value is the first
+	// record's data for positive entries and the SOA for negative ones.
 	DNSRecord dnsrecords.DNSRecord `json:"dns_record"`
-	Expiry    time.Time            `json:"expiry,omitempty"`
-	Timestamp time.Time            `json:"timestamp,omitempty"`
-	LastQuery time.Time            `json:"last_query,omitempty"`
+	Class     string               `json:"class,omitempty"`
+	// Records holds every record of the answer in presentation format.
+	Records   []string  `json:"records,omitempty"`
+	Expiry    time.Time `json:"expiry,omitempty"`
+	Timestamp time.Time `json:"timestamp,omitempty"`
+	LastQuery time.Time `json:"last_query,omitempty"`
+	Hits      int       `json:"hits,omitempty"`
+	// Negative marks a cached NXDOMAIN or NODATA answer (RFC 2308).
+	Negative bool `json:"negative,omitempty"`
+	Rcode    int  `json:"rcode,omitempty"`
+	// DNSSEC marks an answer cached for clients that set the DO bit.
+	DNSSEC bool `json:"dnssec,omitempty"`
 }
 
 var (
@@ -25,79 +37,213 @@ var (
 	ErrInvalidArgs   = errors.New("invalid arguments")
 )
 
-// Add a new record to the cache
-func Add(cacheRecordsData []CacheRecord, record *dns.RR) []CacheRecord {
-	var value string
-
-	switch r := (*record).(type) {
-	case *dns.A:
-		value = r.A.String()
-	case *dns.AAAA:
-		value = r.AAAA.String()
-	case *dns.CNAME:
-		value = r.Target
-	case *dns.MX:
-		value = fmt.Sprintf("%d %s", r.Preference, r.Mx)
-	case *dns.NS:
-		value = r.Ns
-	case *dns.SOA:
-		value = fmt.Sprintf("%s %s %d %d %d %d %d", r.Ns, r.Mbox, r.Serial, r.Refresh, r.Retry, r.Expire, r.Minttl)
-	case *dns.TXT:
-		value = strings.Join(r.Txt, " ")
-	default:
-		value = (*record).String()
+// SOA returns the authority record of a negative entry with its TTL set to
+// ttl, or nil when the entry is positive or its value cannot be parsed.
+func (c CacheRecord) SOA(ttl uint32) dns.RR {
+	if !c.Negative {
+		return nil
+	}
+	rr, err := dns.NewRR(c.DNSRecord.Value)
+	if err != nil || rr == nil {
+		return nil
+	}
+	rr.Header().Ttl = ttl
+	return rr
+}
+
+// NegativeLabel names the kind of negative answer, NXDOMAIN or NODATA.
+func (c CacheRecord) NegativeLabel() string {
+	return negativeLabel(c.Rcode)
+}
+
+// NegativeLabel names the kind of negative answer, NXDOMAIN or NODATA.
+func (e Entry) NegativeLabel() string {
+	return negativeLabel(e.Rcode)
+}
+
+func negativeLabel(rcode int) string {
+	if rcode == dns.RcodeNameError {
+		return "NXDOMAIN"
+	}
+	return "NODATA"
+}
+
+// RRs parses the stored records of a positive entry.
+func (c CacheRecord) RRs() []dns.RR {
+	rrs := make([]dns.RR, 0, len(c.Records))
+	for _, text := range c.Records {
+		if rr, err := dns.NewRR(text); err == nil && rr != nil {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// Values returns the data of each stored record for display. Records of a
+// CNAME chain that belong to another name or type are shown in full.
+func (c CacheRecord) Values() []string {
+	if c.Negative {
+		return []string{c.DNSRecord.Value}
 	}
+	name := dns.CanonicalName(c.DNSRecord.Name)
+	values := make([]string, 0, len(c.Records))
+	for _, rr := range c.RRs() {
+		header := rr.Header()
+		if dns.CanonicalName(header.Name) == name && dns.TypeToString[header.Rrtype] == c.DNSRecord.Type {
+			values = append(values, rdata(rr))
+			continue
+		}
+		values = append(values, fmt.Sprintf("%s %s %s", header.Name, dns.TypeToString[header.Rrtype], rdata(rr)))
+	}
+	return values
+}
 
-	cacheRecord := CacheRecord{
+// Record converts an entry into its persisted form.
+func (e Entry) Record() CacheRecord {
+	record := CacheRecord{
 		DNSRecord: dnsrecords.DNSRecord{
-			Name:  (*record).Header().Name,
-			Type:  dns.TypeToString[(*record).Header().Rrtype],
-			Value: value,
-			TTL:   (*record).Header().Ttl,
+			Name: e.Key.Name,
+			Type: typeName(e.Key),
 		},
-		Expiry:    time.Now().Add(time.Duration((*record).Header().Ttl) * time.Second),
-		Timestamp: time.Now(),
+		Class:     dns.ClassToString[e.Key.Class],
+		Expiry:    e.Expiry,
+		Timestamp: e.Timestamp,
+		LastQuery: e.LastQuery,
+		Hits:      e.Hits,
+		Negative:  e.Negative,
+		Rcode:     e.Rcode,
+		DNSSEC:    e.Key.DNSSEC,
 	}
-
-	// Check if the record already exists in the cache
-	recordIndex := -1
-	for i, existingRecord := range cacheRecordsData {
-		if existingRecord.DNSRecord.Name == cacheRecord.DNSRecord.Name &&
-			existingRecord.DNSRecord.Type == cacheRecord.DNSRecord.Type &&
-			existingRecord.DNSRecord.Value == cacheRecord.DNSRecord.Value {
-			recordIndex = i
-			break
+	if e.Negative {
+		if e.SOA != nil {
+			record.DNSRecord.Value = e.SOA.String()
+			record.DNSRecord.TTL = e.SOA.Header().Ttl
 		}
+		return record
 	}
+	record.DNSRecord.TTL = minTTL(e.RRs)
+	for i, rr := range e.RRs {
+		if i == 0 {
+			record.DNSRecord.Value = rdata(rr)
+		}
+		record.Records = append(record.Records, rr.String())
+	}
+	return record
+}
 
-	// If the record exists in the cache, update its TTL, expiry, and last query, otherwise add it
-	if recordIndex != -1 {
-		cacheRecordsData[recordIndex].DNSRecord.TTL = cacheRecord.DNSRecord.TTL
-		cacheRecordsData[recordIndex].Expiry = cacheRecord.Expiry
-		cacheRecordsData[recordIndex].LastQuery = time.Now()
-	} else {
-		cacheRecord.LastQuery = time.Now()
-		cacheRecordsData = append(cacheRecordsData, cacheRecord)
+// Records returns the persisted form of every entry.
+func (c *Cache) Records() []CacheRecord {
+	entries := c.Entries()
+	records := make([]CacheRecord, 0, len(entries))
+	for _, entry := range entries {
+		records = append(records, entry.Record())
 	}
+	return records
+}
 
-	return cacheRecordsData
+// Load replaces the cache contents with records, skipping those that expired
+// longer than the stale window ago.
+// Records written before full RRsets were stored, which only carry a
+// flattened name, type and value, are converted and grouped by name and type.
+func (c *Cache) Load(records []CacheRecord) {
+	c.Clear()
+	now := time.Now()
+	legacy := make(map[Key]*Entry)
+	var legacyOrder []Key
+	for _, record := range records {
+		if !now.Before(record.Expiry.Add(time.Duration(c.staleWindow.Load()))) {
+			continue
+		}
+		entry, ok := record.entry()
+		if !ok {
+			continue
+		}
+		if len(record.Records) > 0 || record.Negative {
+			c.Set(entry)
+			continue
+		}
+		if existing, ok := legacy[entry.Key]; ok {
+			existing.RRs = append(existing.RRs, entry.RRs...)
+			if entry.Expiry.Before(existing.Expiry) {
+				existing.Expiry = entry.Expiry
+			}
+			continue
+		}
+		legacy[entry.Key] = &entry
+		legacyOrder = append(legacyOrder, entry.Key)
+	}
+	for _, key := range legacyOrder {
+		c.Set(*legacy[key])
+	}
+	// The contents now match what was loaded, so there is nothing to save.
+	c.modified.Store(false)
 }
 
-// List returns the cache records without mutating them.
-func List(cacheRecordsData []CacheRecord) []CacheRecord {
-	return cacheRecordsData
+// entry converts a persisted record back into a cache entry.
+func (c CacheRecord) entry() (Entry, bool) {
+	class := uint16(dns.ClassINET)
+	if value, ok := dns.StringToClass[strings.ToUpper(c.Class)]; ok {
+		class = value
+	}
+	rrtype, ok := dns.StringToType[dnsrecords.NormalizeRecordType(c.DNSRecord.Type)]
+	if !ok && !(c.Negative && c.Rcode == dns.RcodeNameError) {
+		return Entry{}, false
+	}
+	entry := Entry{
+		Key:       NewKey(c.DNSRecord.Name, rrtype, class),
+		Expiry:    c.Expiry,
+		Timestamp: c.Timestamp,
+		LastQuery: c.LastQuery,
+		Hits:      c.Hits,
+		Negative:  c.Negative,
+		Rcode:     c.Rcode,
+	}
+	entry.Key.DNSSEC = c.DNSSEC
+	switch {
+	case c.Negative:
+		entry.SOA = c.SOA(c.DNSRecord.TTL)
+		if entry.SOA == nil {
+			return Entry{}, false
+		}
+		if c.Rcode == dns.RcodeNameError {
+			entry.Key = nxdomainKey(entry.Key)
+		}
+	case len(c.Records) > 0:
+		entry.RRs = c.RRs()
+	default:
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", c.DNSRecord.Name, c.DNSRecord.TTL, c.DNSRecord.Type, c.DNSRecord.Value))
+		if err == nil && rr != nil {
+			entry.RRs = []dns.RR{rr}
+		}
+	}
+	if !entry.Negative && len(entry.RRs) == 0 {
+		return Entry{}, false
+	}
+	return entry, true
 }
 
-// Remove a record from the cache
+// typeName returns the type shown for key. NXDOMAIN entries cover every type
+// of their name and are shown as ANY.
+func typeName(key Key) string {
+	if key.Type == dns.TypeNone {
+		return "ANY"
+	}
+	return dns.TypeToString[key.Type]
+}
 
-func Remove(fullCommand []string, cacheRecordsData []CacheRecord) ([]CacheRecord, []dnsrecords.Message, error) {
+// rdata returns the data part of rr in presentation format.
+func rdata(rr dns.RR) string {
+	return strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String()))
+}
+
+// Remove removes the cache entry matching the command arguments
+func Remove(fullCommand []string, cache *Cache) ([]dnsrecords.Message, error) {
 	messages := make([]dnsrecords.Message, 0)
 	if len(fullCommand) == 0 || cliutil.IsHelpRequest(fullCommand) {
-		return cacheRecordsData, usageCacheRemove(), ErrHelpRequested
+		return usageCacheRemove(), ErrHelpRequested
 	}
 
-	nameArg := strings.TrimSpace(fullCommand[0])
-	nameKey := dnsrecords.NormalizeRecordNameKey(nameArg)
+	nameKey := dns.CanonicalName(strings.TrimSpace(fullCommand[0]))
 
 	typeArg := ""
 	if len(fullCommand) >= 2 {
@@ -114,42 +260,54 @@ func Remove(fullCommand []string, cacheRecordsData []CacheRecord) ([]CacheRecord
 		valueKey = dnsrecords.NormalizeRecordValueKey(typeKey, valueArg)
 	}
 
-	matchingIdx := make([]int, 0)
-	for i, record := range cacheRecordsData {
-		if dnsrecords.NormalizeRecordNameKey(record.DNSRecord.Name) != nameKey {
+	matching := make([]Entry, 0)
+	for _, entry := range cache.Entries() {
+		if entry.Key.Name != nameKey {
 			continue
 		}
-		recordType := dnsrecords.NormalizeRecordType(record.DNSRecord.Type)
-		if typeKey != "" && recordType != typeKey {
+		if typeKey != "" && typeName(entry.Key) != typeKey {
 			continue
 		}
-		recordValueKey := dnsrecords.NormalizeRecordValueKey(recordType, record.DNSRecord.Value)
-		if valueKey != "" && recordValueKey != valueKey {
+		if valueKey != "" && !entryHasValue(entry, valueKey) {
 			continue
 		}
-		matchingIdx = append(matchingIdx, i)
+		matching = append(matching, entry)
 	}
 
-	if len(matchingIdx) == 0 {
+	if len(matching) == 0 {
 		msgs := append([]dnsrecords.Message{{Level: dnsrecords.LevelWarn, Text: "No records found with the specified criteria."}}, usageCacheRemove()...)
-		return cacheRecordsData, msgs, ErrInvalidArgs
+		return msgs, ErrInvalidArgs
 	}
 
-	if len(matchingIdx) > 1 && valueKey == "" {
-		msgs := []dnsrecords.Message{{Level: dnsrecords.LevelWarn, Text: "Multiple records found. Please specify the type and value to remove a specific entry."}}
-		for _, idx := range matchingIdx {
-			record := cacheRecordsData[idx]
-			msgs = append(msgs, dnsrecords.Message{Level: dnsrecords.LevelInfo, Text: fmt.Sprintf("- %s %s %s %d", record.DNSRecord.Name, record.DNSRecord.Type, record.DNSRecord.Value, record.DNSRecord.TTL)})
+	if len(matching) > 1 && typeKey == "" {
+		msgs := []dnsrecords.Message{{Level: dnsrecords.LevelWarn, Text: "Multiple records found. Please specify the type to remove a specific entry."}}
+		for _, entry := range matching {
+			msgs = append(msgs, dnsrecords.Message{Level: dnsrecords.LevelInfo, Text: "- " + describeEntry(entry)})
 		}
 		msgs = append(msgs, usageCacheRemove()...)
-		return cacheRecordsData, msgs, ErrInvalidArgs
+		return msgs, ErrInvalidArgs
 	}
 
-	idx := matchingIdx[0]
-	removed := cacheRecordsData[idx]
-	cacheRecordsData = append(cacheRecordsData[:idx], cacheRecordsData[idx+1:]...)
-	messages = append(messages, dnsrecords.Message{Level: dnsrecords.LevelInfo, Text: fmt.Sprintf("Removed: %s %s %s %d", removed.DNSRecord.Name, removed.DNSRecord.Type, removed.DNSRecord.Value, removed.DNSRecord.TTL)})
-	return cacheRecordsData, messages, nil
+	for _, entry := range matching {
+		cache.Delete(entry.Key)
+		messages = append(messages, dnsrecords.Message{Level: dnsrecords.LevelInfo, Text: "Removed: " + describeEntry(entry)})
+	}
+	return messages, nil
+}
+
+func entryHasValue(entry Entry, valueKey string) bool {
+	for _, rr := range entry.RRs {
+		recordType := dns.TypeToString[rr.Header().Rrtype]
+		if dnsrecords.NormalizeRecordValueKey(recordType, rdata(rr)) == valueKey {
+			return true
+		}
+	}
+	return false
+}
+
+func describeEntry(entry Entry) string {
+	record := entry.Record()
+	return fmt.Sprintf("%s %s %s %d", record.DNSRecord.Name, record.DNSRecord.Type, strings.Join(record.Values(), ", "), record.DNSRecord.TTL)
 }
 
 func usageCacheRemove() []dnsrecords.Message {
@@ -436,6 +436,64 @@ func parseDNSRecordArgs(args []string) (DNSRecord, error) {
 	return dnsRecord, nil
 }
 
+// maxCNAMEChain bounds how many local CNAME hops ResolveRecords follows.
+const maxCNAMEChain = 8
+
+// FindRecords returns every stored record matching the name and type as
+// dns.RR values. A record type of ANY matches all types.
+func FindRecords(dnsRecords []DNSRecord, lookupName, recordType string) []dns.RR {
+	targetName := normalizeRecordNameKey(lookupName)
+	targetType := normalizeRecordType(recordType)
+	var rrs []dns.RR
+	for _, record := range dnsRecords {
+		if normalizeRecordNameKey(record.Name) != targetName {
+			continue
+		}
+		if targetType != "ANY" && normalizeRecordType(record.Type) != targetType {
+			continue
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(strings.TrimSpace(lookupName)), record.TTL, normalizeRecordType(record.Type), record.Value))
+		if err != nil || rr == nil {
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// ResolveRecords answers a query from the local store. When no record of the
+// requested type exists but a CNAME does, the chain is followed within the
+// store and every hop is included in the answer.
+func ResolveRecords(dnsRecords []DNSRecord, lookupName, recordType string) []dns.RR {
+	recordType = normalizeRecordType(recordType)
+	var answer []dns.RR
+	name := lookupName
+	seen := make(map[string]struct{})
+	for hop := 0; hop <= maxCNAMEChain; hop++ {
+		if matches := FindRecords(dnsRecords, name, recordType); len(matches) > 0 {
+			return append(answer, matches...)
+		}
+		if recordType == "CNAME" {
+			return answer
+		}
+		cnames := FindRecords(dnsRecords, name, "CNAME")
+		if len(cnames) == 0 {
+			return answer
+		}
+		cname, ok := cnames[0].(*dns.CNAME)
+		if !ok {
+			return answer
+		}
+		answer = append(answer, cname)
+		seen[normalizeRecordNameKey(name)] = struct{}{}
+		name = cname.Target
+		if _, loop := seen[normalizeRecordNameKey(name)]; loop {
+			return answer
+		}
+	}
+	return answer
+}
+
 // FindRecord searches for a DNS record in the list of DNS records.
 func FindRecord(dnsRecords []DNSRecord, lookupRecord, recordType string, autoBuildPTRFromA bool) *dns.RR {
 	for _, record := range dnsRecords {
@@ -2,13 +2,20 @@
 package dnsservers
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"dnsplane/cliutil"
+	"dnsplane/upstream"
+
+	"github.com/miekg/dns"
 )
 
 // DNSServer holds the data for a DNS server
@@ -20,6 +27,118 @@ type DNSServer struct {
 	AdBlocker     bool      `json:"adblocker"`
 	LastUsed      time.Time `json:"last_used,omitempty"`
 	LastSuccess   time.Time `json:"last_success,omitempty"`
+	// LastRTT is the round-trip time of the last successful query or probe.
+	LastRTT time.Duration `json:"last_rtt,omitempty"`
+	// Health is the runtime health state reported by the health checker.
+	Health string `json:"-"`
+	// Domains restricts the server to queries under these suffixes. Servers
+	// without domains form the general pool.
+	Domains []string `json:"domains,omitempty"`
+	// TimeoutMs overrides the global query timeout for this server.
+	TimeoutMs int `json:"timeout_ms,omitempty"`
+	// Retries is the number of extra attempts after a failed query.
+	Retries int `json:"retries,omitempty"`
+	// Protocol is the transport used to reach the server: udp (default), tcp,
+	// tls, https or quic.
+	Protocol string `json:"protocol,omitempty"`
+	// ServerName is the TLS name verified for tls, https and quic servers.
+	// It defaults to the address.
+	ServerName string `json:"server_name,omitempty"`
+	// URL is the DNS-over-HTTPS endpoint of https servers.
+	URL string `json:"url,omitempty"`
+}
+
+// UnmarshalJSON accepts the address either as a plain IP or as a server URL
+// such as "tls://1.1.1.1@cloudflare-dns.com".
+func (s *DNSServer) UnmarshalJSON(payload []byte) error {
+	type plain DNSServer
+	var decoded plain
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		return err
+	}
+	server := DNSServer(decoded)
+	if strings.Contains(server.Address, "://") {
+		if err := applyServerURL(&server, server.Address); err != nil {
+			return err
+		}
+	}
+	*s = server
+	return nil
+}
+
+// Endpoint describes how the server is reached, e.g. "1.1.1.1:53",
+// "tls://1.1.1.1:853" or "https://dns.example/dns-query".
+func (s DNSServer) Endpoint() string {
+	switch s.Protocol {
+	case "", upstream.ProtocolUDP:
+		return net.JoinHostPort(s.Address, s.Port)
+	case upstream.ProtocolHTTPS:
+		return s.URL
+	default:
+		return s.Protocol + "://" + net.JoinHostPort(s.Address, s.Port)
+	}
+}
+
+// ParseServerURL parses a server written as a URL: udp://, tcp://, tls:// and
+// quic:// take host[:port][@servername], https:// takes the DoH endpoint URL.
+func ParseServerURL(raw string) (DNSServer, error) {
+	server := DNSServer{Active: true}
+	err := applyServerURL(&server, raw)
+	return server, err
+}
+
+func applyServerURL(server *DNSServer, raw string) error {
+	scheme, rest, ok := strings.Cut(strings.TrimSpace(raw), "://")
+	scheme = strings.ToLower(scheme)
+	if !ok || scheme == "" || !upstream.IsValidProtocol(scheme) {
+		return fmt.Errorf("invalid server URL: %s (supported schemes: %s)", raw, strings.Join(upstream.Protocols, ", "))
+	}
+
+	if scheme == upstream.ProtocolHTTPS {
+		parsed, err := url.Parse(raw)
+		if err != nil || parsed.Hostname() == "" {
+			return fmt.Errorf("invalid DoH URL: %s", raw)
+		}
+		if parsed.Path == "" {
+			parsed.Path = "/dns-query"
+		}
+		server.Protocol = scheme
+		server.URL = parsed.String()
+		server.Address = parsed.Hostname()
+		server.Port = parsed.Port()
+		if server.Port == "" {
+			server.Port = "443"
+		}
+		server.ServerName = ""
+		return nil
+	}
+
+	hostPort, serverName, _ := strings.Cut(rest, "@")
+	host, port := hostPort, ""
+	if h, p, err := net.SplitHostPort(hostPort); err == nil {
+		host, port = h, p
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid IP address in server URL: %s", raw)
+	}
+	if port == "" {
+		port = "53"
+		if scheme == upstream.ProtocolTLS || scheme == upstream.ProtocolQUIC {
+			port = "853"
+		}
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return fmt.Errorf("invalid port in server URL: %s", raw)
+	}
+	server.Protocol = scheme
+	if scheme == upstream.ProtocolUDP {
+		server.Protocol = ""
+	}
+	server.Address = host
+	server.Port = port
+	server.ServerName = serverName
+	server.URL = ""
+	return nil
 }
 
 var (
@@ -45,18 +164,90 @@ type ListResult struct {
 	Messages []Message
 }
 
-// GetDNSArray returns an array of DNS servers in the format "Address:Port".
+// Route maps a domain suffix to the servers responsible for it.
+type Route struct {
+	Domain  string   `json:"domain"`
+	Servers []string `json:"servers"`
+}
+
+// RouteListResult captures the outcome of listing conditional forwarding routes.
+type RouteListResult struct {
+	Routes   []Route
+	Messages []Message
+}
+
+// GetDNSArray returns the endpoints of the DNS servers, "Address:Port" for
+// plain UDP servers and a URL for the other transports.
 func GetDNSArray(dnsServerData []DNSServer, activeOnly bool) []string {
 	var dnsArray []string
 	for _, dnsServer := range dnsServerData {
 		if activeOnly && !dnsServer.Active {
 			continue
 		}
-		dnsArray = append(dnsArray, dnsServer.Address+":"+dnsServer.Port)
+		dnsArray = append(dnsArray, dnsServer.Endpoint())
 	}
 	return dnsArray
 }
 
+// ServersForQuery returns the active servers that should receive a query for
+// queryName. Servers carrying domain suffixes only receive queries under the
+// longest matching suffix, and the second result reports that one matched;
+// everything else goes to the servers without domains.
+func ServersForQuery(dnsServerData []DNSServer, queryName string) ([]DNSServer, bool) {
+	name := normalizeDomain(queryName)
+	longest := -1
+	var routed []DNSServer
+	var general []DNSServer
+	for _, server := range dnsServerData {
+		if !server.Active {
+			continue
+		}
+		if len(server.Domains) == 0 {
+			general = append(general, server)
+			continue
+		}
+		match := longestMatch(name, server.Domains)
+		if match < 0 || match < longest {
+			continue
+		}
+		if match > longest {
+			longest = match
+			routed = routed[:0]
+		}
+		routed = append(routed, server)
+	}
+	if longest >= 0 {
+		return routed, true
+	}
+	return general, false
+}
+
+// longestMatch returns the length of the longest of domains that name falls
+// under, or -1 when none does.
+func longestMatch(name string, domains []string) int {
+	longest := -1
+	for _, domain := range domains {
+		suffix := normalizeDomain(domain)
+		if domainMatches(name, suffix) && len(suffix) > longest {
+			longest = len(suffix)
+		}
+	}
+	return longest
+}
+
+func normalizeDomain(name string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(name), "."))
+}
+
+// domainMatches reports whether name equals suffix or is a subdomain of it.
+// An empty suffix (the root) matches every name.
+func domainMatches(name, suffix string) bool {
+	if suffix == "" || name == suffix {
+		return true
+	}
+	return strings.HasSuffix(name, "."+suffix)
+}
+
 // Add adds a DNS server to the list, returning the updated slice and messages.
 func Add(fullCommand []string, dnsServers []DNSServer) ([]DNSServer, []Message, error) {
 	messages := make([]Message, 0)
@@ -77,7 +268,7 @@ func Add(fullCommand []string, dnsServers []DNSServer) ([]DNSServer, []Message,
 	}
 
 	dnsServers = append(dnsServers, server)
-	messages = append(messages, Message{Level: LevelInfo, Text: fmt.Sprintf("Added DNS server: %s:%s", server.Address, server.Port)})
+	messages = append(messages, Message{Level: LevelInfo, Text: fmt.Sprintf("Added DNS server: %s", server.Endpoint())})
 	return dnsServers, messages, nil
 }
 
@@ -146,13 +337,121 @@ func List(dnsServerData []DNSServer) ListResult {
 	return result
 }
 
+// AddRoute attaches a domain suffix to an existing server so that matching
+// queries are forwarded only to it.
+func AddRoute(fullCommand []string, dnsServerData []DNSServer) ([]DNSServer, []Message, error) {
+	if cliutil.IsHelpRequest(fullCommand) {
+		return dnsServerData, usageRouteAdd(), ErrHelpRequested
+	}
+	if len(fullCommand) != 2 {
+		msgs := append([]Message{{Level: LevelError, Text: "address and domain are required"}}, usageRouteAdd()...)
+		return dnsServerData, msgs, ErrInvalidArgs
+	}
+
+	address := fullCommand[0]
+	index := findDNSServerIndex(dnsServerData, address)
+	if index == -1 {
+		msgs := append([]Message{{Level: LevelWarn, Text: fmt.Sprintf("DNS server not found: %s", address)}}, usageRouteAdd()...)
+		return dnsServerData, msgs, ErrInvalidArgs
+	}
+	domain := normalizeDomain(fullCommand[1])
+	if _, ok := dns.IsDomainName(domain); !ok || domain == "" {
+		msgs := append([]Message{{Level: LevelError, Text: fmt.Sprintf("invalid domain: %s", fullCommand[1])}}, usageRouteAdd()...)
+		return dnsServerData, msgs, ErrInvalidArgs
+	}
+
+	server := dnsServerData[index]
+	for _, existing := range server.Domains {
+		if normalizeDomain(existing) == domain {
+			return dnsServerData, []Message{{Level: LevelWarn, Text: fmt.Sprintf("%s is already routed to %s", domain, address)}}, nil
+		}
+	}
+	server.Domains = append(append([]string(nil), server.Domains...), domain)
+	dnsServerData[index] = server
+	return dnsServerData, []Message{{Level: LevelInfo, Text: fmt.Sprintf("Routing %s to %s", domain, server.Endpoint())}}, nil
+}
+
+// RemoveRoute detaches a domain suffix from a server.
+func RemoveRoute(fullCommand []string, dnsServerData []DNSServer) ([]DNSServer, []Message, error) {
+	if cliutil.IsHelpRequest(fullCommand) {
+		return dnsServerData, usageRouteRemove(), ErrHelpRequested
+	}
+	if len(fullCommand) != 2 {
+		msgs := append([]Message{{Level: LevelError, Text: "address and domain are required"}}, usageRouteRemove()...)
+		return dnsServerData, msgs, ErrInvalidArgs
+	}
+
+	address := fullCommand[0]
+	index := findDNSServerIndex(dnsServerData, address)
+	if index == -1 {
+		msgs := append([]Message{{Level: LevelWarn, Text: fmt.Sprintf("DNS server not found: %s", address)}}, usageRouteRemove()...)
+		return dnsServerData, msgs, ErrInvalidArgs
+	}
+
+	domain := normalizeDomain(fullCommand[1])
+	server := dnsServerData[index]
+	domains := make([]string, 0, len(server.Domains))
+	for _, existing := range server.Domains {
+		if normalizeDomain(existing) != domain {
+			domains = append(domains, existing)
+		}
+	}
+	if len(domains) == len(server.Domains) {
+		msgs := append([]Message{{Level: LevelWarn, Text: fmt.Sprintf("%s is not routed to %s", domain, address)}}, usageRouteRemove()...)
+		return dnsServerData, msgs, ErrInvalidArgs
+	}
+	if len(domains) == 0 {
+		domains = nil
+	}
+	server.Domains = domains
+	dnsServerData[index] = server
+	return dnsServerData, []Message{{Level: LevelInfo, Text: fmt.Sprintf("Removed route %s from %s", domain, address)}}, nil
+}
+
+// ListRoutes groups the configured domain suffixes with their servers.
+func ListRoutes(dnsServerData []DNSServer) RouteListResult {
+	byDomain := make(map[string][]string)
+	for _, server := range dnsServerData {
+		for _, domain := range server.Domains {
+			key := normalizeDomain(domain)
+			byDomain[key] = append(byDomain[key], server.Endpoint())
+		}
+	}
+
+	result := RouteListResult{Routes: make([]Route, 0, len(byDomain))}
+	for domain, servers := range byDomain {
+		result.Routes = append(result.Routes, Route{Domain: domain, Servers: servers})
+	}
+	sort.Slice(result.Routes, func(i, j int) bool { return result.Routes[i].Domain < result.Routes[j].Domain })
+	if len(result.Routes) == 0 {
+		result.Messages = append(result.Messages, Message{Level: LevelInfo, Text: "No conditional forwarding routes configured."})
+	}
+	return result
+}
+
 // Helper function to parse and apply command arguments to a DNSServer.
 
-func applyArgsToDNSServer(server *DNSServer, args []string) error {
+func applyArgsToDNSServer(server *DNSServer, fullArgs []string) error {
+	args := make([]string, 0, len(fullArgs))
+	var options []string
+	for _, arg := range fullArgs {
+		if strings.Contains(arg, "=") {
+			options = append(options, arg)
+			continue
+		}
+		args = append(args, arg)
+	}
+
 	if len(args) >= 1 {
-		server.Address = args[0]
-		if net.ParseIP(server.Address) == nil {
-			return fmt.Errorf("invalid IP address: %s", server.Address)
+		if strings.Contains(args[0], "://") {
+			if err := applyServerURL(server, args[0]); err != nil {
+				return err
+			}
+		} else {
+			server.Address = args[0]
+			if net.ParseIP(server.Address) == nil {
+				return fmt.Errorf("invalid IP address: %s", server.Address)
+			}
 		}
 	} else {
 		return fmt.Errorf("address is required")
@@ -190,11 +489,78 @@ func applyArgsToDNSServer(server *DNSServer, args []string) error {
 		return fmt.Errorf("too many arguments provided; expected at most %d parameters", maxArgs)
 	}
 
+	for _, option := range options {
+		if err := applyServerOption(server, option); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-// Helper function to find the index of a DNSServer by address.
+// applyServerOption applies a key=value option such as timeout=500ms or retries=2.
+func applyServerOption(server *DNSServer, option string) error {
+	key, value, _ := strings.Cut(option, "=")
+	key = strings.ToLower(strings.TrimSpace(key))
+	value = strings.TrimSpace(value)
+	switch key {
+	case "timeout":
+		timeout, err := ParseMilliseconds(value)
+		if err != nil {
+			return fmt.Errorf("invalid timeout: %s", value)
+		}
+		server.TimeoutMs = timeout
+	case "retries":
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return fmt.Errorf("invalid retries: %s", value)
+		}
+		server.Retries = retries
+	case "protocol":
+		protocol := strings.ToLower(value)
+		if !upstream.IsValidProtocol(protocol) || protocol == upstream.ProtocolHTTPS {
+			return fmt.Errorf("invalid protocol: %s (use an https:// URL for DoH)", value)
+		}
+		if protocol == upstream.ProtocolUDP {
+			protocol = ""
+		}
+		server.Protocol = protocol
+		server.URL = ""
+	case "server_name":
+		server.ServerName = value
+	default:
+		return fmt.Errorf("unknown option: %s", key)
+	}
+	return nil
+}
+
+// ParseMilliseconds accepts a Go duration ("750ms", "2s") or a bare number of
+// milliseconds. Zero clears the override.
+func ParseMilliseconds(value string) (int, error) {
+	if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+		return ms, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid duration: %s", value)
+	}
+	return int(duration / time.Millisecond), nil
+}
+
+// Helper function to find the index of a DNSServer by address or server URL.
 func findDNSServerIndex(dnsServers []DNSServer, address string) int {
+	if strings.Contains(address, "://") {
+		target, err := ParseServerURL(address)
+		if err != nil {
+			return -1
+		}
+		for i, server := range dnsServers {
+			if server.Endpoint() == target.Endpoint() {
+				return i
+			}
+		}
+		return -1
+	}
 	for i, server := range dnsServers {
 		if server.Address == address {
 			return i
@@ -206,15 +572,18 @@ func findDNSServerIndex(dnsServers []DNSServer, address string) int {
 // Helper function to handle the help command.
 func usageAdd() []Message {
 	msgs := []Message{
-		{Level: LevelInfo, Text: "Usage  : add <Address> [Port] [Active] [LocalResolver] [AdBlocker]"},
+		{Level: LevelInfo, Text: "Usage  : add <Address|URL> [Port] [Active] [LocalResolver] [AdBlocker] [timeout=<duration>] [retries=<n>] [protocol=<udp|tcp|tls|quic>] [server_name=<name>]"},
 		{Level: LevelInfo, Text: "Example: add 1.1.1.1 53 true false false"},
+		{Level: LevelInfo, Text: "Example: add 10.8.0.1 53 timeout=500ms retries=1"},
+		{Level: LevelInfo, Text: "Example: add tls://1.1.1.1@cloudflare-dns.com"},
+		{Level: LevelInfo, Text: "Example: add https://dns.example/dns-query"},
 	}
 	return append(msgs, helpHint())
 }
 
 func usageRemove() []Message {
 	msgs := []Message{
-		{Level: LevelInfo, Text: "Usage  : remove <Address>"},
+		{Level: LevelInfo, Text: "Usage  : remove <Address|URL>"},
 		{Level: LevelInfo, Text: "Example: remove 127.0.0.1"},
 	}
 	return append(msgs, helpHint())
@@ -222,8 +591,25 @@ func usageRemove() []Message {
 
 func usageUpdate() []Message {
 	msgs := []Message{
-		{Level: LevelInfo, Text: "Usage  : update <Address> [Port] [Active] [LocalResolver] [AdBlocker]"},
+		{Level: LevelInfo, Text: "Usage  : update <Address|URL> [Port] [Active] [LocalResolver] [AdBlocker] [timeout=<duration>] [retries=<n>] [protocol=<udp|tcp|tls|quic>] [server_name=<name>]"},
 		{Level: LevelInfo, Text: "Example: update 1.1.1.1 53 false true true"},
+		{Level: LevelInfo, Text: "Example: update 10.8.0.1 timeout=750ms retries=2"},
+	}
+	return append(msgs, helpHint())
+}
+
+func usageRouteAdd() []Message {
+	msgs := []Message{
+		{Level: LevelInfo, Text: "Usage  : route add <Address> <Domain>"},
+		{Level: LevelInfo, Text: "Example: route add 10.8.0.1 corp.example.com"},
+	}
+	return append(msgs, helpHint())
+}
+
+func usageRouteRemove() []Message {
+	msgs := []Message{
+		{Level: LevelInfo, Text: "Usage  : route remove <Address> <Domain>"},
+		{Level: LevelInfo, Text: "Example: route remove 10.8.0.1 corp.example.com"},
 	}
 	return append(msgs, helpHint())
 }
@@ -0,0 +1,57 @@
+package dnsservers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestServersForQuery(t *testing.T) {
+	servers := []DNSServer{
+		{Address: "192.0.2.1", Active: true},
+		{Address: "192.0.2.2", Active: true},
+		{Address: "192.0.2.10", Active: true, Domains: []string{"com", "Example.COM."}},
+		{Address: "192.0.2.11", Active: true, Domains: []string{"example.com"}},
+		{Address: "192.0.2.12", Active: true, Domains: []string{"corp.example.com"}},
+		{Address: "192.0.2.13", Active: false, Domains: []string{"lab.example.com"}},
+		{Address: "192.0.2.14", Active: true, Domains: []string{"internal"}},
+		{Address: "192.0.2.15", Active: false},
+	}
+	tests := []struct {
+		name       string
+		query      string
+		want       []string
+		wantRouted bool
+	}{
+		{name: "unrouted name uses the general pool", query: "www.example.org.", want: []string{"192.0.2.1", "192.0.2.2"}},
+		{name: "single suffix", query: "shop.com.", want: []string{"192.0.2.10"}, wantRouted: true},
+		{name: "servers tie on their longest suffix", query: "www.example.com.", want: []string{"192.0.2.10", "192.0.2.11"}, wantRouted: true},
+		{name: "exact match of the suffix", query: "example.com.", want: []string{"192.0.2.10", "192.0.2.11"}, wantRouted: true},
+		{name: "longest suffix wins", query: "host.corp.example.com.", want: []string{"192.0.2.12"}, wantRouted: true},
+		{name: "inactive server is skipped", query: "host.lab.example.com.", want: []string{"192.0.2.10", "192.0.2.11"}, wantRouted: true},
+		{name: "suffix matches whole labels only", query: "notinternal.", want: []string{"192.0.2.1", "192.0.2.2"}},
+		{name: "matching ignores case", query: "HOST.Internal.", want: []string{"192.0.2.14"}, wantRouted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, routed := ServersForQuery(servers, tt.query)
+			var addresses []string
+			for _, server := range got {
+				addresses = append(addresses, server.Address)
+			}
+			if !reflect.DeepEqual(addresses, tt.want) || routed != tt.wantRouted {
+				t.Errorf("ServersForQuery(%q) = %v, %t, want %v, %t", tt.query, addresses, routed, tt.want, tt.wantRouted)
+			}
+		})
+	}
+}
+
+func TestServersForQueryRootRoute(t *testing.T) {
+	servers := []DNSServer{
+		{Address: "192.0.2.1", Active: true},
+		{Address: "192.0.2.20", Active: true, Domains: []string{"."}},
+	}
+	got, routed := ServersForQuery(servers, "anything.test.")
+	if !routed || len(got) != 1 || got[0].Address != "192.0.2.20" {
+		t.Errorf("ServersForQuery = %+v, %t, want the root route", got, routed)
+	}
+}
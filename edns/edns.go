@@ -0,0 +1,179 @@
+// Package edns implements the EDNS0 (RFC 6891) handling shared by every
+// listener: negotiating the UDP payload size, carrying the DO bit and
+// deciding what happens to EDNS Client Subnet (RFC 7871) options.
+package edns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultUDPSize is the payload size advertised when none is configured. It is
+// the value recommended by DNS Flag Day 2020 to avoid IP fragmentation.
+const DefaultUDPSize = 1232
+
+// Version is the highest EDNS version understood.
+const Version = 0
+
+// Options controls how EDNS0 is negotiated.
+type Options struct {
+	// UDPSize is advertised to clients and upstreams and caps UDP replies.
+	UDPSize uint16
+	// ForwardSubnet passes EDNS Client Subnet options to the upstreams.
+	ForwardSubnet bool
+}
+
+// Client holds the EDNS0 parameters of a client request.
+type Client struct {
+	// Present reports whether the request carried an OPT record.
+	Present bool
+	Version uint8
+	UDPSize uint16
+	// DO is the DNSSEC OK bit (RFC 3225).
+	DO     bool
+	Subnet *dns.EDNS0_SUBNET
+}
+
+// Parse extracts the EDNS0 parameters from request.
+func Parse(request *dns.Msg) Client {
+	opt := request.IsEdns0()
+	if opt == nil {
+		return Client{}
+	}
+	client := Client{
+		Present: true,
+		Version: opt.Version(),
+		UDPSize: opt.UDPSize(),
+		DO:      opt.Do(),
+	}
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			client.Subnet = subnet
+			break
+		}
+	}
+	return client
+}
+
+// Supported reports whether the client used an EDNS version we implement.
+// Requests with a higher version must be answered with BADVERS.
+func (c Client) Supported() bool {
+	return !c.Present || c.Version <= Version
+}
+
+// ResponseSize returns the largest UDP reply that may be sent to the client:
+// 512 bytes without EDNS0, otherwise the smaller of the client's and our
+// advertised payload size.
+func (c Client) ResponseSize(options Options) int {
+	if !c.Present {
+		return dns.MinMsgSize
+	}
+	size := int(c.UDPSize)
+	if limit := int(normalizeSize(options.UDPSize)); size > limit {
+		size = limit
+	}
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	return size
+}
+
+// PrepareQuery replaces any OPT record in query with our own, advertising
+// options.UDPSize, carrying the client's DO bit and, when allowed, its client
+// subnet. Other options such as cookies are hop-by-hop and are not forwarded.
+func PrepareQuery(query *dns.Msg, client Client, options Options) {
+	removeOPT(query)
+	opt := newOPT(options.UDPSize, client.DO)
+	if options.ForwardSubnet && client.Subnet != nil {
+		opt.Option = append(opt.Option, copySubnet(client.Subnet))
+	}
+	query.Extra = append(query.Extra, opt)
+}
+
+// FinishResponse replaces any OPT record in response, which may have been
+// relayed from an upstream, with the one sent to the client. Clients that did
+// not use EDNS0 get no OPT record. A client subnet in the request is answered
+// with the upstream's scope when subnets are forwarded, and with scope zero
+// otherwise so the client knows the answer was not tailored to it.
+func FinishResponse(response *dns.Msg, client Client, options Options) {
+	upstreamOPT := response.IsEdns0()
+	removeOPT(response)
+	if !client.Present {
+		if response.Rcode > 0xF {
+			// Extended rcodes cannot be expressed without an OPT record.
+			response.Rcode = dns.RcodeServerFailure
+		}
+		return
+	}
+
+	opt := newOPT(options.UDPSize, client.DO)
+	if client.Subnet != nil {
+		var subnet *dns.EDNS0_SUBNET
+		if options.ForwardSubnet && upstreamOPT != nil {
+			for _, option := range upstreamOPT.Option {
+				if candidate, ok := option.(*dns.EDNS0_SUBNET); ok {
+					subnet = copySubnet(candidate)
+					break
+				}
+			}
+		}
+		if subnet == nil {
+			subnet = copySubnet(client.Subnet)
+			subnet.SourceScope = 0
+		}
+		opt.Option = append(opt.Option, subnet)
+	}
+	response.Extra = append(response.Extra, opt)
+}
+
+// BadVersion turns response into the BADVERS reply for a client that used an
+// unsupported EDNS version. The reply advertises the version we implement.
+func BadVersion(response *dns.Msg, options Options) {
+	response.Answer = nil
+	response.Ns = nil
+	response.Extra = []dns.RR{newOPT(options.UDPSize, false)}
+	response.Rcode = dns.RcodeBadVers
+}
+
+// StripOPT removes the OPT record from message, for upstreams that reject
+// EDNS0 with FORMERR.
+func StripOPT(message *dns.Msg) *dns.Msg {
+	stripped := message.Copy()
+	removeOPT(stripped)
+	return stripped
+}
+
+func newOPT(size uint16, do bool) *dns.OPT {
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(normalizeSize(size))
+	opt.SetVersion(Version)
+	if do {
+		opt.SetDo()
+	}
+	return opt
+}
+
+func normalizeSize(size uint16) uint16 {
+	if size < dns.MinMsgSize {
+		return DefaultUDPSize
+	}
+	return size
+}
+
+func copySubnet(subnet *dns.EDNS0_SUBNET) *dns.EDNS0_SUBNET {
+	copied := *subnet
+	copied.Address = append(net.IP(nil), subnet.Address...)
+	return &copied
+}
+
+func removeOPT(message *dns.Msg) {
+	extra := make([]dns.RR, 0, len(message.Extra))
+	for _, rr := range message.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	message.Extra = extra
+}
@@ -0,0 +1,185 @@
+package edns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func request(size uint16, do bool, options ...dns.EDNS0) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.test.", dns.TypeA)
+	if size > 0 {
+		m.SetEdns0(size, do)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, options...)
+	}
+	return m
+}
+
+func subnet(address string, source, scope uint8) *dns.EDNS0_SUBNET {
+	return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: source, SourceScope: scope, Address: net.ParseIP(address).To4()}
+}
+
+func subnetOf(t *testing.T, m *dns.Msg) *dns.EDNS0_SUBNET {
+	t.Helper()
+	opt := m.IsEdns0()
+	if opt == nil {
+		t.Fatal("no OPT record")
+	}
+	for _, option := range opt.Option {
+		if s, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestResponseSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		request *dns.Msg
+		limit   uint16
+		want    int
+	}{
+		{name: "no OPT", request: request(0, false), limit: 4096, want: dns.MinMsgSize},
+		{name: "below 512", request: request(256, false), limit: 4096, want: dns.MinMsgSize},
+		{name: "within the limit", request: request(1400, false), limit: 4096, want: 1400},
+		{name: "above the limit", request: request(4096, false), limit: 1232, want: 1232},
+		{name: "unset limit uses the default", request: request(4096, false), want: DefaultUDPSize},
+		{name: "limit below 512 uses the default", request: request(4096, false), limit: 100, want: DefaultUDPSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Parse(tt.request).ResponseSize(Options{UDPSize: tt.limit}); got != tt.want {
+				t.Errorf("ResponseSize = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareQuery(t *testing.T) {
+	cookie := &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"}
+	client := Parse(request(4096, true, cookie, subnet("192.0.2.0", 24, 0)))
+
+	for _, forward := range []bool{false, true} {
+		query := request(4096, true, cookie, subnet("192.0.2.0", 24, 0))
+		PrepareQuery(query, client, Options{UDPSize: 1232, ForwardSubnet: forward})
+
+		opts := 0
+		for _, rr := range query.Extra {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				opts++
+			}
+		}
+		opt := query.IsEdns0()
+		if opts != 1 || opt.UDPSize() != 1232 || !opt.Do() || opt.Version() != Version {
+			t.Fatalf("forward=%t: OPT = %v, want one OPT with size 1232 and DO", forward, opt)
+		}
+		for _, option := range opt.Option {
+			if option.Option() == dns.EDNS0COOKIE {
+				t.Errorf("forward=%t: cookie forwarded", forward)
+			}
+		}
+		s := subnetOf(t, query)
+		if forward != (s != nil) {
+			t.Fatalf("forward=%t: subnet = %v", forward, s)
+		}
+		if s != nil && (s.SourceNetmask != 24 || !s.Address.Equal(net.ParseIP("192.0.2.0"))) {
+			t.Errorf("forwarded subnet = %v, want 192.0.2.0/24", s)
+		}
+	}
+
+	// Without ECS in the request nothing is added.
+	query := request(0, false)
+	PrepareQuery(query, Parse(query), Options{ForwardSubnet: true})
+	if opt := query.IsEdns0(); opt == nil || opt.Do() || len(opt.Option) != 0 {
+		t.Errorf("OPT = %v, want a bare OPT without DO", opt)
+	}
+}
+
+func TestFinishResponseSubnetScope(t *testing.T) {
+	client := Parse(request(4096, false, subnet("192.0.2.0", 24, 0)))
+	tests := []struct {
+		name    string
+		forward bool
+		// upstream is the scope the upstream answered with, -1 for no ECS.
+		upstream int
+		want     uint8
+	}{
+		{name: "stripped", forward: false, upstream: 16, want: 0},
+		{name: "forwarded", forward: true, upstream: 16, want: 16},
+		{name: "forwarded, upstream without ECS", forward: true, upstream: -1, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := request(1232, false)
+			if tt.upstream >= 0 {
+				response = request(1232, false, subnet("192.0.2.0", 24, uint8(tt.upstream)))
+			}
+			FinishResponse(response, client, Options{UDPSize: 1232, ForwardSubnet: tt.forward})
+			s := subnetOf(t, response)
+			if s == nil {
+				t.Fatal("no subnet in the response")
+			}
+			if s.SourceScope != tt.want || s.SourceNetmask != 24 || !s.Address.Equal(net.ParseIP("192.0.2.0")) {
+				t.Errorf("subnet = %v, want 192.0.2.0/24 scope %d", s, tt.want)
+			}
+		})
+	}
+}
+
+func TestFinishResponseWithoutClientEDNS(t *testing.T) {
+	client := Parse(request(0, false))
+	for _, rcode := range []int{dns.RcodeSuccess, dns.RcodeNameError, dns.RcodeBadCookie} {
+		response := request(1232, true)
+		response.Rcode = rcode
+		FinishResponse(response, client, Options{UDPSize: 1232})
+		if response.IsEdns0() != nil {
+			t.Errorf("rcode %s: OPT record sent to a client without EDNS", dns.RcodeToString[rcode])
+		}
+		want := rcode
+		if rcode > 0xF {
+			want = dns.RcodeServerFailure
+		}
+		if response.Rcode != want {
+			t.Errorf("rcode %s became %s, want %s", dns.RcodeToString[rcode], dns.RcodeToString[response.Rcode], dns.RcodeToString[want])
+		}
+	}
+}
+
+func TestBadVersion(t *testing.T) {
+	query := request(4096, true)
+	query.IsEdns0().SetVersion(1)
+	client := Parse(query)
+	if client.Supported() {
+		t.Fatal("EDNS version 1 reported as supported")
+	}
+
+	response := new(dns.Msg)
+	response.SetReply(query)
+	rr, _ := dns.NewRR("example.test. 60 IN A 192.0.2.1")
+	response.Answer = []dns.RR{rr}
+	BadVersion(response, Options{UDPSize: 1232})
+
+	if len(response.Answer) != 0 || len(response.Ns) != 0 || len(response.Extra) != 1 {
+		t.Fatalf("sections = %d/%d/%d, want only the OPT record", len(response.Answer), len(response.Ns), len(response.Extra))
+	}
+	opt := response.IsEdns0()
+	if opt == nil || opt.Version() != Version || opt.UDPSize() != 1232 || opt.Do() {
+		t.Errorf("OPT = %v, want version %d, size 1232 and no DO", opt, Version)
+	}
+	// BADVERS is an extended rcode, carried partly in the OPT record.
+	packed, err := response.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacked := new(dns.Msg)
+	if err := unpacked.Unpack(packed); err != nil {
+		t.Fatal(err)
+	}
+	if unpacked.Rcode != dns.RcodeBadVers {
+		t.Errorf("rcode on the wire = %s, want BADVERS", dns.RcodeToString[unpacked.Rcode])
+	}
+}
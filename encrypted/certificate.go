@@ -0,0 +1,79 @@
+// Package encrypted runs the encrypted DNS listeners (DNS-over-TLS,
+// DNS-over-HTTPS and DNS-over-QUIC) that share the resolver's query handler.
+package encrypted
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrNoCertificate is returned when an encrypted listener is started without a
+// configured certificate and key.
+var ErrNoCertificate = errors.New("tls certificate and key are not configured")
+
+// Certificate holds a TLS key pair that can be swapped at runtime, so that
+// renewed certificates are picked up without restarting the listeners.
+type Certificate struct {
+	mu       sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+}
+
+// LoadCertificate reads the key pair from certFile and keyFile.
+func LoadCertificate(certFile, keyFile string) (*Certificate, error) {
+	c := &Certificate{}
+	if err := c.Load(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Load replaces the key pair with the one read from certFile and keyFile. The
+// previous pair stays in use when loading fails.
+func (c *Certificate) Load(certFile, keyFile string) error {
+	if certFile == "" || keyFile == "" {
+		return ErrNoCertificate
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("load tls certificate: %w", err)
+	}
+	c.mu.Lock()
+	c.certFile = certFile
+	c.keyFile = keyFile
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+// Reload reads the key pair again from the paths it was last loaded from.
+func (c *Certificate) Reload() error {
+	c.mu.RLock()
+	certFile, keyFile := c.certFile, c.keyFile
+	c.mu.RUnlock()
+	return c.Load(certFile, keyFile)
+}
+
+// Paths returns the files the key pair was loaded from.
+func (c *Certificate) Paths() (certFile, keyFile string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.certFile, c.keyFile
+}
+
+// TLSConfig returns a server configuration that always presents the current
+// key pair and advertises nextProtos via ALPN.
+func (c *Certificate) TLSConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			return c.cert, nil
+		},
+	}
+}
@@ -0,0 +1,130 @@
+package encrypted
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and
+// its key to dir and returns the certificate, for clients to trust.
+func writeTestCertificate(t *testing.T, dir, commonName string) (*x509.Certificate, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certFile, keyFile
+}
+
+// newTestCertificate loads a fresh self-signed certificate and returns it
+// together with a client configuration that trusts it.
+func newTestCertificate(t *testing.T, nextProtos ...string) (*Certificate, *tls.Config) {
+	t.Helper()
+	x509Cert, certFile, keyFile := writeTestCertificate(t, t.TempDir(), "dnsplane test")
+	cert, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(x509Cert)
+	return cert, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1", NextProtos: nextProtos}
+}
+
+// testResolve answers every name with 192.0.2.1 and drops queries for names
+// starting with "drop.".
+func testResolve(request *dns.Msg, client net.Addr) *dns.Msg {
+	if dns.SplitDomainName(request.Question[0].Name)[0] == "drop" {
+		return nil
+	}
+	response := new(dns.Msg)
+	response.SetReply(request)
+	rr, _ := dns.NewRR(request.Question[0].Name + " 60 IN A 192.0.2.1")
+	response.Answer = append(response.Answer, rr)
+	return response
+}
+
+func checkTestAnswer(t *testing.T, response *dns.Msg, name string) {
+	t.Helper()
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 {
+		t.Fatalf("unexpected response %v", response)
+	}
+	a, ok := response.Answer[0].(*dns.A)
+	if !ok || a.Hdr.Name != name || a.A.String() != "192.0.2.1" {
+		t.Fatalf("answer = %v, want %s A 192.0.2.1", response.Answer[0], name)
+	}
+}
+
+func TestCertificateLoadRequiresFiles(t *testing.T) {
+	if _, err := LoadCertificate("", ""); err != ErrNoCertificate {
+		t.Errorf("err = %v, want %v", err, ErrNoCertificate)
+	}
+	if _, err := LoadCertificate(filepath.Join(t.TempDir(), "missing.pem"), "missing.key"); err == nil {
+		t.Error("loading missing files succeeded")
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	_, certFile, keyFile := writeTestCertificate(t, dir, "first")
+	cert, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCertificate(t, dir, "second")
+	if err := cert.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	served, err := cert.TLSConfig().GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(served.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "second" {
+		t.Errorf("serving %q after reload, want %q", leaf.Subject.CommonName, "second")
+	}
+}
@@ -0,0 +1,210 @@
+package encrypted
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DoHPath is the well-known DNS-over-HTTPS endpoint (RFC 8484).
+const DoHPath = "/dns-query"
+
+// dohContentType is the media type of wire-format DNS messages.
+const dohContentType = "application/dns-message"
+
+// ResolveFunc answers a DNS request from client with a complete response
+// message, or nil when the request is to be dropped without an answer. client
+// is nil when the address of the client is not known.
+type ResolveFunc func(request *dns.Msg, client net.Addr) *dns.Msg
+
+// NewDoHHandler returns an http.Handler implementing RFC 8484 on top of
+// resolve. It accepts GET with a base64url "dns" parameter and POST with an
+// application/dns-message body.
+func NewDoHHandler(resolve ResolveFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			wire []byte
+			err  error
+		)
+		switch r.Method {
+		case http.MethodGet:
+			param := r.URL.Query().Get("dns")
+			if param == "" {
+				http.Error(w, "missing dns parameter", http.StatusBadRequest)
+				return
+			}
+			wire, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+		case http.MethodPost:
+			if mediaType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0]); mediaType != dohContentType {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			wire, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
+			if err == nil && len(wire) > dns.MaxMsgSize {
+				http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			http.Error(w, "invalid dns message", http.StatusBadRequest)
+			return
+		}
+
+		request := new(dns.Msg)
+		if err := request.Unpack(wire); err != nil || len(request.Question) == 0 {
+			http.Error(w, "invalid dns message", http.StatusBadRequest)
+			return
+		}
+
+		response := resolve(request, remoteAddr(r))
+		if response == nil {
+			dropHTTP(w)
+			return
+		}
+		packed, err := response.Pack()
+		if err != nil {
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(response)))
+		_, _ = w.Write(packed)
+	})
+}
+
+// remoteAddr returns the address of the client that sent r.
+func remoteAddr(r *http.Request) net.Addr {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(addrPort)
+}
+
+// dropHTTP closes the connection without a response, the closest HTTP has to
+// a dropped query. HTTP/2 streams cannot be hijacked and are reset instead.
+func dropHTTP(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	_ = conn.Close()
+}
+
+// minTTL returns the smallest TTL in the response, which bounds how long an
+// HTTP cache may keep it. Responses without records are not cacheable.
+func minTTL(msg *dns.Msg) uint32 {
+	var (
+		ttl   uint32
+		found bool
+	)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+	return ttl
+}
+
+// DoHServer serves DNS over HTTPS on its own TLS listener.
+type DoHServer struct {
+	handler http.Handler
+
+	mu      sync.Mutex
+	server  *http.Server
+	addr    string
+	running bool
+}
+
+// NewDoH builds a DNS-over-HTTPS server answering queries with resolve.
+func NewDoH(resolve ResolveFunc) *DoHServer {
+	mux := http.NewServeMux()
+	mux.Handle(DoHPath, NewDoHHandler(resolve))
+	return &DoHServer{handler: mux}
+}
+
+// Start binds addr and serves DoH with cert until Stop is called.
+func (s *DoHServer) Start(addr string, cert *Certificate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return ErrAlreadyRunning
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("doh listener: %w", err)
+	}
+	server := &http.Server{
+		Handler:           s.handler,
+		TLSConfig:         cert.TLSConfig(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.server = server
+	s.addr = listener.Addr().String()
+	s.running = true
+
+	go func() {
+		if err := server.ServeTLS(listener, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("DoH listener on %s stopped: %v", addr, err)
+		}
+		s.mu.Lock()
+		if s.server == server {
+			s.running = false
+			s.server = nil
+		}
+		s.mu.Unlock()
+	}()
+	return nil
+}
+
+// Stop shuts the listener down, giving in-flight requests a few seconds to
+// complete.
+func (s *DoHServer) Stop() error {
+	s.mu.Lock()
+	server := s.server
+	s.server = nil
+	s.running = false
+	s.mu.Unlock()
+	if server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
+
+// Running reports whether the listener is serving.
+func (s *DoHServer) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+// Addr returns the address the listener was last bound to.
+func (s *DoHServer) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
@@ -0,0 +1,125 @@
+package encrypted
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func startTestDoH(t *testing.T) (string, *http.Client) {
+	t.Helper()
+	cert, clientConfig := newTestCertificate(t)
+	server := NewDoH(testResolve)
+	if err := server.Start("127.0.0.1:0", cert); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Stop() })
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: clientConfig, ForceAttemptHTTP2: true},
+	}
+	t.Cleanup(client.CloseIdleConnections)
+	return "https://" + server.Addr() + DoHPath, client
+}
+
+func packQuery(t *testing.T, name string) []byte {
+	t.Helper()
+	query := new(dns.Msg)
+	query.SetQuestion(name, dns.TypeA)
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+func readDoHResponse(t *testing.T, resp *http.Response) *dns.Msg {
+	t.Helper()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %s, want 200", resp.Status)
+	}
+	if got := resp.Header.Get("Content-Type"); got != dohContentType {
+		t.Errorf("Content-Type = %q, want %q", got, dohContentType)
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "max-age=60" {
+		t.Errorf("Cache-Control = %q, want max-age=60", got)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := new(dns.Msg)
+	if err := response.Unpack(body); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestDoHGet(t *testing.T) {
+	url, client := startTestDoH(t)
+	resp, err := client.Get(url + "?dns=" + base64.RawURLEncoding.EncodeToString(packQuery(t, "get.example.test.")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestAnswer(t, readDoHResponse(t, resp), "get.example.test.")
+}
+
+func TestDoHPost(t *testing.T) {
+	url, client := startTestDoH(t)
+	resp, err := client.Post(url, dohContentType, bytes.NewReader(packQuery(t, "post.example.test.")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestAnswer(t, readDoHResponse(t, resp), "post.example.test.")
+}
+
+func TestDoHDroppedQuery(t *testing.T) {
+	url, client := startTestDoH(t)
+	resp, err := client.Post(url, dohContentType, bytes.NewReader(packQuery(t, "drop.example.test.")))
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("dropped query got %s", resp.Status)
+	}
+}
+
+func TestDoHRejectsInvalidRequests(t *testing.T) {
+	handler := NewDoHHandler(testResolve)
+	query := packQuery(t, "example.test.")
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        []byte
+		want        int
+	}{
+		{name: "GET without dns parameter", method: http.MethodGet, target: DoHPath, want: http.StatusBadRequest},
+		{name: "GET with bad base64", method: http.MethodGet, target: DoHPath + "?dns=!!!", want: http.StatusBadRequest},
+		{name: "GET with padded base64", method: http.MethodGet, target: DoHPath + "?dns=" + base64.URLEncoding.EncodeToString(query), want: http.StatusOK},
+		{name: "POST with wrong content type", method: http.MethodPost, target: DoHPath, contentType: "text/plain", body: query, want: http.StatusUnsupportedMediaType},
+		{name: "POST with garbage", method: http.MethodPost, target: DoHPath, contentType: dohContentType, body: []byte{1, 2, 3}, want: http.StatusBadRequest},
+		{name: "POST too large", method: http.MethodPost, target: DoHPath, contentType: dohContentType, body: make([]byte, dns.MaxMsgSize+1), want: http.StatusRequestEntityTooLarge},
+		{name: "PUT", method: http.MethodPut, target: DoHPath, want: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, bytes.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package encrypted
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// DoQ application error codes (RFC 9250, section 4.3).
+const (
+	doqNoError       quic.ApplicationErrorCode = 0x0
+	doqInternalError quic.ApplicationErrorCode = 0x1
+	doqProtocolError quic.ApplicationErrorCode = 0x2
+)
+
+// DefaultDoQIdleTimeout closes DoQ connections that have been idle this long.
+const DefaultDoQIdleTimeout = 30 * time.Second
+
+// doqStreamTimeout bounds reading a query from and writing the reply to a
+// single stream.
+const doqStreamTimeout = 10 * time.Second
+
+// DoQServer serves DNS over QUIC (RFC 9250): one query per bidirectional
+// stream, each message prefixed with its two byte length.
+type DoQServer struct {
+	resolve ResolveFunc
+
+	mu       sync.Mutex
+	listener *quic.Listener
+	cancel   context.CancelFunc
+	addr     string
+	running  bool
+}
+
+// NewDoQ builds a DNS-over-QUIC server answering queries with resolve.
+func NewDoQ(resolve ResolveFunc) *DoQServer {
+	return &DoQServer{resolve: resolve}
+}
+
+// Start binds addr and serves DoQ with cert until Stop is called. Connections
+// without traffic for idleTimeout are closed.
+func (s *DoQServer) Start(addr string, cert *Certificate, idleTimeout time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return ErrAlreadyRunning
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultDoQIdleTimeout
+	}
+
+	listener, err := quic.ListenAddr(addr, cert.TLSConfig("doq"), &quic.Config{
+		MaxIdleTimeout: idleTimeout,
+	})
+	if err != nil {
+		return fmt.Errorf("doq listener: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.listener = listener
+	s.cancel = cancel
+	s.addr = listener.Addr().String()
+	s.running = true
+
+	go func() {
+		for {
+			conn, err := listener.Accept(ctx)
+			if err != nil {
+				if ctx.Err() == nil && !errors.Is(err, quic.ErrServerClosed) {
+					log.Printf("DoQ listener on %s stopped: %v", addr, err)
+				}
+				break
+			}
+			go s.serveConn(ctx, conn)
+		}
+		s.mu.Lock()
+		if s.listener == listener {
+			s.running = false
+			s.listener = nil
+		}
+		s.mu.Unlock()
+	}()
+	return nil
+}
+
+func (s *DoQServer) serveConn(ctx context.Context, conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			// Idle timeouts and client closes end up here.
+			return
+		}
+		go s.serveStream(conn, stream)
+	}
+}
+
+func (s *DoQServer) serveStream(conn *quic.Conn, stream *quic.Stream) {
+	defer stream.Close()
+	_ = stream.SetDeadline(time.Now().Add(doqStreamTimeout))
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		stream.CancelRead(quic.StreamErrorCode(doqProtocolError))
+		return
+	}
+	wire := make([]byte, length)
+	if _, err := io.ReadFull(stream, wire); err != nil {
+		stream.CancelRead(quic.StreamErrorCode(doqProtocolError))
+		return
+	}
+
+	request := new(dns.Msg)
+	if err := request.Unpack(wire); err != nil || len(request.Question) == 0 {
+		_ = conn.CloseWithError(doqProtocolError, "malformed query")
+		return
+	}
+	// RFC 9250 requires the message ID to be zero on DoQ.
+	if request.Id != 0 {
+		_ = conn.CloseWithError(doqProtocolError, "non-zero message id")
+		return
+	}
+
+	response := s.resolve(request, conn.RemoteAddr())
+	if response == nil {
+		stream.CancelWrite(quic.StreamErrorCode(doqNoError))
+		return
+	}
+	packed, err := response.Pack()
+	if err != nil {
+		_ = conn.CloseWithError(doqInternalError, "failed to encode response")
+		return
+	}
+	out := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(out, uint16(len(packed)))
+	copy(out[2:], packed)
+	_, _ = stream.Write(out)
+}
+
+// Stop closes the listener and every open connection.
+func (s *DoQServer) Stop() error {
+	s.mu.Lock()
+	listener, cancel := s.listener, s.cancel
+	s.listener = nil
+	s.cancel = nil
+	s.running = false
+	s.mu.Unlock()
+	if listener == nil {
+		return nil
+	}
+	cancel()
+	return listener.Close()
+}
+
+// Running reports whether the listener is serving.
+func (s *DoQServer) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+// Addr returns the address the listener was last bound to.
+func (s *DoQServer) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
@@ -0,0 +1,136 @@
+package encrypted
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+func startTestDoQ(t *testing.T) *quic.Conn {
+	t.Helper()
+	cert, clientConfig := newTestCertificate(t, "doq")
+	server := NewDoQ(testResolve)
+	if err := server.Start("127.0.0.1:0", cert, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Stop() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, server.Addr(), clientConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.CloseWithError(doqNoError, "") })
+	return conn
+}
+
+// exchangeDoQ sends query on a new stream of conn and reads the reply.
+func exchangeDoQ(conn *quic.Conn, query *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_ = stream.SetDeadline(time.Now().Add(5 * time.Second))
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(out, uint16(len(packed)))
+	copy(out[2:], packed)
+	if _, err := stream.Write(out); err != nil {
+		return nil, err
+	}
+	_ = stream.Close()
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	wire := make([]byte, length)
+	if _, err := io.ReadFull(stream, wire); err != nil {
+		return nil, err
+	}
+	response := new(dns.Msg)
+	return response, response.Unpack(wire)
+}
+
+func TestDoQExchange(t *testing.T) {
+	conn := startTestDoQ(t)
+	// Several queries share the connection, one stream each.
+	for _, name := range []string{"one.example.test.", "two.example.test."} {
+		query := new(dns.Msg)
+		query.SetQuestion(name, dns.TypeA)
+		query.Id = 0
+		response, err := exchangeDoQ(conn, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Id != 0 {
+			t.Errorf("response id = %d, want 0", response.Id)
+		}
+		checkTestAnswer(t, response, name)
+	}
+}
+
+func TestDoQDroppedQueryResetsStream(t *testing.T) {
+	conn := startTestDoQ(t)
+	query := new(dns.Msg)
+	query.SetQuestion("drop.example.test.", dns.TypeA)
+	query.Id = 0
+	_, err := exchangeDoQ(conn, query)
+	var streamErr *quic.StreamError
+	if !errors.As(err, &streamErr) || streamErr.ErrorCode != quic.StreamErrorCode(doqNoError) {
+		t.Fatalf("err = %v, want a stream reset with DOQ_NO_ERROR", err)
+	}
+
+	// The connection stays usable.
+	query.SetQuestion("kept.example.test.", dns.TypeA)
+	query.Id = 0
+	response, err := exchangeDoQ(conn, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestAnswer(t, response, "kept.example.test.")
+}
+
+func TestDoQNonZeroIDClosesConnection(t *testing.T) {
+	conn := startTestDoQ(t)
+	query := new(dns.Msg)
+	query.SetQuestion("example.test.", dns.TypeA)
+	query.Id = 1234
+	_, err := exchangeDoQ(conn, query)
+	var appErr *quic.ApplicationError
+	if !errors.As(err, &appErr) || appErr.ErrorCode != doqProtocolError {
+		t.Fatalf("err = %v, want the connection closed with DOQ_PROTOCOL_ERROR", err)
+	}
+}
+
+func TestDoQStop(t *testing.T) {
+	cert, _ := newTestCertificate(t, "doq")
+	server := NewDoQ(testResolve)
+	if err := server.Start("127.0.0.1:0", cert, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start("127.0.0.1:0", cert, 0); !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("second Start() = %v, want %v", err, ErrAlreadyRunning)
+	}
+	if !server.Running() {
+		t.Error("not running after Start")
+	}
+	if err := server.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if server.Running() {
+		t.Error("still running after Stop")
+	}
+}
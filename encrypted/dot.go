@@ -0,0 +1,89 @@
+package encrypted
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// ErrAlreadyRunning is returned when starting a listener that is already up.
+var ErrAlreadyRunning = errors.New("listener already running")
+
+// DoTServer serves DNS over TLS (RFC 7858).
+type DoTServer struct {
+	handler dns.Handler
+
+	mu      sync.Mutex
+	server  *dns.Server
+	addr    string
+	running bool
+}
+
+// NewDoT builds a DNS-over-TLS server answering queries with handler.
+func NewDoT(handler dns.Handler) *DoTServer {
+	return &DoTServer{handler: handler}
+}
+
+// Start binds addr and serves DoT with cert until Stop is called. The bind
+// happens synchronously so that address errors are reported to the caller.
+func (s *DoTServer) Start(addr string, cert *Certificate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return ErrAlreadyRunning
+	}
+
+	listener, err := tls.Listen("tcp", addr, cert.TLSConfig("dot"))
+	if err != nil {
+		return fmt.Errorf("dot listener: %w", err)
+	}
+	server := &dns.Server{Listener: listener, Net: "tcp-tls", Handler: s.handler}
+	s.server = server
+	s.addr = listener.Addr().String()
+	s.running = true
+
+	go func() {
+		if err := server.ActivateAndServe(); err != nil {
+			log.Printf("DoT listener on %s stopped: %v", addr, err)
+		}
+		s.mu.Lock()
+		if s.server == server {
+			s.running = false
+			s.server = nil
+		}
+		s.mu.Unlock()
+	}()
+	return nil
+}
+
+// Stop shuts the listener down. Stopping a server that is not running is a
+// no-op.
+func (s *DoTServer) Stop() error {
+	s.mu.Lock()
+	server := s.server
+	s.server = nil
+	s.running = false
+	s.mu.Unlock()
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown()
+}
+
+// Running reports whether the listener is serving.
+func (s *DoTServer) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+// Addr returns the address the listener was last bound to.
+func (s *DoTServer) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
@@ -0,0 +1,55 @@
+package encrypted
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDoTExchange(t *testing.T) {
+	cert, clientConfig := newTestCertificate(t)
+	server := NewDoT(dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		_ = w.WriteMsg(testResolve(r, w.RemoteAddr()))
+	}))
+	if err := server.Start("127.0.0.1:0", cert); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Stop() })
+	if err := server.Start("127.0.0.1:0", cert); !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("second Start() = %v, want %v", err, ErrAlreadyRunning)
+	}
+
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: clientConfig, Timeout: 5 * time.Second}
+	query := new(dns.Msg)
+	query.SetQuestion("dot.example.test.", dns.TypeA)
+	response, _, err := client.Exchange(query, server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Id != query.Id {
+		t.Errorf("response id = %d, want %d", response.Id, query.Id)
+	}
+	checkTestAnswer(t, response, "dot.example.test.")
+}
+
+func TestDoTRejectsUntrustedClients(t *testing.T) {
+	cert, _ := newTestCertificate(t)
+	_, untrusted := newTestCertificate(t)
+	server := NewDoT(dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		_ = w.WriteMsg(testResolve(r, w.RemoteAddr()))
+	}))
+	if err := server.Start("127.0.0.1:0", cert); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Stop() })
+
+	// The client trusts a different certificate, so the handshake fails.
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: untrusted, Timeout: 5 * time.Second}
+	query := new(dns.Msg)
+	query.SetQuestion("dot.example.test.", dns.TypeA)
+	if _, _, err := client.Exchange(query, server.Addr()); err == nil {
+		t.Error("exchange with an untrusted certificate succeeded")
+	}
+}
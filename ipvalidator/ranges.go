@@ -0,0 +1,134 @@
+package ipvalidator
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Range is an inclusive range of IP addresses of one family
+type Range struct {
+	First netip.Addr
+	Last  netip.Addr
+}
+
+// ParseCIDR parses a CIDR block such as 192.0.2.0/24 or 2001:db8::/32. Host
+// bits are cleared, so 192.0.2.1/24 is read as 192.0.2.0/24. IPv4-mapped
+// blocks are read as the IPv4 block they map, so ::ffff:10.0.0.0/104 is
+// 10.0.0.0/8.
+func ParseCIDR(cidr string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR block %q", cidr)
+	}
+	if prefix.Addr().Zone() != "" {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR block %q: zones are not supported", cidr)
+	}
+	if prefix.Addr().Is4In6() {
+		// Client addresses are compared unmapped, so a mapped block would
+		// never match anyone.
+		if prefix.Bits() < 96 {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR block %q: IPv4-mapped blocks need a prefix length of at least 96", cidr)
+		}
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+// ParseRange parses a single address (192.0.2.1), a CIDR block
+// (192.0.2.0/24) or an inclusive range of addresses (192.0.2.10-192.0.2.20)
+func ParseRange(value string) (Range, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return Range{}, errors.New("empty address range")
+	}
+	if strings.Contains(value, "/") {
+		prefix, err := ParseCIDR(value)
+		if err != nil {
+			return Range{}, err
+		}
+		return Range{First: prefix.Addr(), Last: lastAddr(prefix)}, nil
+	}
+	first, last, isRange := strings.Cut(value, "-")
+	if !isRange {
+		last = first
+	}
+	from, err := parseAddr(first)
+	if err != nil {
+		return Range{}, err
+	}
+	to, err := parseAddr(last)
+	if err != nil {
+		return Range{}, err
+	}
+	if from.Is4() != to.Is4() {
+		return Range{}, fmt.Errorf("invalid address range %q: mixes IPv4 and IPv6", value)
+	}
+	if to.Less(from) {
+		return Range{}, fmt.Errorf("invalid address range %q: first address is above the last", value)
+	}
+	return Range{First: from, Last: to}, nil
+}
+
+// Contains reports whether addr lies within the range. IPv4 addresses mapped
+// into IPv6, as reported by dual-stack sockets, match IPv4 ranges.
+func (r Range) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	if !addr.IsValid() || addr.Is4() != r.First.Is4() {
+		return false
+	}
+	return r.First.Compare(addr) <= 0 && addr.Compare(r.Last) <= 0
+}
+
+// Ranges is a list of address ranges
+type Ranges []Range
+
+// ParseRanges parses every entry with ParseRange. Invalid entries are left
+// out and reported in the returned error.
+func ParseRanges(values []string) (Ranges, error) {
+	ranges := make(Ranges, 0, len(values))
+	var errs []error
+	for _, value := range values {
+		r, err := ParseRange(value)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, errors.Join(errs...)
+}
+
+// Contains reports whether any of the ranges contains addr
+func (rs Ranges) Contains(addr netip.Addr) bool {
+	for _, r := range rs {
+		if r.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseAddr(value string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(value))
+	if err != nil || addr.Zone() != "" {
+		return netip.Addr{}, fmt.Errorf("invalid IP address %q", strings.TrimSpace(value))
+	}
+	return addr.Unmap(), nil
+}
+
+// lastAddr returns the highest address of a masked prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().AsSlice()
+	for i := range bytes {
+		switch hostBits := (i+1)*8 - prefix.Bits(); {
+		case hostBits >= 8:
+			bytes[i] = 0xff
+		case hostBits > 0:
+			bytes[i] |= byte(1<<hostBits - 1)
+		}
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
@@ -0,0 +1,93 @@
+package ipvalidator
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		cidr    string
+		want    string
+		wantErr bool
+	}{
+		{cidr: "192.0.2.0/24", want: "192.0.2.0/24"},
+		{cidr: "192.0.2.77/24", want: "192.0.2.0/24"},
+		{cidr: " 2001:db8::1/32 ", want: "2001:db8::/32"},
+		{cidr: "::ffff:10.0.0.0/104", want: "10.0.0.0/8"},
+		{cidr: "::ffff:192.0.2.1/128", want: "192.0.2.1/32"},
+		{cidr: "::ffff:0.0.0.0/96", want: "0.0.0.0/0"},
+		{cidr: "::ffff:10.0.0.0/80", wantErr: true},
+		{cidr: "fe80::/10%eth0", wantErr: true},
+		{cidr: "192.0.2.0/33", wantErr: true},
+		{cidr: "192.0.2.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			prefix, err := ParseCIDR(tt.cidr)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseCIDR(%q) = %s, want an error", tt.cidr, prefix)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prefix.String() != tt.want {
+				t.Errorf("ParseCIDR(%q) = %s, want %s", tt.cidr, prefix, tt.want)
+			}
+		})
+	}
+}
+
+func TestRangeContains(t *testing.T) {
+	tests := []struct {
+		entry string
+		addr  string
+		want  bool
+	}{
+		{entry: "192.0.2.0/24", addr: "192.0.2.200", want: true},
+		{entry: "192.0.2.0/24", addr: "192.0.3.1", want: false},
+		{entry: "192.0.2.0/24", addr: "::ffff:192.0.2.1", want: true},
+		{entry: "::ffff:10.0.0.0/104", addr: "10.1.2.3", want: true},
+		{entry: "::ffff:10.0.0.0/104", addr: "::ffff:10.1.2.3", want: true},
+		{entry: "::ffff:10.0.0.0/104", addr: "11.0.0.1", want: false},
+		{entry: "::ffff:192.0.2.1", addr: "192.0.2.1", want: true},
+		{entry: "2001:db8::/32", addr: "2001:db8::53", want: true},
+		{entry: "2001:db8::/32", addr: "192.0.2.1", want: false},
+		{entry: "192.0.2.10-192.0.2.20", addr: "192.0.2.10", want: true},
+		{entry: "192.0.2.10-192.0.2.20", addr: "192.0.2.20", want: true},
+		{entry: "192.0.2.10-192.0.2.20", addr: "192.0.2.21", want: false},
+		{entry: "0.0.0.0/0", addr: "2001:db8::1", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry+" "+tt.addr, func(t *testing.T) {
+			r, err := ParseRange(tt.entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("Contains(%s) = %t, want %t", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRangeErrors(t *testing.T) {
+	for _, entry := range []string{"", "not-an-address", "192.0.2.20-192.0.2.10", "192.0.2.1-2001:db8::1", "192.0.2.1-"} {
+		if _, err := ParseRange(entry); err == nil {
+			t.Errorf("ParseRange(%q) succeeded", entry)
+		}
+	}
+}
+
+func TestParseRangesKeepsValidEntries(t *testing.T) {
+	ranges, err := ParseRanges([]string{"192.0.2.0/24", "bogus", "2001:db8::1"})
+	if err == nil {
+		t.Error("invalid entry not reported")
+	}
+	if len(ranges) != 2 {
+		t.Errorf("%d ranges, want 2", len(ranges))
+	}
+}
@@ -11,10 +11,13 @@ import (
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"dnsplane/acl"
 	"dnsplane/api"
+	"dnsplane/blocklist"
 	"dnsplane/commandhandler"
 	"dnsplane/config"
 	"dnsplane/converters"
@@ -23,6 +26,11 @@ import (
 	"dnsplane/dnsrecordcache"
 	"dnsplane/dnsrecords"
 	"dnsplane/dnsservers"
+	"dnsplane/edns"
+	"dnsplane/encrypted"
+	"dnsplane/policy"
+	"dnsplane/rpz"
+	"dnsplane/upstream"
 
 	"github.com/chzyer/readline"
 	"github.com/miekg/dns"
@@ -36,12 +44,26 @@ const (
 	defaultUnixSocketPath  = "/tmp/dnsplane.socket"
 	defaultTCPTerminalAddr = ":8053"
 	defaultClientTCPPort   = "8053"
+	// staleRefreshInterval is how often an upstream is retried for a name
+	// answered from stale cache; in between, the stale answer is returned
+	// without waiting for upstreams (RFC 8767 failure recheck timer).
+	staleRefreshInterval = 30 * time.Second
+	// refreshCheckInterval is how often blocklists subscribed to by URL and
+	// response policy zones with a primary are checked for having reached
+	// their refresh interval.
+	refreshCheckInterval = time.Minute
 )
 
 var (
-	appState   = daemon.NewState()
-	appversion = "0.1.17"
-	rootCmd    = &cobra.Command{
+	appState         = daemon.NewState()
+	upstreamResolver = upstream.NewResolver(queryAuthoritative)
+	upstreamHealth   = upstream.NewHealthChecker(probeUpstream)
+	inflightQueries  = upstream.NewCoalescer()
+	dotServer        = encrypted.NewDoT(dns.HandlerFunc(handleRequest))
+	dohServer        = encrypted.NewDoH(resolveRequest)
+	doqServer        = encrypted.NewDoQ(resolveRequest)
+	appversion       = "0.1.17"
+	rootCmd          = &cobra.Command{
 		Use:           "dnsplane",
 		Short:         "DNS Server with optional CLI mode",
 		SilenceUsage:  true,
@@ -201,12 +223,15 @@ func runRoot(cmd *cobra.Command, args []string) error {
 	dnsData.UpdateSettingsInMemory(settings)
 
 	commandhandler.RegisterCommands()
+	api.RegisterDNSQueryHandler(encrypted.NewDoHHandler(resolveRequest))
 	commandhandler.RegisterServerControlHooks(
 		func() { stopDNSServer(appState) },
 		func(p string) { restartDNSServer(appState, p) },
 		func() bool { return getServerStatus(appState) },
 		func(p string) { startAPIAsync(appState, p) },
 		func() commandhandler.ServerListenerInfo { return currentServerListeners(appState) },
+		startEncryptedListener,
+		stopEncryptedListener,
 	)
 	tui.SetPrompt("dnsplane> ")
 
@@ -244,6 +269,30 @@ func runRoot(cmd *cobra.Command, args []string) error {
 
 	monitorDNSErrors()
 
+	backgroundStop := make(chan struct{})
+	defer close(backgroundStop)
+	startHealthChecks(backgroundStop)
+	go dnsData.GetCache().RunJanitor(backgroundStop, time.Duration(settings.Cache.JanitorInterval)*time.Second)
+	go dnsData.RunCachePersistence(backgroundStop, time.Duration(settings.Cache.SaveInterval)*time.Second)
+	go dnsData.RunBlocklistRefresh(backgroundStop, refreshCheckInterval)
+	go dnsData.RunRPZRefresh(backgroundStop, refreshCheckInterval)
+
+	if settings.DoT.Enabled {
+		if err := startEncryptedListener("dot"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting DoT listener: %v\n", err)
+		}
+	}
+	if settings.DoH.Enabled {
+		if err := startEncryptedListener("doh"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting DoH listener: %v\n", err)
+		}
+	}
+	if settings.DoQ.Enabled {
+		if err := startEncryptedListener("doq"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting DoQ listener: %v\n", err)
+		}
+	}
+
 	appState.SetReadlineConfig(readline.Config{
 		Prompt:                 "> ",
 		HistoryFile:            "/tmp/dnsplane.history",
@@ -272,12 +321,23 @@ func runRoot(cmd *cobra.Command, args []string) error {
 		go acceptInteractiveSessions(listener)
 	}
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	defer signal.Stop(sigCh)
 	fmt.Println("Press Ctrl+C to exit daemon mode.")
-	<-sigCh
+	for sig := range sigCh {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		reloadTLSCertificate()
+	}
 	fmt.Println("Shutting down.")
 	stopDNSServer(appState)
+	_ = stopEncryptedListener("dot")
+	_ = stopEncryptedListener("doh")
+	_ = stopEncryptedListener("doq")
+	if err := dnsData.SaveCacheIfModified(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save cache records: %v\n", err)
+	}
 	if unixListener != nil {
 		_ = unixListener.Close()
 	}
@@ -305,9 +365,16 @@ func currentServerListeners(state *daemon.State) commandhandler.ServerListenerIn
 		apiEndpoint = normalizeTCPAddress(":" + strings.TrimSpace(settings.RESTPort))
 	}
 
+	dnsAddress := normalizeTCPAddress(":" + dnsPort)
+	dnsRunning := state.ServerStatus()
 	info := commandhandler.ServerListenerInfo{
-		DNSProtocol:         "udp",
-		DNSListeners:        []string{normalizeTCPAddress(":" + dnsPort)},
+		DNSListeners: []commandhandler.DNSListener{
+			{Protocol: "udp", Address: dnsAddress, Enabled: true, Running: dnsRunning},
+			{Protocol: "tcp", Address: dnsAddress, Enabled: true, Running: dnsRunning},
+			{Protocol: "dot", Address: normalizeTCPAddress(":" + settings.DoT.Port), Enabled: settings.DoT.Enabled || dotServer.Running(), Running: dotServer.Running()},
+			{Protocol: "doh", Address: normalizeTCPAddress(":" + settings.DoH.Port), Enabled: settings.DoH.Enabled || dohServer.Running(), Running: dohServer.Running()},
+			{Protocol: "doq", Address: normalizeTCPAddress(":" + settings.DoQ.Port), Enabled: settings.DoQ.Enabled || doqServer.Running(), Running: doqServer.Running()},
+		},
 		ClientSocket:        socket,
 		ClientSocketEnabled: socket != "",
 		ClientTCPEndpoint:   tcp,
@@ -319,6 +386,150 @@ func currentServerListeners(state *daemon.State) commandhandler.ServerListenerIn
 	return info
 }
 
+var (
+	tlsCertMu sync.Mutex
+	tlsCert   *encrypted.Certificate
+)
+
+// listenerCertificate returns the certificate shared by the encrypted
+// listeners, loading it on first use or when the configured paths change.
+func listenerCertificate() (*encrypted.Certificate, error) {
+	settings := data.GetInstance().GetResolverSettings()
+	tlsCertMu.Lock()
+	defer tlsCertMu.Unlock()
+	if tlsCert != nil {
+		certFile, keyFile := tlsCert.Paths()
+		if certFile == settings.TLS.CertFile && keyFile == settings.TLS.KeyFile {
+			return tlsCert, nil
+		}
+		if err := tlsCert.Load(settings.TLS.CertFile, settings.TLS.KeyFile); err != nil {
+			return nil, err
+		}
+		return tlsCert, nil
+	}
+	cert, err := encrypted.LoadCertificate(settings.TLS.CertFile, settings.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsCert = cert
+	return tlsCert, nil
+}
+
+// reloadTLSCertificate re-reads the listener certificate, typically on SIGHUP
+// after it has been renewed.
+func reloadTLSCertificate() {
+	tlsCertMu.Lock()
+	cert := tlsCert
+	tlsCertMu.Unlock()
+	if cert == nil {
+		return
+	}
+	settings := data.GetInstance().GetResolverSettings()
+	if err := cert.Load(settings.TLS.CertFile, settings.TLS.KeyFile); err != nil {
+		log.Printf("Failed to reload TLS certificate: %v", err)
+		return
+	}
+	log.Printf("Reloaded TLS certificate from %s", settings.TLS.CertFile)
+}
+
+// startEncryptedListener starts the named encrypted listener on its
+// configured port.
+func startEncryptedListener(name string) error {
+	settings := data.GetInstance().GetResolverSettings()
+	switch name {
+	case "dot":
+		cert, err := listenerCertificate()
+		if err != nil {
+			return err
+		}
+		addr := ":" + strings.TrimSpace(settings.DoT.Port)
+		if err := dotServer.Start(addr, cert); err != nil {
+			return err
+		}
+		log.Printf("Starting DoT listener on %s\n", addr)
+		return nil
+	case "doh":
+		cert, err := listenerCertificate()
+		if err != nil {
+			return err
+		}
+		addr := ":" + strings.TrimSpace(settings.DoH.Port)
+		if err := dohServer.Start(addr, cert); err != nil {
+			return err
+		}
+		log.Printf("Starting DoH listener on %s%s\n", addr, encrypted.DoHPath)
+		return nil
+	case "doq":
+		cert, err := listenerCertificate()
+		if err != nil {
+			return err
+		}
+		addr := ":" + strings.TrimSpace(settings.DoQ.Port)
+		idleTimeout := time.Duration(settings.DoQ.IdleTimeout) * time.Second
+		if err := doqServer.Start(addr, cert, idleTimeout); err != nil {
+			return err
+		}
+		log.Printf("Starting DoQ listener on %s\n", addr)
+		return nil
+	default:
+		return fmt.Errorf("unknown listener: %s", name)
+	}
+}
+
+// stopEncryptedListener stops the named encrypted listener.
+func stopEncryptedListener(name string) error {
+	switch name {
+	case "dot":
+		return dotServer.Stop()
+	case "doh":
+		return dohServer.Stop()
+	case "doq":
+		return doqServer.Stop()
+	default:
+		return fmt.Errorf("unknown listener: %s", name)
+	}
+}
+
+// startHealthChecks begins probing the active upstream servers in the
+// background and takes failing ones out of rotation until they recover.
+func startHealthChecks(stop <-chan struct{}) {
+	settings := data.GetInstance().GetResolverSettings()
+	interval := time.Duration(settings.HealthCheck.Interval) * time.Second
+	if interval <= 0 {
+		log.Printf("Upstream health checks disabled")
+		return
+	}
+	upstreamHealth.SetFailureThreshold(settings.HealthCheck.FailureThreshold)
+	upstreamHealth.OnChange(func(server string, from, to upstream.HealthState) {
+		if from == upstream.HealthUnknown && to == upstream.HealthHealthy {
+			return
+		}
+		log.Printf("Upstream %s health changed: %s -> %s", server, from, to)
+	})
+	upstreamResolver.SetHealthChecker(upstreamHealth)
+
+	activeServers := func() []upstream.Server {
+		dnsdata := data.GetInstance()
+		return append(upstreamTargets(dnsdata.GetServers()), fallbackTargets(dnsdata.GetResolverSettings())...)
+	}
+	go upstreamHealth.Run(stop, interval, activeServers, syncServerHealth)
+}
+
+// syncServerHealth copies the tracked health into the in-memory server list so
+// that it shows up in `dns list` and is persisted by `dns save`.
+func syncServerHealth() {
+	data.GetInstance().ApplyServerStatus(func(server *dnsservers.DNSServer) {
+		health, ok := upstreamHealth.Status(upstreamTarget(*server, 0).String())
+		if !ok {
+			return
+		}
+		server.Health = string(health.State)
+		server.LastRTT = health.LastRTT
+		server.LastUsed = health.LastUsed
+		server.LastSuccess = health.LastSuccess
+	})
+}
+
 func startAPIAsync(state *daemon.State, port string) {
 	if port == "" {
 		port = data.GetInstance().GetResolverSettings().RESTPort
@@ -343,47 +554,75 @@ func startDNSServer(state *daemon.State, port string) (<-chan struct{}, <-chan e
 	})
 	dnsData := data.GetInstance()
 
-	server := &dns.Server{
-		Addr: fmt.Sprintf(":%s", trimmedPort),
-		Net:  "udp",
+	addr := fmt.Sprintf(":%s", trimmedPort)
+	servers := []*dns.Server{
+		{Addr: addr, Net: "udp", UDPSize: int(dnsData.GetResolverSettings().EDNS.UDPSize)},
+		{Addr: addr, Net: "tcp"},
 	}
 
-	log.Printf("Starting DNS server on %s\n", server.Addr)
+	log.Printf("Starting DNS server on %s (udp, tcp)\n", addr)
 
 	startedCh := make(chan struct{})
-	errCh := make(chan error, 1)
+	errCh := make(chan error, len(servers))
 	var once sync.Once
+	var startedCount atomic.Int32
+	var failed atomic.Bool
 
-	server.NotifyStartedFunc = func() {
-		once.Do(func() {
-			state.SetServerStatus(true)
-			stats := dnsData.GetStats()
-			stats.ServerStartTime = time.Now()
-			dnsData.UpdateStats(stats)
-			close(startedCh)
-		})
+	shutdownAll := func() {
+		for _, server := range servers {
+			_ = server.Shutdown()
+		}
 	}
 
-	go func() {
-		defer state.NotifyStopped()
-		if err := server.ListenAndServe(); err != nil {
-			state.SetServerStatus(false)
-			select {
-			case errCh <- err:
-			default:
+	var running sync.WaitGroup
+	for _, server := range servers {
+		server.NotifyStartedFunc = func() {
+			if failed.Load() {
+				// A sibling listener failed to bind; do not leave this one running alone.
+				go func() { _ = server.Shutdown() }()
+				return
 			}
-			return
+			if int(startedCount.Add(1)) != len(servers) {
+				return
+			}
+			once.Do(func() {
+				state.SetServerStatus(true)
+				stats := dnsData.GetStats()
+				stats.ServerStartTime = time.Now()
+				dnsData.UpdateStats(stats)
+				close(startedCh)
+			})
 		}
+
+		running.Add(1)
+		go func(server *dns.Server) {
+			defer running.Done()
+			if err := server.ListenAndServe(); err != nil {
+				failed.Store(true)
+				select {
+				case errCh <- fmt.Errorf("%s listener: %w", server.Net, err):
+				default:
+				}
+				shutdownAll()
+			}
+		}(server)
+	}
+
+	go func() {
+		running.Wait()
 		state.SetServerStatus(false)
+		state.NotifyStopped()
 	}()
 
 	stopCh := state.StopChannel()
 	go func() {
 		<-stopCh
-		if err := server.Shutdown(); err != nil {
-			select {
-			case errCh <- err:
-			default:
+		for _, server := range servers {
+			if err := server.Shutdown(); err != nil {
+				select {
+				case errCh <- err:
+				default:
+				}
 			}
 		}
 	}()
@@ -426,57 +665,214 @@ func logQuery(format string, args ...interface{}) {
 
 // DNS
 func handleRequest(writer dns.ResponseWriter, request *dns.Msg) {
+	response := resolveRequest(request, writer.RemoteAddr())
+	if response == nil {
+		return
+	}
+
+	if isUDPWriter(writer) {
+		response.Truncate(edns.Parse(request).ResponseSize(ednsOptions()))
+	}
+
+	err := writer.WriteMsg(response)
+	if err != nil {
+		log.Println("Error writing response:", err)
+	}
+}
+
+// resolveRequest answers every question in request. It is shared by all
+// listeners; transport specific handling such as truncation is left to the
+// caller. It returns nil when a response policy says to drop the query.
+// Clients at remote that the DNS access control list does not allow are
+// refused.
+func resolveRequest(request *dns.Msg, remote net.Addr) *dns.Msg {
 	response := new(dns.Msg)
 	response.SetReply(request)
 	response.Authoritative = false
 
 	dnsData := data.GetInstance()
+	if !dnsData.GetACL().DNS.AllowedAddr(remote) {
+		dnsData.IncrementACLDenials()
+		log.Printf("ACL: refused DNS query for %s from %s", describeQuestion(request), remote)
+		response.Rcode = dns.RcodeRefused
+		return response
+	}
 	dnsData.IncrementTotalQueries()
 
+	options := ednsOptions()
+	client := edns.Parse(request)
+	if !client.Supported() {
+		edns.BadVersion(response, options)
+		logQuery("Query: %s, Reply: BADVERS (EDNS version %d)\n", describeQuestion(request), client.Version)
+		return response
+	}
+
 	for _, question := range request.Question {
-		handleQuestion(question, response)
+		if handleQuestion(request, question, response) {
+			return nil
+		}
 	}
+	edns.FinishResponse(response, client, options)
+	return response
+}
 
-	err := writer.WriteMsg(response)
-	if err != nil {
-		log.Println("Error writing response:", err)
+// ednsOptions returns the configured EDNS0 negotiation settings.
+func ednsOptions() edns.Options {
+	settings := data.GetInstance().GetResolverSettings()
+	return edns.Options{
+		UDPSize:       settings.EDNS.UDPSize,
+		ForwardSubnet: settings.EDNS.ClientSubnet == config.ClientSubnetPassthrough,
 	}
 }
 
-func handleQuestion(question dns.Question, response *dns.Msg) {
-	dnsdata := data.GetInstance()
-	dnsServerSettings := dnsdata.GetResolverSettings()
-	dnsRecords := dnsdata.GetRecords()
+func describeQuestion(request *dns.Msg) string {
+	if len(request.Question) == 0 {
+		return "none"
+	}
+	return request.Question[0].Name
+}
 
-	switch question.Qtype {
-	case dns.TypePTR:
-		handlePTRQuestion(question, response)
-		return
+// isUDPWriter reports whether the response is sent over a datagram transport
+// and therefore subject to message size limits.
+func isUDPWriter(writer dns.ResponseWriter) bool {
+	if writer == nil || writer.LocalAddr() == nil {
+		return false
+	}
+	return writer.LocalAddr().Network() == "udp"
+}
 
-	case dns.TypeA:
-		recordType := dns.TypeToString[question.Qtype]
-		cachedRecord := dnsrecords.FindRecord(dnsRecords, question.Name, recordType, dnsServerSettings.DNSRecordSettings.AutoBuildPTRFromA)
+// handleQuestion adds the answer to question to response. It reports drop
+// when a response policy zone says the query must not be answered at all.
+func handleQuestion(request *dns.Msg, question dns.Question, response *dns.Msg) (drop bool) {
+	dnsdata := data.GetInstance()
+	dnsRecords := dnsdata.GetRecords()
 
-		if cachedRecord != nil {
-			processCachedRecord(question, cachedRecord, response)
-		} else {
-			cachedRecord = findCacheRecord(dnsdata.GetCacheRecords(), question.Name, recordType)
-			if cachedRecord != nil {
-				dnsdata.IncrementCacheHits()
-				processCacheRecord(question, cachedRecord, response)
-			} else {
+	// Policy rules come before everything else: a deny rule answers right
+	// away and an allow rule exempts the name from the blocklists and
+	// response policy zones.
+	rule, ruled := dnsdata.GetPolicy().Evaluate(question.Name, question.Qtype)
+	if ruled && rule.Rule.Action == policy.ActionDeny {
+		denyQuestion(question, rule, response)
+		dnsdata.IncrementQueriesAnswered()
+		return false
+	}
+	allowed := ruled && rule.Rule.Action == policy.ActionAllow
 
-				handleDNSServers(question, dnsservers.GetDNSArray(dnsdata.DNSServers, true), fmt.Sprintf("%s:%s", dnsServerSettings.FallbackServerIP, dnsServerSettings.FallbackServerPort), response)
+	recordType := dns.TypeToString[question.Qtype]
+	localRecords := dnsrecords.ResolveRecords(dnsRecords, question.Name, recordType)
+	key := cacheKey(request, question)
+	if !allowed && len(localRecords) == 0 {
+		if hit, ok := dnsdata.GetRPZ().MatchQName(question.Name); ok {
+			if hit.Rewrites() {
+				drop = applyRPZ(request, question, hit, response)
+				if !drop {
+					dnsdata.IncrementQueriesAnswered()
+				}
+				return drop
 			}
+			// PASSTHRU: answer normally without any further filtering.
+			allowed = true
+		}
+	}
+	blocked := !allowed && len(localRecords) == 0 && blockQuestion(question, response)
+	// Reverse names go through the same filters, so a blocked PTR name is
+	// never looked up.
+	if question.Qtype == dns.TypePTR && !blocked {
+		handlePTRQuestion(request, question, response)
+		return false
+	}
+	var cachedRecord *dnsrecordcache.Entry
+	if len(localRecords) == 0 && !blocked {
+		if entry, ok := dnsdata.GetCache().Get(key); ok {
+			cachedRecord = &entry
 		}
+	}
 
+	answerStart, nsStart := len(response.Answer), len(response.Ns)
+	switch {
+	case len(localRecords) > 0:
+		processLocalRecords(question, localRecords, response)
+	case blocked:
+		// Answered by blockQuestion.
+	case cachedRecord != nil:
+		dnsdata.IncrementCacheHits()
+		processCacheRecord(question, cachedRecord, "dnscache.json", response)
+		prefetch(request, question, cachedRecord)
+	case isStaleRefreshing(key) && serveStale(request, question, response):
+		// Upstreams failed recently and are being retried in the background.
 	default:
-		handleDNSServers(question, dnsservers.GetDNSArray(dnsdata.DNSServers, true), fmt.Sprintf("%s:%s", dnsServerSettings.FallbackServerIP, dnsServerSettings.FallbackServerPort), response)
+		handleDNSServers(request, question, response)
+	}
+
+	// IP and NSDNAME triggers depend on the answer, so they are checked once
+	// it is known, whether it came from the cache or an upstream.
+	if !allowed && !blocked && len(localRecords) == 0 {
+		if hit, ok := dnsdata.GetRPZ().MatchResponse(response.Answer[answerStart:], response.Ns[nsStart:]); ok && hit.Rewrites() {
+			response.Answer = response.Answer[:answerStart]
+			response.Ns = response.Ns[:nsStart]
+			response.Rcode = dns.RcodeSuccess
+			response.AuthenticatedData = false
+			if applyRPZ(request, question, hit, response) {
+				return true
+			}
+		}
 	}
 	dnsdata.IncrementQueriesAnswered()
+	return false
+}
+
+// applyRPZ answers question as a response policy zone rule says and reports
+// whether the query must be dropped. A CNAME from local data is followed
+// through local records, the cache and upstreams, without applying policies
+// to the target again.
+func applyRPZ(request *dns.Msg, question dns.Question, hit rpz.Hit, response *dns.Msg) bool {
+	dnsdata := data.GetInstance()
+	dnsdata.IncrementTotalBlocks()
+	reply, target := hit.Apply(question, response)
+	logQuery("Query: %s, Reply: %s, Method: rpz %s\n", question.Name, reply, hit)
+	if hit.Action == rpz.ActionDrop {
+		return true
+	}
+	if target == "" {
+		return false
+	}
+	targetQuestion := dns.Question{Name: target, Qtype: question.Qtype, Qclass: question.Qclass}
+	if localRecords := dnsrecords.ResolveRecords(dnsdata.GetRecords(), target, dns.TypeToString[question.Qtype]); len(localRecords) > 0 {
+		processLocalRecords(targetQuestion, localRecords, response)
+		return false
+	}
+	if entry, ok := dnsdata.GetCache().Get(cacheKey(request, targetQuestion)); ok {
+		processCacheRecord(targetQuestion, &entry, "dnscache.json", response)
+		return false
+	}
+	handleDNSServers(request, targetQuestion, response)
+	return false
+}
+
+// blockQuestion answers question with the configured block response when the
+// name is on a blocklist, and reports whether it did.
+func blockQuestion(question dns.Question, response *dns.Msg) bool {
+	dnsdata := data.GetInstance()
+	match, ok := dnsdata.GetBlocklist().Match(question.Name)
+	if !ok {
+		return false
+	}
+	reply := blocklist.Respond(response, question, dnsdata.GetResolverSettings().Blocklist.Response)
+	dnsdata.IncrementTotalBlocks()
+	logQuery("Query: %s, Reply: %s, Method: blocklist %s (%s)\n", question.Name, reply, match.Source, match.Rule)
+	return true
 }
 
-func handlePTRQuestion(question dns.Question, response *dns.Msg) {
+// denyQuestion answers question the way blocked queries are answered because
+// a deny rule matched it.
+func denyQuestion(question dns.Question, rule policy.Match, response *dns.Msg) {
+	dnsdata := data.GetInstance()
+	reply := blocklist.Respond(response, question, dnsdata.GetResolverSettings().Blocklist.Response)
+	dnsdata.IncrementTotalBlocks()
+	logQuery("Query: %s, Reply: %s, Method: policy rule %d (%s)\n", question.Name, reply, rule.Number, rule.Rule)
+}
+
+func handlePTRQuestion(request *dns.Msg, question dns.Question, response *dns.Msg) {
 	dnsdata := data.GetInstance()
 	dnsServerSettings := dnsdata.GetResolverSettings()
 
@@ -510,45 +906,290 @@ func handlePTRQuestion(question dns.Question, response *dns.Msg) {
 
 	} else {
 		logQuery("PTR record not found in dnsrecords.json\n")
-		handleDNSServers(question, dnsservers.GetDNSArray(dnsdata.DNSServers, true), fmt.Sprintf("%s:%s", dnsServerSettings.FallbackServerIP, dnsServerSettings.FallbackServerPort), response)
+		handleDNSServers(request, question, response)
 	}
 }
 
-func dnsRecordToRR(dnsRecord *dnsrecords.DNSRecord, ttl uint32) *dns.RR {
-	recordString := fmt.Sprintf("%s %d IN %s %s", dnsRecord.Name, ttl, dnsRecord.Type, dnsRecord.Value)
-	rr, err := dns.NewRR(recordString)
-	if err != nil {
-		log.Printf("Error converting DnsRecord to dns.RR: %s\n", err)
-		return nil
+func processUpstreamAnswer(request *dns.Msg, question dns.Question, answer *dns.Msg, server string, response *dns.Msg) {
+	mergeUpstreamResponse(response, answer)
+	response.Authoritative = answer.Authoritative
+	logQuery("Query: %s, Reply: %s, Method: DNS server: %s\n", question.Name, describeAnswer(answer), server)
+
+	cacheDNSResponse(request, answer)
+}
+
+// handleFallbackServer queries the fallback servers, in order or in parallel
+// depending on the configured fallback mode, and relays the first usable
+// reply. When every fallback fails, the best of the non-authoritative replies
+// already received is used instead, and SERVFAIL is returned if nothing
+// answered.
+func handleFallbackServer(request *dns.Msg, question dns.Question, fallbackServers []upstream.Server, deadline time.Time, candidates []*dns.Msg, response *dns.Msg) {
+	strategy := fallbackStrategy(data.GetInstance().GetResolverSettings())
+	result := upstreamResolver.Resolve(strategy, newUpstreamQuery(request, question), fallbackServers, deadline)
+	if result.Answer != nil {
+		mergeUpstreamResponse(response, result.Answer)
+		logQuery("Query: %s, Reply: %s, Method: Fallback DNS server: %s\n", question.Name, describeAnswer(result.Answer), result.Server.String())
+
+		cacheDNSResponse(request, result.Answer)
+		return
+	}
+	answerBestReply(request, question, append(candidates, result.Replies...), response)
+}
+
+// answerBestReply relays the best of the replies that were received but not
+// accepted by the upstream strategy. A stale cache entry is preferred over
+// failures, and SERVFAIL is returned if nothing answered.
+func answerBestReply(request *dns.Msg, question dns.Question, candidates []*dns.Msg, response *dns.Msg) {
+	best := upstream.Best(candidates)
+	if upstream.Rank(best) <= upstream.RankFailure && serveStale(request, question, response) {
+		return
+	}
+	if best == nil {
+		response.Rcode = dns.RcodeServerFailure
+		logQuery("Query: %s, No response\n", question.Name)
+		return
+	}
+	mergeUpstreamResponse(response, best)
+	logQuery("Query: %s, Reply: %s, Method: non-authoritative DNS server\n", question.Name, describeAnswer(best))
+	cacheDNSResponse(request, best)
+}
+
+var (
+	// staleRefreshes holds the cache keys that are being refreshed in the
+	// background after a stale answer was served.
+	staleRefreshes sync.Map
+	// prefetches holds the cache keys of running prefetches.
+	prefetches sync.Map
+)
+
+// prefetch re-resolves a popular cache entry in the background once less than
+// the configured share of its TTL is left, so that clients keep getting
+// cached answers instead of waiting for upstreams when it expires.
+func prefetch(request *dns.Msg, question dns.Question, cachedRecord *dnsrecordcache.Entry) {
+	dnsdata := data.GetInstance()
+	settings := dnsdata.GetResolverSettings().Cache
+	if !settings.Prefetch || cachedRecord.Hits < settings.PrefetchMinHits {
+		return
+	}
+	if cachedRecord.LifetimeLeft(time.Now())*100 >= float64(settings.PrefetchThreshold) {
+		return
+	}
+	key := cacheKey(request, question)
+	if _, running := prefetches.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	dnsdata.IncrementPrefetches()
+	query := newUpstreamQuery(request, question)
+	go func() {
+		defer prefetches.Delete(key)
+		if !resolveInBackground(query, question) {
+			dnsdata.IncrementPrefetchFailures()
+			logQuery("Query: %s, Method: prefetch failed\n", question.Name)
+			return
+		}
+		logQuery("Query: %s, Method: prefetched\n", question.Name)
+	}()
+}
+
+// fallbackStrategy returns the upstream strategy matching the fallback mode.
+func fallbackStrategy(settings data.DNSResolverSettings) string {
+	if settings.FallbackMode == config.FallbackModeParallel {
+		return upstream.StrategyFastest
 	}
-	return &rr
+	return upstream.StrategySequential
 }
 
-func processAuthoritativeAnswer(question dns.Question, answer *dns.Msg, response *dns.Msg) {
+// serveStale answers question from an expired cache entry when serving stale
+// is enabled, and starts refreshing the entry in the background. It reports
+// whether an answer was written.
+func serveStale(request *dns.Msg, question dns.Question, response *dns.Msg) bool {
+	dnsdata := data.GetInstance()
+	settings := dnsdata.GetResolverSettings()
+	if !settings.Cache.ServeStale {
+		return false
+	}
+	key := cacheKey(request, question)
+	entry, ok := dnsdata.GetCache().GetStale(key, uint32(settings.Cache.StaleTTL))
+	if !ok {
+		return false
+	}
+	dnsdata.IncrementStaleAnswers()
+	processCacheRecord(question, &entry, "dnscache.json (stale)", response)
+	refreshStale(request, question, key)
+	return true
+}
+
+func isStaleRefreshing(key dnsrecordcache.Key) bool {
+	_, ok := staleRefreshes.Load(key)
+	return ok
+}
+
+// refreshStale retries the upstreams for question every staleRefreshInterval
+// until one answers or the stale window has passed. Only one refresh runs per
+// key.
+func refreshStale(request *dns.Msg, question dns.Question, key dnsrecordcache.Key) {
+	if _, running := staleRefreshes.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	query := newUpstreamQuery(request, question)
+	window := time.Duration(data.GetInstance().GetResolverSettings().Cache.StaleWindow) * time.Second
+	giveUp := time.Now().Add(window)
+	go func() {
+		defer staleRefreshes.Delete(key)
+		for {
+			query.Id = dns.Id()
+			if resolveInBackground(query, question) {
+				logQuery("Query: %s, Method: stale entry refreshed\n", question.Name)
+				return
+			}
+			if time.Now().Add(staleRefreshInterval).After(giveUp) {
+				return
+			}
+			time.Sleep(staleRefreshInterval)
+		}
+	}()
+}
+
+// resolveInBackground sends query to the upstreams and then the fallback
+// servers and caches the first usable reply. It reports whether one arrived.
+func resolveInBackground(query *dns.Msg, question dns.Question) bool {
+	dnsdata := data.GetInstance()
+	settings := dnsdata.GetResolverSettings()
+	routedServers, routed := dnsservers.ServersForQuery(dnsdata.GetServers(), question.Name)
+	result := upstreamResolver.Resolve(settings.UpstreamStrategy, query, upstreamTargets(routedServers), time.Time{})
+	if result.Answer == nil && !routed {
+		result = upstreamResolver.Resolve(fallbackStrategy(settings), query, fallbackTargets(settings), time.Time{})
+	}
+	if result.Answer == nil {
+		return false
+	}
+	cacheDNSResponse(query, result.Answer)
+	return true
+}
+
+// newUpstreamQuery builds the message forwarded to upstream servers for a
+// single question, preserving the client's opcode and RD/CD/AD bits. The query
+// always carries our own EDNS0 OPT with the client's DO bit and, depending on
+// the privacy setting, its client subnet.
+func newUpstreamQuery(request *dns.Msg, question dns.Question) *dns.Msg {
+	message := new(dns.Msg)
+	message.Id = dns.Id()
+	message.Question = []dns.Question{question}
+	message.RecursionDesired = true
+
+	var client edns.Client
+	if request != nil {
+		message.Opcode = request.Opcode
+		message.RecursionDesired = request.RecursionDesired
+		message.CheckingDisabled = request.CheckingDisabled
+		message.AuthenticatedData = request.AuthenticatedData
+		client = edns.Parse(request)
+	}
+	edns.PrepareQuery(message, client, ednsOptions())
+	return message
+}
+
+// mergeUpstreamResponse relays the answer, authority and additional sections of
+// an upstream reply into the client response together with its rcode. The
+// upstream OPT record is kept only until resolveRequest replaces it with ours.
+func mergeUpstreamResponse(response *dns.Msg, answer *dns.Msg) {
+	if answer == nil {
+		return
+	}
 	response.Answer = append(response.Answer, answer.Answer...)
-	response.Authoritative = true
-	logQuery("Query: %s, Reply: %s, Method: DNS server: %s\n", question.Name, answer.Answer[0].String(), answer.Answer[0].Header().Name[:len(answer.Answer[0].Header().Name)-1])
+	response.Ns = append(response.Ns, answer.Ns...)
+	for _, rr := range answer.Extra {
+		if _, ok := rr.(*dns.OPT); ok {
+			if response.IsEdns0() == nil {
+				response.Extra = append(response.Extra, dns.Copy(rr))
+			}
+			continue
+		}
+		response.Extra = append(response.Extra, rr)
+	}
+	if answer.Rcode != dns.RcodeSuccess {
+		response.Rcode = answer.Rcode
+	}
+	response.RecursionAvailable = response.RecursionAvailable || answer.RecursionAvailable
+	response.AuthenticatedData = answer.AuthenticatedData
+}
 
-	cacheDNSResponse(answer)
+func describeAnswer(answer *dns.Msg) string {
+	if answer == nil {
+		return "none"
+	}
+	if len(answer.Answer) > 0 {
+		return answer.Answer[0].String()
+	}
+	return dns.RcodeToString[answer.Rcode]
 }
 
-func handleFallbackServer(question dns.Question, fallbackServer string, response *dns.Msg) {
-	fallbackResponse, _ := queryAuthoritative(question.Name, fallbackServer)
-	if fallbackResponse != nil {
-		response.Answer = append(response.Answer, fallbackResponse.Answer...)
-		logQuery("Query: %s, Reply: %s, Method: Fallback DNS server: %s\n", question.Name, fallbackResponse.Answer[0].String(), fallbackServer)
+// cacheKey returns the key question is cached under for request. Answers for
+// clients that set the DO bit are kept apart, since only they get signatures.
+func cacheKey(request *dns.Msg, question dns.Question) dnsrecordcache.Key {
+	key := dnsrecordcache.NewKey(question.Name, question.Qtype, question.Qclass)
+	key.DNSSEC = request != nil && edns.Parse(request).DO
+	return key
+}
 
-		cacheDNSResponse(fallbackResponse)
-	} else {
-		logQuery("Query: %s, No response\n", question.Name)
+// cacheDNSResponse caches an upstream reply to request. Replies that are only
+// good for the client that asked are not cached: those to queries with the CD
+// bit set, which may hold data that failed validation, and those the upstream
+// tailored to the client's subnet.
+func cacheDNSResponse(request *dns.Msg, answer *dns.Msg) {
+	if answer == nil {
+		return
+	}
+	if request != nil && request.CheckingDisabled {
+		return
+	}
+	if subnet := edns.Parse(answer).Subnet; subnet != nil && subnet.SourceScope > 0 {
+		return
+	}
+	if len(answer.Answer) == 0 {
+		cacheNegativeResponse(request, answer)
+		return
+	}
+	if len(answer.Question) == 0 {
+		cacheRRs(answer.Answer)
+		return
 	}
+	cacheAnswer(request, answer)
 }
 
-func cacheDNSResponse(answer *dns.Msg) {
-	if answer == nil || len(answer.Answer) == 0 {
+// cacheNegativeResponse caches NXDOMAIN and NODATA replies. Replies without a
+// SOA in the authority section carry no negative TTL and are not cached.
+func cacheNegativeResponse(request *dns.Msg, answer *dns.Msg) {
+	if len(answer.Question) == 0 || (answer.Rcode != dns.RcodeNameError && answer.Rcode != dns.RcodeSuccess) {
 		return
 	}
-	cacheRRs(answer.Answer)
+	var soa *dns.SOA
+	for _, rr := range answer.Ns {
+		if record, ok := rr.(*dns.SOA); ok {
+			soa = record
+			break
+		}
+	}
+	if soa == nil {
+		return
+	}
+
+	dnsdata := data.GetInstance()
+	settings := dnsdata.GetResolverSettings()
+	if !settings.CacheRecords {
+		return
+	}
+	dnsdata.GetCache().AddNegative(cacheKey(request, answer.Question[0]), answer.Rcode, soa, uint32(settings.Cache.NegativeMaxTTL))
+}
+
+// cacheAnswer caches the answer section of a reply under its question, so that
+// CNAME chains are served together with the records they lead to.
+func cacheAnswer(request *dns.Msg, answer *dns.Msg) {
+	dnsdata := data.GetInstance()
+	if !dnsdata.GetResolverSettings().CacheRecords {
+		return
+	}
+	dnsdata.GetCache().AddAnswer(cacheKey(request, answer.Question[0]), answer.Answer)
 }
 
 func cacheRRs(rrs []dns.RR) {
@@ -562,99 +1203,161 @@ func cacheRRs(rrs []dns.RR) {
 		return
 	}
 
-	cache := dnsdata.GetCacheRecords()
-	for i := range rrs {
-		rr := rrs[i]
-		cache = dnsrecordcache.Add(cache, &rr)
-	}
-	dnsdata.UpdateCacheRecords(cache)
+	dnsdata.GetCache().Add(rrs)
 }
 
-func processCachedRecord(question dns.Question, cachedRecord *dns.RR, response *dns.Msg) {
-	response.Answer = append(response.Answer, *cachedRecord)
+func processLocalRecords(question dns.Question, records []dns.RR, response *dns.Msg) {
+	response.Answer = append(response.Answer, records...)
 	response.Authoritative = true
-	logQuery("Query: %s, Reply: %s, Method: dnsrecords.json\n", question.Name, (*cachedRecord).String())
-	cacheRRs([]dns.RR{*cachedRecord})
-}
-
-func processCacheRecord(question dns.Question, cachedRecord *dns.RR, response *dns.Msg) {
-	response.Answer = append(response.Answer, *cachedRecord)
-	logQuery("Query: %s, Reply: %s, Method: dnscache.json\n", question.Name, (*cachedRecord).String())
+	for _, rr := range records {
+		logQuery("Query: %s, Reply: %s, Method: dnsrecords.json\n", question.Name, rr.String())
+	}
+	cacheRRs(records)
 }
 
-func findCacheRecord(cacheRecords []dnsrecordcache.CacheRecord, name string, recordType string) *dns.RR {
-	now := time.Now()
-	for _, record := range cacheRecords {
-		if dnsrecords.NormalizeRecordNameKey(record.DNSRecord.Name) == dnsrecords.NormalizeRecordNameKey(name) &&
-			dnsrecords.NormalizeRecordType(record.DNSRecord.Type) == dnsrecords.NormalizeRecordType(recordType) {
-			if now.Before(record.Expiry) {
-				remainingTTL := uint32(record.Expiry.Sub(now).Seconds())
-				return dnsRecordToRR(&record.DNSRecord, remainingTTL)
-			}
+func processCacheRecord(question dns.Question, cachedRecord *dnsrecordcache.Entry, method string, response *dns.Msg) {
+	if cachedRecord.Negative {
+		response.Rcode = cachedRecord.Rcode
+		if cachedRecord.SOA != nil {
+			response.Ns = append(response.Ns, cachedRecord.SOA)
 		}
+		logQuery("Query: %s, Reply: %s, Method: %s (negative)\n", question.Name, cachedRecord.NegativeLabel(), method)
+		return
 	}
-	return nil
+	response.Answer = append(response.Answer, cachedRecord.RRs...)
+	logQuery("Query: %s, Reply: %s, Method: %s\n", question.Name, cachedRecord.RRs[0].String(), method)
 }
 
-func queryAuthoritative(questionName string, server string) (*dns.Msg, error) {
-	client := new(dns.Client)
-	client.Timeout = 2 * time.Second // Set the desired timeout duration
-	message := new(dns.Msg)
-	message.SetQuestion(questionName, dns.TypeA)
-	response, _, err := client.Exchange(message, server)
+func queryAuthoritative(message *dns.Msg, target upstream.Server) (*dns.Msg, error) {
+	server := target.String()
+	questionName := message.Question[0].Name
+	response, err := upstream.Exchange(message, target)
 	if err != nil {
 		log.Printf("Error querying DNS server (%s) for %s: %s\n", server, questionName, err)
 		return nil, err
 	}
 
 	if len(response.Answer) == 0 {
-		log.Printf("No answer received from DNS server (%s) for %s\n", server, questionName)
-		return nil, errors.New("no answer received")
+		logQuery("No answer received from DNS server (%s) for %s: %s\n", server, questionName, dns.RcodeToString[response.Rcode])
+	} else {
+		logQuery("response %s\n", response.Answer[0].String())
 	}
 
-	logQuery("response %s\n", response.Answer[0].String())
-
 	return response, nil
 }
 
-func queryAllDNSServers(question dns.Question, dnsServers []string) <-chan *dns.Msg {
-	answers := make(chan *dns.Msg, len(dnsServers))
-	var wg sync.WaitGroup
+// probeUpstream sends a health probe without the query logging done by
+// queryAuthoritative.
+func probeUpstream(message *dns.Msg, target upstream.Server) (*dns.Msg, error) {
+	return upstream.Exchange(message, target)
+}
 
-	for _, server := range dnsServers {
-		wg.Add(1)
-		go func(server string) {
-			defer wg.Done()
-			authResponse, _ := queryAuthoritative(question.Name, server)
-			if authResponse != nil {
-				answers <- authResponse
-			}
-		}(server)
+// globalTimeout returns the configured per-exchange timeout.
+func globalTimeout(settings data.DNSResolverSettings) time.Duration {
+	if settings.Timeout <= 0 {
+		return upstream.DefaultTimeout
 	}
+	return time.Duration(settings.Timeout) * time.Second
+}
 
-	go func() {
-		wg.Wait()
-		close(answers)
-	}()
+// upstreamTargets converts the active configured servers into upstream
+// targets, applying the global timeout where a server has no override.
+func upstreamTargets(servers []dnsservers.DNSServer) []upstream.Server {
+	timeout := globalTimeout(data.GetInstance().GetResolverSettings())
+	targets := make([]upstream.Server, 0, len(servers))
+	for _, server := range servers {
+		if !server.Active {
+			continue
+		}
+		targets = append(targets, upstreamTarget(server, timeout))
+	}
+	return targets
+}
 
-	return answers
+// upstreamTarget describes how to reach server, using timeout unless the
+// server overrides it.
+func upstreamTarget(server dnsservers.DNSServer, timeout time.Duration) upstream.Server {
+	target := upstream.Server{
+		Address:    net.JoinHostPort(server.Address, server.Port),
+		Timeout:    timeout,
+		Retries:    server.Retries,
+		Protocol:   server.Protocol,
+		ServerName: server.ServerName,
+		URL:        server.URL,
+	}
+	if server.TimeoutMs > 0 {
+		target.Timeout = time.Duration(server.TimeoutMs) * time.Millisecond
+	}
+	return target
 }
 
-func handleDNSServers(question dns.Question, dnsServers []string, fallbackServer string, response *dns.Msg) {
-	answers := queryAllDNSServers(question, dnsServers)
+// fallbackTargets returns the configured fallback servers as upstream targets.
+func fallbackTargets(settings data.DNSResolverSettings) []upstream.Server {
+	timeout := globalTimeout(settings)
+	targets := make([]upstream.Server, 0, len(settings.FallbackServers))
+	for _, server := range settings.FallbackServers {
+		targets = append(targets, upstream.Server{Address: server.String(), Timeout: timeout})
+	}
+	return targets
+}
 
-	found := false
-	for answer := range answers {
-		if answer.MsgHdr.Authoritative {
-			processAuthoritativeAnswer(question, answer, response)
-			found = true
-			break
-		}
+// handleDNSServers resolves question through the upstream and fallback
+// servers. Identical questions already being resolved for another client are
+// not sent again; the client shares the reply of the query in flight.
+func handleDNSServers(request *dns.Msg, question dns.Question, response *dns.Msg) {
+	reply, shared := inflightQueries.Do(coalesceKey(request, question), func() *dns.Msg {
+		reply := new(dns.Msg)
+		resolveUpstreams(request, question, reply)
+		return reply
+	})
+	if shared {
+		data.GetInstance().IncrementQueriesCoalesced()
+		logQuery("Query: %s, Reply: %s, Method: coalesced with in-flight query\n", question.Name, describeAnswer(reply))
 	}
+	mergeUpstreamResponse(response, reply)
+	response.Authoritative = response.Authoritative || reply.Authoritative
+}
 
-	if !found {
-		handleFallbackServer(question, fallbackServer, response)
+// coalesceKey identifies the upstream queries that may share a reply: the
+// question and the client's DO and CD bits, plus its client subnet when
+// subnets are forwarded.
+func coalesceKey(request *dns.Msg, question dns.Question) string {
+	key := dnsrecordcache.NewKey(question.Name, question.Qtype, question.Qclass).String()
+	if request == nil {
+		return key
 	}
+	client := edns.Parse(request)
+	key += fmt.Sprintf(" do=%t cd=%t", client.DO, request.CheckingDisabled)
+	if client.Subnet != nil && ednsOptions().ForwardSubnet {
+		key += " ecs=" + client.Subnet.String()
+	}
+	return key
+}
+
+func resolveUpstreams(request *dns.Msg, question dns.Question, response *dns.Msg) {
+	dnsdata := data.GetInstance()
+	settings := dnsdata.GetResolverSettings()
+	routedServers, routed := dnsservers.ServersForQuery(dnsdata.GetServers(), question.Name)
+	servers := upstreamTargets(routedServers)
+
+	var deadline time.Time
+	if settings.QueryDeadlineMs > 0 {
+		deadline = time.Now().Add(time.Duration(settings.QueryDeadlineMs) * time.Millisecond)
+	}
+
+	result := upstreamResolver.Resolve(settings.UpstreamStrategy, newUpstreamQuery(request, question), servers, deadline)
+	if result.Answer != nil {
+		processUpstreamAnswer(request, question, result.Answer, result.Server.String(), response)
+		return
+	}
+	// Routed names are often internal ones that public fallback servers
+	// would answer with NXDOMAIN, so they never leave their routed servers.
+	if routed {
+		answerBestReply(request, question, result.Replies, response)
+		return
+	}
+
+	handleFallbackServer(request, question, fallbackTargets(settings), deadline, result.Replies, response)
 }
 
 func startUnixSocketListener(socketPath string) (net.Listener, error) {
@@ -678,7 +1381,11 @@ func startTCPTerminalListener(address string) (net.Listener, error) {
 		return nil, err
 	}
 	log.Printf("Listening on TCP address %s for TUI clients", address)
-	return listener, nil
+	tuiACL := func() *acl.ACL { return data.GetInstance().GetACL().TUI }
+	return acl.NewListener(listener, tuiACL, func(addr net.Addr) {
+		data.GetInstance().IncrementACLDenials()
+		log.Printf("ACL: refused TUI connection from %s", addr)
+	}), nil
 }
 
 func acceptInteractiveSessions(listener net.Listener) {
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"dnsplane/config"
+	"dnsplane/data"
+	"dnsplane/dnsrecordcache"
+	"dnsplane/dnsservers"
+
+	"github.com/miekg/dns"
+)
+
+// upstreamSubnets records, by query name, the client subnet the fake upstream
+// received, or nil when the query carried none.
+var upstreamSubnets sync.Map
+
+// TestMain points the config at a temporary directory and the resolver at an
+// in-process upstream, so tests never touch the user's config or the network.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "dnsplane-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("HOME", dir)
+	os.Setenv("XDG_CONFIG_HOME", dir)
+
+	addr, stop, err := startFakeUpstream()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	loaded, err := config.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	data.SetConfig(loaded)
+	data.InitializeJSONFiles()
+	dnsData := data.GetInstance()
+	host, port, _ := net.SplitHostPort(addr)
+	dnsData.UpdateServers([]dnsservers.DNSServer{{Address: host, Port: port, Active: true}})
+	settings := dnsData.GetResolverSettings()
+	settings.FallbackServers = []config.FallbackServer{{Address: host, Port: port}}
+	settings.CacheRecords = false
+	dnsData.UpdateSettingsInMemory(settings)
+
+	code := m.Run()
+	stop()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// startFakeUpstream serves authoritative answers on a loopback UDP port. Names
+// starting with "big." get a reply of about 800 bytes, and client subnets are
+// echoed with scope 24.
+func startFakeUpstream() (string, func(), error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, NotifyStartedFunc: func() { close(started) }, Handler: dns.HandlerFunc(fakeUpstream)}
+	go server.ActivateAndServe()
+	<-started
+	return conn.LocalAddr().String(), func() { _ = server.Shutdown() }, nil
+}
+
+func fakeUpstream(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	q := r.Question[0]
+	var subnet *dns.EDNS0_SUBNET
+	if opt := r.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if s, ok := option.(*dns.EDNS0_SUBNET); ok {
+				subnet = s
+			}
+		}
+		m.SetEdns0(opt.UDPSize(), opt.Do())
+		if subnet != nil {
+			scoped := *subnet
+			scoped.SourceScope = 24
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &scoped)
+		}
+	}
+	upstreamSubnets.Store(strings.ToLower(q.Name), subnet)
+	if strings.HasPrefix(q.Name, "big.") {
+		for i := 0; i < 12; i++ {
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN TXT \"%02d%s\"", q.Name, i, strings.Repeat("x", 48)))
+			m.Answer = append(m.Answer, rr)
+		}
+	} else {
+		rr, _ := dns.NewRR(q.Name + " 60 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+	}
+	_ = w.WriteMsg(m)
+}
+
+// recordingWriter is a dns.ResponseWriter that keeps the message written to
+// it.
+type recordingWriter struct {
+	local, remote net.Addr
+	msg           *dns.Msg
+}
+
+func newRecordingWriter(network string) *recordingWriter {
+	client := net.ParseIP("127.0.0.1")
+	if network == "tcp" {
+		return &recordingWriter{local: &net.TCPAddr{IP: client, Port: 53}, remote: &net.TCPAddr{IP: client, Port: 40000}}
+	}
+	return &recordingWriter{local: &net.UDPAddr{IP: client, Port: 53}, remote: &net.UDPAddr{IP: client, Port: 40000}}
+}
+
+func (w *recordingWriter) LocalAddr() net.Addr       { return w.local }
+func (w *recordingWriter) RemoteAddr() net.Addr      { return w.remote }
+func (w *recordingWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *recordingWriter) Write([]byte) (int, error) { return 0, fmt.Errorf("not supported") }
+func (w *recordingWriter) Close() error              { return nil }
+func (w *recordingWriter) TsigStatus() error         { return nil }
+func (w *recordingWriter) TsigTimersOnly(bool)       {}
+func (w *recordingWriter) Hijack()                   {}
+
+func setClientSubnetMode(t *testing.T, mode string) {
+	t.Helper()
+	dnsData := data.GetInstance()
+	settings := dnsData.GetResolverSettings()
+	previous := settings.EDNS.ClientSubnet
+	settings.EDNS.ClientSubnet = mode
+	dnsData.UpdateSettingsInMemory(settings)
+	t.Cleanup(func() {
+		settings := dnsData.GetResolverSettings()
+		settings.EDNS.ClientSubnet = previous
+		dnsData.UpdateSettingsInMemory(settings)
+	})
+}
+
+func TestHandleRequestEDNS(t *testing.T) {
+	type clientEDNS struct {
+		size    uint16
+		do      bool
+		version uint8
+		subnet  string
+	}
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		network string
+		edns    *clientEDNS
+		ecsMode string
+
+		wantRcode     int
+		wantOPT       bool
+		wantSize      uint16
+		wantDO        bool
+		wantTruncated bool
+		// wantUpstreamECS is whether the upstream saw the client subnet and
+		// wantScope the scope returned to the client.
+		wantUpstreamECS bool
+		wantScope       int
+	}{
+		{name: "no EDNS gets no OPT", qname: "plain.test.", qtype: dns.TypeA, network: "udp", wantRcode: dns.RcodeSuccess},
+		{name: "advertises our buffer size", qname: "size.test.", qtype: dns.TypeA, network: "udp", edns: &clientEDNS{size: 4096}, wantRcode: dns.RcodeSuccess, wantOPT: true, wantSize: 1232},
+		{name: "small client buffer still gets our size", qname: "tiny.test.", qtype: dns.TypeA, network: "udp", edns: &clientEDNS{size: 100}, wantRcode: dns.RcodeSuccess, wantOPT: true, wantSize: 1232},
+		{name: "DO bit is echoed", qname: "do.test.", qtype: dns.TypeA, network: "udp", edns: &clientEDNS{size: 1232, do: true}, wantRcode: dns.RcodeSuccess, wantOPT: true, wantSize: 1232, wantDO: true},
+		{name: "DO bit stays clear", qname: "nodo.test.", qtype: dns.TypeA, network: "udp", edns: &clientEDNS{size: 1232}, wantRcode: dns.RcodeSuccess, wantOPT: true, wantSize: 1232},
+		{name: "UDP without EDNS is truncated to 512", qname: "big.udp512.test.", qtype: dns.TypeTXT, network: "udp", wantRcode: dns.RcodeSuccess, wantTruncated: true},
+		{name: "UDP with EDNS fits the negotiated size", qname: "big.udp1232.test.", qtype: dns.TypeTXT, network: "udp", edns: &clientEDNS{size: 4096}, wantRcode: dns.RcodeSuccess, wantOPT: true, wantSize: 1232},
+		{name: "TCP is never truncated", qname: "big.tcp.test.", qtype: dns.TypeTXT, network: "tcp", wantRcode: dns.RcodeSuccess},
+		{name: "ECS is stripped", qname: "strip.test.", qtype: dns.TypeA, network: "udp", edns: &clientEDNS{size: 1232, subnet: "198.51.100.0"}, ecsMode: config.ClientSubnetStrip, wantRcode: dns.RcodeSuccess, wantOPT: true, wantSize: 1232, wantScope: 0},
+		{name: "ECS is passed through", qname: "pass.test.", qtype: dns.TypeA, network: "udp", edns: &clientEDNS{size: 1232, subnet: "198.51.100.0"}, ecsMode: config.ClientSubnetPassthrough, wantRcode: dns.RcodeSuccess, wantOPT: true, wantSize: 1232, wantUpstreamECS: true, wantScope: 24},
+		{name: "unknown EDNS version gets BADVERS", qname: "badvers.test.", qtype: dns.TypeA, network: "udp", edns: &clientEDNS{size: 1232, version: 1}, wantRcode: dns.RcodeBadVers, wantOPT: true, wantSize: 1232},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.ecsMode != "" {
+				setClientSubnetMode(t, tt.ecsMode)
+			}
+			request := new(dns.Msg)
+			request.SetQuestion(tt.qname, tt.qtype)
+			if tt.edns != nil {
+				request.SetEdns0(tt.edns.size, tt.edns.do)
+				opt := request.IsEdns0()
+				opt.SetVersion(tt.edns.version)
+				if tt.edns.subnet != "" {
+					opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(tt.edns.subnet).To4()})
+				}
+			}
+
+			writer := newRecordingWriter(tt.network)
+			handleRequest(writer, request)
+			response := writer.msg
+			if response == nil {
+				t.Fatal("no response written")
+			}
+			if response.Rcode != tt.wantRcode {
+				t.Fatalf("rcode = %s, want %s", dns.RcodeToString[response.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			if response.Truncated != tt.wantTruncated {
+				t.Errorf("truncated = %t, want %t", response.Truncated, tt.wantTruncated)
+			}
+			if tt.network == "udp" {
+				limit := 512
+				if tt.edns != nil {
+					limit = int(tt.wantSize)
+				}
+				if size := response.Len(); size > limit {
+					t.Errorf("response is %d bytes, larger than %d", size, limit)
+				}
+			}
+
+			opt := response.IsEdns0()
+			if (opt != nil) != tt.wantOPT {
+				t.Fatalf("OPT present = %t, want %t", opt != nil, tt.wantOPT)
+			}
+			if opt != nil {
+				if opt.UDPSize() != tt.wantSize {
+					t.Errorf("OPT size = %d, want %d", opt.UDPSize(), tt.wantSize)
+				}
+				if opt.Do() != tt.wantDO {
+					t.Errorf("OPT DO = %t, want %t", opt.Do(), tt.wantDO)
+				}
+				if opt.Version() != 0 {
+					t.Errorf("OPT version = %d, want 0", opt.Version())
+				}
+			}
+
+			if tt.edns == nil || tt.edns.subnet == "" {
+				return
+			}
+			seen, _ := upstreamSubnets.Load(tt.qname)
+			if got := seen.(*dns.EDNS0_SUBNET) != nil; got != tt.wantUpstreamECS {
+				t.Errorf("upstream saw ECS = %t, want %t", got, tt.wantUpstreamECS)
+			}
+			var subnet *dns.EDNS0_SUBNET
+			for _, option := range opt.Option {
+				if s, ok := option.(*dns.EDNS0_SUBNET); ok {
+					subnet = s
+				}
+			}
+			if subnet == nil {
+				t.Fatal("client subnet missing from the response")
+			}
+			if int(subnet.SourceScope) != tt.wantScope {
+				t.Errorf("ECS scope = %d, want %d", subnet.SourceScope, tt.wantScope)
+			}
+		})
+	}
+}
+
+func enableCache(t *testing.T) {
+	t.Helper()
+	dnsData := data.GetInstance()
+	settings := dnsData.GetResolverSettings()
+	settings.CacheRecords = true
+	dnsData.UpdateSettingsInMemory(settings)
+	dnsData.GetCache().Clear()
+	t.Cleanup(func() {
+		settings := dnsData.GetResolverSettings()
+		settings.CacheRecords = false
+		dnsData.UpdateSettingsInMemory(settings)
+		dnsData.GetCache().Clear()
+	})
+}
+
+func TestCacheKeepsClientSpecificAnswersApart(t *testing.T) {
+	tests := []struct {
+		name    string
+		qname   string
+		do      bool
+		cd      bool
+		subnet  bool
+		ecsMode string
+		// wantCached is whether the answer is cached, and wantDNSSEC the
+		// cache it lands in.
+		wantCached bool
+		wantDNSSEC bool
+	}{
+		{name: "plain answer is cached", qname: "cached.test.", wantCached: true},
+		{name: "DO answer is cached apart", qname: "dnssec.test.", do: true, wantCached: true, wantDNSSEC: true},
+		{name: "CD answer is not cached", qname: "cd.test.", cd: true},
+		{name: "subnet-scoped answer is not cached", qname: "scoped.test.", subnet: true, ecsMode: config.ClientSubnetPassthrough},
+		{name: "stripped subnet answer is cached", qname: "unscoped.test.", subnet: true, ecsMode: config.ClientSubnetStrip, wantCached: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enableCache(t)
+			if tt.ecsMode != "" {
+				setClientSubnetMode(t, tt.ecsMode)
+			}
+			request := new(dns.Msg)
+			request.SetQuestion(tt.qname, dns.TypeA)
+			request.CheckingDisabled = tt.cd
+			request.SetEdns0(1232, tt.do)
+			if tt.subnet {
+				opt := request.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("198.51.100.0").To4()})
+			}
+			writer := newRecordingWriter("udp")
+			handleRequest(writer, request)
+			if writer.msg == nil || writer.msg.Rcode != dns.RcodeSuccess {
+				t.Fatalf("query failed: %v", writer.msg)
+			}
+
+			cache := data.GetInstance().GetCache()
+			for _, dnssec := range []bool{false, true} {
+				key := dnsrecordcache.NewKey(tt.qname, dns.TypeA, dns.ClassINET)
+				key.DNSSEC = dnssec
+				_, ok := cache.Get(key)
+				if want := tt.wantCached && dnssec == tt.wantDNSSEC; ok != want {
+					t.Errorf("cached with DNSSEC=%t: %t, want %t", dnssec, ok, want)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkResolveRequestCacheHit answers cached names while the cache is
+// persisted in the background, compared with no persistence and with saving
+// the cache after every query.
+func BenchmarkResolveRequestCacheHit(b *testing.B) {
+	const entries = 10000
+	dnsData := data.GetInstance()
+	settings := dnsData.GetResolverSettings()
+	settings.CacheRecords = true
+	dnsData.UpdateSettingsInMemory(settings)
+	cache := dnsData.GetCache()
+	cache.Clear()
+	b.Cleanup(func() {
+		settings := dnsData.GetResolverSettings()
+		settings.CacheRecords = false
+		dnsData.UpdateSettingsInMemory(settings)
+		cache.Clear()
+	})
+
+	requests := make([]*dns.Msg, entries)
+	for i := range requests {
+		name := fmt.Sprintf("host%d.cached.test.", i)
+		rr, _ := dns.NewRR(name + " 3600 IN A 192.0.2.1")
+		cache.AddAnswer(dnsrecordcache.NewKey(name, dns.TypeA, dns.ClassINET), []dns.RR{rr})
+		requests[i] = new(dns.Msg)
+		requests[i].SetQuestion(name, dns.TypeA)
+	}
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+	resolve := func(b *testing.B, i int) {
+		if response := resolveRequest(requests[i%entries], client); response == nil || len(response.Answer) == 0 {
+			b.Fatal("cache miss")
+		}
+	}
+
+	b.Run("no persistence", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			resolve(b, i)
+		}
+	})
+	b.Run("background persistence", func(b *testing.B) {
+		// Marking the cache modified makes every tick write the whole file,
+		// the worst case for a busy resolver.
+		stop := make(chan struct{})
+		go dnsData.RunCachePersistence(stop, 10*time.Millisecond)
+		go func() {
+			ticker := time.NewTicker(time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					cache.MarkModified()
+				}
+			}
+		}()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			resolve(b, i)
+		}
+		b.StopTimer()
+		close(stop)
+	})
+	b.Run("save per query", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			resolve(b, i)
+			if err := dnsData.SaveCache(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestReverseNamesAreFiltered(t *testing.T) {
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, "blocked.txt")
+	if err := os.WriteFile(listPath, []byte("2.0.51.198.in-addr.arpa\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	zonePath := filepath.Join(dir, "rpz.zone")
+	zone := "$TTL 60\n@ SOA ns.rpz.test. admin.rpz.test. 1 3600 600 86400 60\n@ NS ns.rpz.test.\n3.0.51.198.in-addr.arpa CNAME .\n"
+	if err := os.WriteFile(zonePath, []byte(zone), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dnsData := data.GetInstance()
+	dnsData.GetBlocklist().Load(config.BlocklistSettings{Files: []string{listPath}})
+	dnsData.GetRPZ().Load([]config.RPZZone{{Name: "rpz.test.", File: zonePath}})
+	t.Cleanup(func() {
+		dnsData.GetBlocklist().Load(config.BlocklistSettings{})
+		dnsData.GetRPZ().Load(nil)
+	})
+
+	tests := []struct {
+		name      string
+		qname     string
+		wantRcode int
+	}{
+		{name: "blocklist", qname: "2.0.51.198.in-addr.arpa.", wantRcode: dns.RcodeNameError},
+		{name: "response policy zone", qname: "3.0.51.198.in-addr.arpa.", wantRcode: dns.RcodeNameError},
+		{name: "unfiltered", qname: "4.0.51.198.in-addr.arpa.", wantRcode: dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := new(dns.Msg)
+			request.SetQuestion(tt.qname, dns.TypePTR)
+			writer := newRecordingWriter("udp")
+			handleRequest(writer, request)
+			if writer.msg == nil {
+				t.Fatal("no response written")
+			}
+			if writer.msg.Rcode != tt.wantRcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[writer.msg.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			_, upstreamSaw := upstreamSubnets.Load(tt.qname)
+			if want := tt.wantRcode == dns.RcodeSuccess; upstreamSaw != want {
+				t.Errorf("sent upstream = %t, want %t", upstreamSaw, want)
+			}
+		})
+	}
+}
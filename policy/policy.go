@@ -0,0 +1,212 @@
+// Package policy applies allow and deny rules to queries before they are
+// answered from local records, the cache or upstreams.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Actions taken by a rule.
+const (
+	// ActionAllow answers the query normally, even when the name is on a
+	// blocklist.
+	ActionAllow = "allow"
+	// ActionDeny answers the query like a blocked one.
+	ActionDeny = "deny"
+)
+
+// Ways a rule matches names.
+const (
+	// MatchExact matches the name itself.
+	MatchExact = "exact"
+	// MatchWildcard matches names against a pattern where * stands for any
+	// run of characters and ? for one, so *.example.com matches every name
+	// below example.com.
+	MatchWildcard = "wildcard"
+	// MatchSuffix matches the domain and every name below it.
+	MatchSuffix = "suffix"
+	// MatchRegex matches names against a regular expression, ignoring case.
+	MatchRegex = "regex"
+)
+
+// Actions and Matches list the supported values.
+var (
+	Actions = []string{ActionAllow, ActionDeny}
+	Matches = []string{MatchExact, MatchWildcard, MatchSuffix, MatchRegex}
+)
+
+// Rule is an allow or deny rule as stored in policy.json.
+type Rule struct {
+	Action  string `json:"action"`
+	Match   string `json:"match"`
+	Pattern string `json:"pattern"`
+	// Types limits the rule to these query types; empty means every type.
+	Types   []string  `json:"types,omitempty"`
+	AddedOn time.Time `json:"added_on,omitempty"`
+}
+
+// String describes the rule, such as "deny suffix example.com (A, AAAA)".
+func (r Rule) String() string {
+	text := fmt.Sprintf("%s %s %s", r.Action, r.Match, r.Pattern)
+	if len(r.Types) > 0 {
+		text += " (" + strings.Join(r.Types, ", ") + ")"
+	}
+	return text
+}
+
+// Same reports whether both rules have the same action, match and pattern.
+func (r Rule) Same(other Rule) bool {
+	return r.Action == other.Action && r.Match == other.Match && r.Pattern == other.Pattern
+}
+
+// Validate checks the rule's action, match, pattern and types.
+func (r Rule) Validate() error {
+	_, err := compile(r)
+	return err
+}
+
+// Match is a rule that matched a query.
+type Match struct {
+	Rule Rule
+	// Number is the rule's position in the rule list, starting at 1.
+	Number int
+}
+
+type compiled struct {
+	rule   Rule
+	number int
+	// name is the canonical pattern for exact and suffix rules, and the
+	// lower-case pattern without trailing dot for wildcard rules.
+	name  string
+	regex *regexp.Regexp
+	types map[uint16]bool
+}
+
+// Policy holds compiled rules. It is never modified after Compile, so it can
+// be used by any number of queries while a new one is being built.
+type Policy struct {
+	rules []compiled
+}
+
+// Compile builds a policy from rules. Invalid rules are left out and reported
+// in the returned error.
+func Compile(rules []Rule) (*Policy, error) {
+	policy := &Policy{rules: make([]compiled, 0, len(rules))}
+	var errs []error
+	for i, rule := range rules {
+		c, err := compile(rule)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %d (%s): %w", i+1, rule, err))
+			continue
+		}
+		c.number = i + 1
+		policy.rules = append(policy.rules, c)
+	}
+	return policy, errors.Join(errs...)
+}
+
+func compile(rule Rule) (compiled, error) {
+	c := compiled{rule: rule}
+	if rule.Action != ActionAllow && rule.Action != ActionDeny {
+		return c, fmt.Errorf("invalid action %q (use %s)", rule.Action, strings.Join(Actions, " or "))
+	}
+	if rule.Pattern == "" {
+		return c, errors.New("pattern is required")
+	}
+	switch rule.Match {
+	case MatchExact, MatchSuffix:
+		c.name = dns.CanonicalName(rule.Pattern)
+		if _, ok := dns.IsDomainName(c.name); !ok {
+			return c, fmt.Errorf("invalid domain name %q", rule.Pattern)
+		}
+	case MatchWildcard:
+		c.name = strings.TrimSuffix(strings.ToLower(rule.Pattern), ".")
+		if _, err := path.Match(c.name, ""); err != nil {
+			return c, fmt.Errorf("invalid wildcard %q", rule.Pattern)
+		}
+	case MatchRegex:
+		// Names are matched in lower case, so the pattern ignores case to
+		// let ^Ads\. match like ^ads\. does.
+		regex, err := regexp.Compile("(?i)" + rule.Pattern)
+		if err != nil {
+			return c, fmt.Errorf("invalid regex %q: %v", rule.Pattern, err)
+		}
+		c.regex = regex
+	default:
+		return c, fmt.Errorf("invalid match %q (use %s)", rule.Match, strings.Join(Matches, ", "))
+	}
+	if len(rule.Types) > 0 {
+		c.types = make(map[uint16]bool, len(rule.Types))
+		for _, name := range rule.Types {
+			qtype, ok := dns.StringToType[strings.ToUpper(name)]
+			if !ok {
+				return c, fmt.Errorf("invalid query type %q", name)
+			}
+			c.types[qtype] = true
+		}
+	}
+	return c, nil
+}
+
+// Len returns the number of rules in use.
+func (p *Policy) Len() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.rules)
+}
+
+// Evaluate returns the rule deciding a query for name and qtype. Allow rules
+// take precedence over deny rules, so a narrow allow rule can make an
+// exception to a broad deny rule; otherwise the first matching rule wins.
+func (p *Policy) Evaluate(name string, qtype uint16) (Match, bool) {
+	if p == nil || len(p.rules) == 0 {
+		return Match{}, false
+	}
+	name = dns.CanonicalName(name)
+	bare := strings.TrimSuffix(name, ".")
+	var denied *compiled
+	for i := range p.rules {
+		rule := &p.rules[i]
+		if !rule.matches(name, bare, qtype) {
+			continue
+		}
+		if rule.rule.Action == ActionAllow {
+			return Match{Rule: rule.rule, Number: rule.number}, true
+		}
+		if denied == nil {
+			denied = rule
+		}
+	}
+	if denied == nil {
+		return Match{}, false
+	}
+	return Match{Rule: denied.rule, Number: denied.number}, true
+}
+
+// matches reports whether the rule applies to name, given canonical and
+// without its trailing dot as bare.
+func (c *compiled) matches(name, bare string, qtype uint16) bool {
+	if c.types != nil && !c.types[qtype] {
+		return false
+	}
+	switch c.rule.Match {
+	case MatchExact:
+		return name == c.name
+	case MatchSuffix:
+		return dns.IsSubDomain(c.name, name)
+	case MatchWildcard:
+		ok, _ := path.Match(c.name, bare)
+		return ok
+	case MatchRegex:
+		return c.regex.MatchString(bare)
+	}
+	return false
+}
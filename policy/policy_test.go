@@ -0,0 +1,145 @@
+package policy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestEvaluate(t *testing.T) {
+	policy, err := Compile([]Rule{
+		{Action: ActionDeny, Match: MatchSuffix, Pattern: "tracker.example.com"},
+		{Action: ActionAllow, Match: MatchExact, Pattern: "cdn.tracker.example.com", Types: []string{"A"}},
+		{Action: ActionDeny, Match: MatchWildcard, Pattern: "*.ads.example.net"},
+		{Action: ActionDeny, Match: MatchWildcard, Pattern: "ad?.example.org"},
+		{Action: ActionDeny, Match: MatchRegex, Pattern: `^Metrics[0-9]*\.`},
+		{Action: ActionDeny, Match: MatchExact, Pattern: "Exact.Example.COM"},
+		{Action: ActionAllow, Match: MatchWildcard, Pattern: "*.ok.ads.example.net"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		qtype uint16
+		// rule is the number of the deciding rule, 0 when none matches.
+		rule int
+	}{
+		{name: "tracker.example.com.", qtype: dns.TypeA, rule: 1},
+		{name: "a.b.tracker.example.com.", qtype: dns.TypeA, rule: 1},
+		{name: "nottracker.example.com.", qtype: dns.TypeA},
+		{name: "cdn.tracker.example.com.", qtype: dns.TypeA, rule: 2},
+		{name: "cdn.tracker.example.com.", qtype: dns.TypeAAAA, rule: 1},
+		{name: "x.ads.example.net.", qtype: dns.TypeA, rule: 3},
+		{name: "x.y.ads.example.net.", qtype: dns.TypeA, rule: 3},
+		{name: "ads.example.net.", qtype: dns.TypeA},
+		{name: "x.ok.ads.example.net.", qtype: dns.TypeA, rule: 7},
+		{name: "ad1.example.org.", qtype: dns.TypeA, rule: 4},
+		{name: "ad.example.org.", qtype: dns.TypeA},
+		{name: "ad12.example.org.", qtype: dns.TypeA},
+		{name: "metrics.example.com.", qtype: dns.TypeA, rule: 5},
+		{name: "METRICS42.example.com.", qtype: dns.TypeA, rule: 5},
+		{name: "www.metrics.example.com.", qtype: dns.TypeA},
+		{name: "exact.example.com", qtype: dns.TypeMX, rule: 6},
+		{name: "www.exact.example.com.", qtype: dns.TypeA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" "+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			match, ok := policy.Evaluate(tt.name, tt.qtype)
+			if got := match.Number; got != tt.rule || ok != (tt.rule != 0) {
+				t.Errorf("Evaluate(%s) = rule %d (%s), want rule %d", tt.name, got, match.Rule, tt.rule)
+			}
+		})
+	}
+}
+
+func TestCompileReportsInvalidRules(t *testing.T) {
+	tests := []struct {
+		rule Rule
+		err  string
+	}{
+		{rule: Rule{Action: "block", Match: MatchExact, Pattern: "example.com"}, err: "invalid action"},
+		{rule: Rule{Action: ActionDeny, Match: "prefix", Pattern: "example.com"}, err: "invalid match"},
+		{rule: Rule{Action: ActionDeny, Match: MatchExact}, err: "pattern is required"},
+		{rule: Rule{Action: ActionDeny, Match: MatchExact, Pattern: "bad..name"}, err: "invalid domain name"},
+		{rule: Rule{Action: ActionDeny, Match: MatchWildcard, Pattern: "[a-.example.com"}, err: "invalid wildcard"},
+		{rule: Rule{Action: ActionDeny, Match: MatchRegex, Pattern: "^(ads"}, err: "invalid regex"},
+		{rule: Rule{Action: ActionDeny, Match: MatchExact, Pattern: "example.com", Types: []string{"BOGUS"}}, err: "invalid query type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err, func(t *testing.T) {
+			valid := Rule{Action: ActionDeny, Match: MatchExact, Pattern: "valid.example.com"}
+			policy, err := Compile([]Rule{valid, tt.rule})
+			if err == nil || !strings.Contains(err.Error(), "rule 2") || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Compile error = %v, want rule 2: %s", err, tt.err)
+			}
+			if policy.Len() != 1 {
+				t.Errorf("Len() = %d, want the valid rule only", policy.Len())
+			}
+			if match, ok := policy.Evaluate("valid.example.com.", dns.TypeA); !ok || match.Number != 1 {
+				t.Errorf("valid rule not applied: %+v, %t", match, ok)
+			}
+		})
+	}
+}
+
+func TestAdd(t *testing.T) {
+	rules, _, err := Add([]string{"DENY", "Suffix", "tracker.example.com", "a", "aaaa"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Rule{Action: ActionDeny, Match: MatchSuffix, Pattern: "tracker.example.com"}
+	if len(rules) != 1 || !rules[0].Same(want) || strings.Join(rules[0].Types, ",") != "A,AAAA" {
+		t.Fatalf("rules = %+v, want %s (A, AAAA)", rules, want)
+	}
+
+	// Adding the same rule again replaces its query types.
+	rules, msgs, err := Add([]string{"deny", "suffix", "tracker.example.com"}, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].Types != nil || !strings.HasPrefix(msgs[0].Text, "Updated rule 1") {
+		t.Errorf("rules = %+v, messages = %+v, want rule 1 updated for every type", rules, msgs)
+	}
+
+	for _, args := range [][]string{
+		{"deny", "regex", "^(ads"},
+		{"deny", "suffix"},
+		{"allow", "exact", "example.com", "BOGUS"},
+	} {
+		updated, _, err := Add(args, rules)
+		if !errors.Is(err, ErrInvalidArgs) || len(updated) != 1 {
+			t.Errorf("Add(%q) = %d rules, %v, want ErrInvalidArgs", args, len(updated), err)
+		}
+	}
+	if _, _, err := Add([]string{"?"}, rules); !errors.Is(err, ErrHelpRequested) {
+		t.Errorf("Add(?) error = %v, want ErrHelpRequested", err)
+	}
+}
+
+func TestParseTest(t *testing.T) {
+	tests := []struct {
+		args  []string
+		name  string
+		qtype uint16
+		err   error
+	}{
+		{args: []string{"Ads.Example.com"}, name: "ads.example.com.", qtype: dns.TypeA},
+		{args: []string{"ads.example.com.", "aaaa"}, name: "ads.example.com.", qtype: dns.TypeAAAA},
+		{args: []string{"ads.example.com", "BOGUS"}, err: ErrInvalidArgs},
+		{args: []string{"bad..name"}, err: ErrInvalidArgs},
+		{args: nil, err: ErrInvalidArgs},
+		{args: []string{"a.example.com", "A", "extra"}, err: ErrInvalidArgs},
+		{args: []string{"help"}, err: ErrHelpRequested},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			name, qtype, _, err := ParseTest(tt.args)
+			if !errors.Is(err, tt.err) || name != tt.name || qtype != tt.qtype {
+				t.Errorf("ParseTest(%q) = %q, %d, %v, want %q, %d, %v", tt.args, name, qtype, err, tt.name, tt.qtype, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"dnsplane/cliutil"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	ErrHelpRequested = errors.New("help requested")
+	ErrInvalidArgs   = errors.New("invalid arguments")
+)
+
+type Level string
+
+const (
+	LevelInfo  Level = "info"
+	LevelWarn  Level = "warn"
+	LevelError Level = "error"
+)
+
+type Message struct {
+	Level Level
+	Text  string
+}
+
+// Add returns rules with the rule described by fullCommand appended. Adding
+// a rule that exists with the same action, match and pattern replaces its
+// query types.
+func Add(fullCommand []string, rules []Rule) ([]Rule, []Message, error) {
+	if cliutil.IsHelpRequest(fullCommand) {
+		return rules, usageAdd(), ErrHelpRequested
+	}
+	if len(fullCommand) < 3 {
+		msgs := append([]Message{{Level: LevelError, Text: "action, match and pattern are required"}}, usageAdd()...)
+		return rules, msgs, ErrInvalidArgs
+	}
+	rule := Rule{
+		Action:  strings.ToLower(fullCommand[0]),
+		Match:   strings.ToLower(fullCommand[1]),
+		Pattern: fullCommand[2],
+		AddedOn: time.Now(),
+	}
+	for _, qtype := range fullCommand[3:] {
+		rule.Types = append(rule.Types, strings.ToUpper(qtype))
+	}
+	if err := rule.Validate(); err != nil {
+		msgs := append([]Message{{Level: LevelError, Text: err.Error()}}, usageAdd()...)
+		return rules, msgs, ErrInvalidArgs
+	}
+	updated := append([]Rule(nil), rules...)
+	for i, existing := range updated {
+		if existing.Same(rule) {
+			updated[i].Types = rule.Types
+			return updated, []Message{{Level: LevelInfo, Text: fmt.Sprintf("Updated rule %d: %s", i+1, updated[i])}}, nil
+		}
+	}
+	updated = append(updated, rule)
+	return updated, []Message{{Level: LevelInfo, Text: fmt.Sprintf("Added rule %d: %s", len(updated), rule)}}, nil
+}
+
+// Remove returns rules without the rule named in fullCommand, either by its
+// number in the rule list or by its action, match and pattern.
+func Remove(fullCommand []string, rules []Rule) ([]Rule, []Message, error) {
+	if cliutil.IsHelpRequest(fullCommand) {
+		return rules, usageRemove(), ErrHelpRequested
+	}
+	index := -1
+	switch len(fullCommand) {
+	case 1:
+		number, err := strconv.Atoi(fullCommand[0])
+		if err != nil || number < 1 || number > len(rules) {
+			msgs := append([]Message{{Level: LevelWarn, Text: fmt.Sprintf("Rule not found: %s", fullCommand[0])}}, usageRemove()...)
+			return rules, msgs, ErrInvalidArgs
+		}
+		index = number - 1
+	case 3:
+		target := Rule{Action: strings.ToLower(fullCommand[0]), Match: strings.ToLower(fullCommand[1]), Pattern: fullCommand[2]}
+		for i, existing := range rules {
+			if existing.Same(target) {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			msgs := append([]Message{{Level: LevelWarn, Text: fmt.Sprintf("Rule not found: %s", target)}}, usageRemove()...)
+			return rules, msgs, ErrInvalidArgs
+		}
+	default:
+		msgs := append([]Message{{Level: LevelError, Text: "a rule number or action, match and pattern are required"}}, usageRemove()...)
+		return rules, msgs, ErrInvalidArgs
+	}
+	removed := rules[index]
+	updated := append(append([]Rule(nil), rules[:index]...), rules[index+1:]...)
+	return updated, []Message{{Level: LevelInfo, Text: fmt.Sprintf("Removed rule %d: %s", index+1, removed)}}, nil
+}
+
+// ParseTest reads the name and optional query type, A by default, of a
+// policy test command.
+func ParseTest(fullCommand []string) (string, uint16, []Message, error) {
+	if cliutil.IsHelpRequest(fullCommand) {
+		return "", 0, usageTest(), ErrHelpRequested
+	}
+	if len(fullCommand) == 0 || len(fullCommand) > 2 {
+		msgs := append([]Message{{Level: LevelError, Text: "a name and an optional type are required"}}, usageTest()...)
+		return "", 0, msgs, ErrInvalidArgs
+	}
+	name := dns.CanonicalName(fullCommand[0])
+	if _, ok := dns.IsDomainName(name); !ok {
+		msgs := append([]Message{{Level: LevelError, Text: fmt.Sprintf("invalid domain name: %s", fullCommand[0])}}, usageTest()...)
+		return "", 0, msgs, ErrInvalidArgs
+	}
+	qtype := dns.TypeA
+	if len(fullCommand) == 2 {
+		value, ok := dns.StringToType[strings.ToUpper(fullCommand[1])]
+		if !ok {
+			msgs := append([]Message{{Level: LevelError, Text: fmt.Sprintf("invalid query type: %s", fullCommand[1])}}, usageTest()...)
+			return "", 0, msgs, ErrInvalidArgs
+		}
+		qtype = value
+	}
+	return name, qtype, nil, nil
+}
+
+func usageAdd() []Message {
+	msgs := []Message{
+		{Level: LevelInfo, Text: "Usage  : policy add <allow|deny> <exact|wildcard|suffix|regex> <Pattern> [Type...]"},
+		{Level: LevelInfo, Text: "Example: policy add deny suffix tracker.example.com"},
+		{Level: LevelInfo, Text: "Example: policy add allow exact cdn.tracker.example.com A AAAA"},
+		{Level: LevelInfo, Text: "Example: policy add deny regex ^ads[0-9]*\\."},
+		{Level: LevelInfo, Text: "Wildcards use * and ?, so *.example.com matches every name below example.com. Regexes are matched against the name without its trailing dot, ignoring case."},
+	}
+	return append(msgs, helpHint())
+}
+
+func usageRemove() []Message {
+	msgs := []Message{
+		{Level: LevelInfo, Text: "Usage  : policy remove <Number> | <allow|deny> <Match> <Pattern>"},
+		{Level: LevelInfo, Text: "Example: policy remove 2"},
+		{Level: LevelInfo, Text: "Example: policy remove deny suffix tracker.example.com"},
+	}
+	return append(msgs, helpHint())
+}
+
+func usageTest() []Message {
+	msgs := []Message{
+		{Level: LevelInfo, Text: "Usage  : policy test <Name> [Type]"},
+		{Level: LevelInfo, Text: "Example: policy test ads.example.com AAAA"},
+	}
+	return append(msgs, helpHint())
+}
+
+func helpHint() Message {
+	return Message{Level: LevelInfo, Text: "Hint: append '?', 'help', or 'h' after the command to view this usage."}
+}
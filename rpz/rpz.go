@@ -0,0 +1,486 @@
+package rpz
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dnsplane/config"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultRefreshInterval is how often a primary is checked for a new
+	// serial when neither the configuration nor the zone's SOA say.
+	defaultRefreshInterval = time.Hour
+	// failedRetryInterval is how soon a failed transfer is retried when the
+	// refresh interval is longer.
+	failedRetryInterval = 15 * time.Minute
+	// transferTimeout bounds connecting to and reading from a primary.
+	transferTimeout = 30 * time.Second
+	// maxNegativeTTL caps the TTL of the SOA sent with NXDOMAIN and NODATA
+	// answers.
+	maxNegativeTTL = 60
+)
+
+// Hit is a rule that matched a query.
+type Hit struct {
+	// Zone is the policy name of the zone holding the rule.
+	Zone    string
+	Trigger string
+	// Rule is the trigger as written in the zone, such as *.example.com or
+	// 32.1.2.0.192.rpz-ip.
+	Rule   string
+	Action string
+
+	data []dns.RR
+	soa  *dns.SOA
+}
+
+// String describes the hit for logging, such as
+// "rpz.example.net QNAME *.example.com NXDOMAIN".
+func (h Hit) String() string {
+	return fmt.Sprintf("%s %s %s %s", h.Zone, h.Trigger, h.Rule, h.Action)
+}
+
+// Rewrites reports whether the hit changes the answer. PASSTHRU hits leave
+// it alone.
+func (h Hit) Rewrites() bool {
+	return h.Action != ActionPassthru
+}
+
+// Apply answers question in response as the hit's action says and returns
+// a short description of the answer for logging. When the answer is a CNAME
+// from local data, target is the name it points to, which should be resolved
+// to complete the answer. DROP and PASSTHRU hits leave response unchanged.
+func (h Hit) Apply(question dns.Question, response *dns.Msg) (reply, target string) {
+	switch h.Action {
+	case ActionNXDOMAIN:
+		response.Rcode = dns.RcodeNameError
+		h.addSOA(response)
+		return "NXDOMAIN", ""
+	case ActionNODATA:
+		h.addSOA(response)
+		return "NODATA", ""
+	case ActionLocalData:
+		return h.localData(question, response)
+	}
+	return h.Action, ""
+}
+
+func (h Hit) localData(question dns.Question, response *dns.Msg) (reply, target string) {
+	var answers []dns.RR
+	for _, rr := range h.data {
+		rr = dns.Copy(rr)
+		rr.Header().Name = question.Name
+		if cname, ok := rr.(*dns.CNAME); ok {
+			// A wildcard target keeps the query name in front of the
+			// domain, such as *.garden.example.net.
+			if domain, wildcard := strings.CutPrefix(cname.Target, "*."); wildcard {
+				cname.Target = question.Name + domain
+			}
+			response.Answer = append(response.Answer, cname)
+			if question.Qtype == dns.TypeCNAME {
+				return "CNAME " + cname.Target, ""
+			}
+			return "CNAME " + cname.Target, cname.Target
+		}
+		if question.Qtype == dns.TypeANY || rr.Header().Rrtype == question.Qtype {
+			answers = append(answers, rr)
+		}
+	}
+	if len(answers) == 0 {
+		h.addSOA(response)
+		return "NODATA", ""
+	}
+	response.Answer = append(response.Answer, answers...)
+	return fmt.Sprintf("%d local records", len(answers)), ""
+}
+
+func (h Hit) addSOA(response *dns.Msg) {
+	if h.soa == nil {
+		return
+	}
+	soa := dns.Copy(h.soa).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl, maxNegativeTTL)
+	response.Ns = append(response.Ns, soa)
+}
+
+func newHit(zone *Zone, trigger string, rule *Rule) Hit {
+	return Hit{Zone: zone.Name, Trigger: trigger, Rule: rule.Owner, Action: rule.Action, data: rule.Data, soa: zone.SOA}
+}
+
+// Status describes one configured zone.
+type Status struct {
+	Name string `json:"name"`
+	// Source is the zone file, or the primary for transferred zones.
+	Source  string    `json:"source"`
+	Serial  uint32    `json:"serial"`
+	Rules   int       `json:"rules"`
+	Skipped int       `json:"skipped,omitempty"`
+	Loaded  time.Time `json:"loaded,omitempty"`
+	// Checked is when the primary was last asked for a new serial.
+	Checked time.Time `json:"checked,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type loadedZone struct {
+	zone   *Zone
+	status Status
+}
+
+// Policies holds the configured zones in order of precedence. Lookups use an
+// immutable list of zones that is replaced as a whole when a zone changes.
+type Policies struct {
+	zones atomic.Pointer[[]*Zone]
+
+	mu        sync.Mutex
+	loaded    map[string]*loadedZone
+	order     []string
+	refreshMu sync.Mutex
+}
+
+// New returns policies without zones.
+func New() *Policies {
+	return &Policies{loaded: make(map[string]*loadedZone)}
+}
+
+// Len returns the number of rules in use.
+func (p *Policies) Len() int {
+	total := 0
+	if zones := p.zones.Load(); zones != nil {
+		for _, zone := range *zones {
+			total += zone.Rules
+		}
+	}
+	return total
+}
+
+// MatchQName returns the rule for a query name from the first zone that has
+// one.
+func (p *Policies) MatchQName(name string) (Hit, bool) {
+	zones := p.zones.Load()
+	if zones == nil {
+		return Hit{}, false
+	}
+	name = dns.CanonicalName(name)
+	for _, zone := range *zones {
+		if rule, ok := zone.matchQName(name); ok {
+			return newHit(zone, TriggerQName, rule), true
+		}
+	}
+	return Hit{}, false
+}
+
+// MatchResponse returns the rule matching a reply from the first zone that
+// has one. IP triggers are checked against the A and AAAA records in answer
+// and NSDNAME triggers against the NS records in answer and authority. As
+// queries are forwarded rather than resolved iteratively, name servers are
+// only known when the upstream includes them in its reply.
+func (p *Policies) MatchResponse(answer, authority []dns.RR) (Hit, bool) {
+	zones := p.zones.Load()
+	if zones == nil {
+		return Hit{}, false
+	}
+	for _, zone := range *zones {
+		if len(zone.ipBits) > 0 {
+			for _, rr := range answer {
+				var addr netip.Addr
+				switch record := rr.(type) {
+				case *dns.A:
+					addr, _ = netip.AddrFromSlice(record.A)
+				case *dns.AAAA:
+					addr, _ = netip.AddrFromSlice(record.AAAA)
+				default:
+					continue
+				}
+				if rule, _, ok := zone.matchIP(addr); ok {
+					return newHit(zone, TriggerIP, rule), true
+				}
+			}
+		}
+		if len(zone.ns) == 0 && len(zone.nsWildcard) == 0 {
+			continue
+		}
+		for _, section := range [][]dns.RR{answer, authority} {
+			for _, rr := range section {
+				ns, ok := rr.(*dns.NS)
+				if !ok {
+					continue
+				}
+				if rule, ok := zone.matchNS(dns.CanonicalName(ns.Ns)); ok {
+					return newHit(zone, TriggerNSDName, rule), true
+				}
+			}
+		}
+	}
+	return Hit{}, false
+}
+
+// Load reads the zone file of every configured zone, replacing the zones
+// loaded before. Nothing is transferred here; see Transfer. A zone that
+// cannot be read keeps the rules it had before, if any, and reports the
+// error in its status.
+func (p *Policies) Load(zones []config.RPZZone) []Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	loaded := make(map[string]*loadedZone, len(zones))
+	order := make([]string, 0, len(zones))
+	for _, settings := range zones {
+		if _, seen := loaded[settings.Name]; seen {
+			continue
+		}
+		current := loadZone(settings)
+		if current.zone == nil {
+			if previous, ok := p.loaded[settings.Name]; ok && previous.zone != nil {
+				current.zone = previous.zone
+				current.status.Serial = previous.status.Serial
+				current.status.Rules = previous.status.Rules
+				current.status.Skipped = previous.status.Skipped
+				current.status.Loaded = previous.status.Loaded
+			}
+		}
+		if previous, ok := p.loaded[settings.Name]; ok {
+			current.status.Checked = previous.status.Checked
+		}
+		loaded[settings.Name] = current
+		order = append(order, settings.Name)
+	}
+	p.loaded = loaded
+	p.order = order
+	p.publish()
+	return p.statusLocked()
+}
+
+func loadZone(settings config.RPZZone) *loadedZone {
+	current := &loadedZone{status: Status{Name: settings.Name, Source: settings.File}}
+	if settings.Primary != "" {
+		current.status.Source = settings.Primary
+	}
+	file, err := os.Open(settings.File)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && settings.Primary != "" {
+			current.status.Error = "not transferred yet"
+			return current
+		}
+		current.status.Error = err.Error()
+		return current
+	}
+	defer file.Close()
+	zone, err := Parse(file, settings.Name, settings.File)
+	if err != nil {
+		current.status.Error = err.Error()
+		return current
+	}
+	current.setZone(zone)
+	return current
+}
+
+func (l *loadedZone) setZone(zone *Zone) {
+	l.zone = zone
+	l.status.Serial = zone.Serial()
+	l.status.Rules = zone.Rules
+	l.status.Skipped = zone.Skipped
+	l.status.Loaded = time.Now()
+	l.status.Error = ""
+}
+
+// Status returns the state of every zone in order of precedence.
+func (p *Policies) Status() []Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.statusLocked()
+}
+
+func (p *Policies) statusLocked() []Status {
+	statuses := make([]Status, 0, len(p.order))
+	for _, name := range p.order {
+		statuses = append(statuses, p.loaded[name].status)
+	}
+	return statuses
+}
+
+// publish swaps in the zones currently loaded for lookups.
+func (p *Policies) publish() {
+	zones := make([]*Zone, 0, len(p.order))
+	for _, name := range p.order {
+		if zone := p.loaded[name].zone; zone != nil {
+			zones = append(zones, zone)
+		}
+	}
+	p.zones.Store(&zones)
+}
+
+// RefreshDue transfers every zone with a primary whose refresh interval has
+// passed since it was last checked, and returns the state of those zones.
+func (p *Policies) RefreshDue(zones []config.RPZZone) []Status {
+	var refreshed []Status
+	for _, settings := range zones {
+		if settings.Primary == "" {
+			continue
+		}
+		status, serialRefresh, ok := p.refreshState(settings.Name)
+		if !ok {
+			continue
+		}
+		wait := time.Duration(settings.RefreshInterval) * time.Second
+		if wait <= 0 {
+			wait = serialRefresh
+		}
+		if status.Error != "" && wait > failedRetryInterval {
+			wait = failedRetryInterval
+		}
+		if !status.Checked.IsZero() && time.Since(status.Checked) < wait {
+			continue
+		}
+		refreshed = append(refreshed, p.Transfer(settings))
+	}
+	return refreshed
+}
+
+// refreshState returns the status of a zone and the refresh interval from
+// its SOA.
+func (p *Policies) refreshState(name string) (Status, time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current, ok := p.loaded[name]
+	if !ok {
+		return Status{}, 0, false
+	}
+	refresh := defaultRefreshInterval
+	if current.zone != nil && current.zone.SOA != nil && current.zone.SOA.Refresh > 0 {
+		refresh = time.Duration(current.zone.SOA.Refresh) * time.Second
+	}
+	return current.status, refresh, true
+}
+
+// Transfer fetches the zone from its primary with AXFR when the primary has
+// a different serial, saves it to the zone file and swaps in its rules. A
+// failed transfer keeps the rules the zone had and reports the error in its
+// status.
+func (p *Policies) Transfer(settings config.RPZZone) Status {
+	p.refreshMu.Lock()
+	defer p.refreshMu.Unlock()
+	if settings.Primary == "" {
+		return Status{Name: settings.Name, Source: settings.File, Error: "zone has no primary"}
+	}
+	status, _, ok := p.refreshState(settings.Name)
+	if !ok {
+		return Status{Name: settings.Name, Source: settings.Primary, Error: "not a configured zone"}
+	}
+	checked := time.Now()
+	zone, err := transfer(settings, status)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current, ok := p.loaded[settings.Name]
+	if !ok {
+		return Status{Name: settings.Name, Source: settings.Primary, Error: "not a configured zone"}
+	}
+	current.status.Checked = checked
+	if err != nil {
+		current.status.Error = err.Error()
+		return current.status
+	}
+	current.status.Error = ""
+	if zone != nil {
+		current.setZone(zone)
+		p.publish()
+	}
+	return current.status
+}
+
+// transfer returns the zone from its primary, or nil when the primary's
+// serial matches the zone already loaded.
+func transfer(settings config.RPZZone, status Status) (*Zone, error) {
+	origin := dns.CanonicalName(settings.Name)
+	if status.Rules > 0 || status.Serial > 0 {
+		if serial, err := primarySerial(settings.Primary, origin); err == nil && serial == status.Serial {
+			return nil, nil
+		}
+	}
+	request := new(dns.Msg)
+	request.SetAxfr(origin)
+	client := &dns.Transfer{DialTimeout: transferTimeout, ReadTimeout: transferTimeout}
+	envelopes, err := client.In(request, settings.Primary)
+	if err != nil {
+		return nil, err
+	}
+	var records []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, envelope.Error
+		}
+		records = append(records, envelope.RR...)
+	}
+	zone, err := FromRecords(records, settings.Name)
+	if err != nil {
+		return nil, err
+	}
+	if settings.File != "" {
+		if err := saveZone(settings.File, records, settings.Primary); err != nil {
+			return nil, fmt.Errorf("save %s: %w", settings.File, err)
+		}
+	}
+	return zone, nil
+}
+
+// primarySerial asks the primary for the serial of the zone at origin.
+func primarySerial(primary, origin string) (uint32, error) {
+	request := new(dns.Msg)
+	request.SetQuestion(origin, dns.TypeSOA)
+	client := &dns.Client{Timeout: transferTimeout}
+	reply, _, err := client.Exchange(request, primary)
+	if err != nil {
+		return 0, err
+	}
+	for _, rr := range reply.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("no SOA for %s from %s", origin, primary)
+}
+
+// saveZone writes a transferred zone to path, so that it is available at the
+// next start even when the primary is not. The file is written to a temporary
+// file first and renamed into place.
+func saveZone(path string, records []dns.RR, primary string) error {
+	var content strings.Builder
+	fmt.Fprintf(&content, "; transferred from %s at %s\n", primary, time.Now().UTC().Format(time.RFC3339))
+	for i, rr := range records {
+		// The SOA is sent both first and last.
+		if _, ok := rr.(*dns.SOA); ok && i > 0 {
+			continue
+		}
+		content.WriteString(rr.String())
+		content.WriteByte('\n')
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(dir, ".zone-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.WriteString(content.String()); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
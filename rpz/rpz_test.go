@@ -0,0 +1,198 @@
+package rpz
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"dnsplane/config"
+
+	"github.com/miekg/dns"
+)
+
+// loadPolicy loads testdata/policy.zone as the zone rpz.test.
+func loadPolicy(t *testing.T) *Policies {
+	t.Helper()
+	policies := New()
+	status := policies.Load([]config.RPZZone{{Name: "rpz.test", File: "testdata/policy.zone"}})
+	if status[0].Error != "" {
+		t.Fatalf("load: %s", status[0].Error)
+	}
+	if status[0].Serial != 7 || status[0].Rules != 14 || status[0].Skipped != 2 {
+		t.Fatalf("status = %+v, want serial 7, 14 rules, 2 skipped", status[0])
+	}
+	return policies
+}
+
+func TestMatchQName(t *testing.T) {
+	policies := loadPolicy(t)
+	tests := []struct {
+		name   string
+		qtype  uint16
+		action string
+		rule   string
+		// rcode, reply and answer describe the response after Apply.
+		rcode  int
+		reply  string
+		answer string
+	}{
+		{name: "nx.example.com.", qtype: dns.TypeA, action: ActionNXDOMAIN, rule: "nx.example.com", rcode: dns.RcodeNameError, reply: "NXDOMAIN"},
+		{name: "NX.Example.COM.", qtype: dns.TypeA, action: ActionNXDOMAIN, rule: "nx.example.com", rcode: dns.RcodeNameError, reply: "NXDOMAIN"},
+		{name: "nodata.example.com.", qtype: dns.TypeAAAA, action: ActionNODATA, rule: "nodata.example.com", reply: "NODATA"},
+		{name: "pass.ads.example.com.", qtype: dns.TypeA, action: ActionPassthru, rule: "pass.ads.example.com", reply: ActionPassthru},
+		{name: "tracker.ads.example.com.", qtype: dns.TypeA, action: ActionNXDOMAIN, rule: "*.ads.example.com", rcode: dns.RcodeNameError, reply: "NXDOMAIN"},
+		{name: "a.b.ads.example.com.", qtype: dns.TypeA, action: ActionNXDOMAIN, rule: "*.ads.example.com", rcode: dns.RcodeNameError, reply: "NXDOMAIN"},
+		{name: "ads.example.com.", qtype: dns.TypeA},
+		{name: "drop.example.com.", qtype: dns.TypeA, action: ActionDrop, rule: "drop.example.com", reply: ActionDrop},
+		{name: "garden.example.com.", qtype: dns.TypeA, action: ActionLocalData, rule: "garden.example.com", reply: "CNAME walled.example.net.", answer: "garden.example.com.\t300\tIN\tCNAME\twalled.example.net."},
+		{name: "buy.shops.example.com.", qtype: dns.TypeA, action: ActionLocalData, rule: "*.shops.example.com", reply: "CNAME buy.shops.example.com.garden.example.net.", answer: "buy.shops.example.com.\t300\tIN\tCNAME\tbuy.shops.example.com.garden.example.net."},
+		{name: "local.example.com.", qtype: dns.TypeAAAA, action: ActionLocalData, rule: "local.example.com", reply: "1 local records", answer: "local.example.com.\t300\tIN\tAAAA\t2001:db8::80"},
+		{name: "local.example.com.", qtype: dns.TypeMX, action: ActionLocalData, rule: "local.example.com", reply: "NODATA"},
+		{name: "tcp.example.com.", qtype: dns.TypeA},
+		{name: "example.com.", qtype: dns.TypeA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" "+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			hit, ok := policies.MatchQName(tt.name)
+			if ok != (tt.action != "") {
+				t.Fatalf("MatchQName(%s) matched = %t, want %t", tt.name, ok, tt.action != "")
+			}
+			if !ok {
+				return
+			}
+			if hit.Action != tt.action || hit.Rule != tt.rule || hit.Zone != "rpz.test" || hit.Trigger != TriggerQName {
+				t.Errorf("hit = %s, want rpz.test QNAME %s %s", hit, tt.rule, tt.action)
+			}
+			if hit.Rewrites() != (tt.action != ActionPassthru) {
+				t.Errorf("Rewrites() = %t for %s", hit.Rewrites(), tt.action)
+			}
+
+			question := dns.Question{Name: dns.Fqdn(strings.ToLower(tt.name)), Qtype: tt.qtype, Qclass: dns.ClassINET}
+			response := new(dns.Msg)
+			response.SetQuestion(question.Name, question.Qtype)
+			reply, _ := hit.Apply(question, response)
+			if reply != tt.reply || response.Rcode != tt.rcode {
+				t.Errorf("Apply = %q rcode %s, want %q rcode %s", reply, dns.RcodeToString[response.Rcode], tt.reply, dns.RcodeToString[tt.rcode])
+			}
+			var answer []string
+			for _, rr := range response.Answer {
+				answer = append(answer, rr.String())
+			}
+			if got := strings.Join(answer, "\n"); got != tt.answer {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+			if tt.reply == "NXDOMAIN" || tt.reply == "NODATA" {
+				if len(response.Ns) != 1 || response.Ns[0].Header().Ttl != 60 {
+					t.Errorf("authority = %v, want the zone SOA with TTL 60", response.Ns)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchResponseIP(t *testing.T) {
+	policies := loadPolicy(t)
+	tests := []struct {
+		record string
+		action string
+		rule   string
+	}{
+		{record: "www.example.org. 60 IN A 192.0.2.9", action: ActionNXDOMAIN, rule: "24.0.2.0.192.rpz-ip"},
+		{record: "www.example.org. 60 IN A 192.0.2.7", action: ActionPassthru, rule: "32.7.2.0.192.rpz-ip"},
+		{record: "www.example.org. 60 IN AAAA ::ffff:192.0.2.7", action: ActionPassthru, rule: "32.7.2.0.192.rpz-ip"},
+		{record: "www.example.org. 60 IN AAAA 2001:db8:0:5::1", action: ActionNXDOMAIN, rule: "48.zz.db8.2001.rpz-ip"},
+		{record: "www.example.org. 60 IN AAAA 2001:db8:0:1::5", action: ActionNODATA, rule: "64.1.0.db8.2001.rpz-ip"},
+		{record: "www.example.org. 60 IN A 198.51.100.1"},
+		{record: "www.example.org. 60 IN AAAA 2001:db9::1"},
+		{record: "www.example.org. 60 IN TXT \"192.0.2.9\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.record, func(t *testing.T) {
+			rr, err := dns.NewRR(tt.record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hit, ok := policies.MatchResponse([]dns.RR{rr}, nil)
+			if ok != (tt.action != "") {
+				t.Fatalf("matched = %t, want %t", ok, tt.action != "")
+			}
+			if ok && (hit.Action != tt.action || hit.Rule != tt.rule || hit.Trigger != TriggerIP) {
+				t.Errorf("hit = %s, want rpz.test IP %s %s", hit, tt.rule, tt.action)
+			}
+		})
+	}
+}
+
+func TestMatchResponseNSDName(t *testing.T) {
+	policies := loadPolicy(t)
+	tests := []struct {
+		ns     string
+		action string
+		rule   string
+	}{
+		{ns: "ns.bad.example.net.", action: ActionNXDOMAIN, rule: "ns.bad.example.net.rpz-nsdname"},
+		{ns: "NS1.Evil.example.net.", action: ActionDrop, rule: "*.evil.example.net.rpz-nsdname"},
+		{ns: "evil.example.net."},
+		{ns: "ns.good.example.net."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ns, func(t *testing.T) {
+			rr, err := dns.NewRR("example.org. 3600 IN NS " + tt.ns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hit, ok := policies.MatchResponse(nil, []dns.RR{rr})
+			if ok != (tt.action != "") {
+				t.Fatalf("matched = %t, want %t", ok, tt.action != "")
+			}
+			if ok && (hit.Action != tt.action || hit.Rule != tt.rule || hit.Trigger != TriggerNSDName) {
+				t.Errorf("hit = %s, want rpz.test NSDNAME %s %s", hit, tt.rule, tt.action)
+			}
+		})
+	}
+}
+
+func TestZoneWithoutSOAIsRejected(t *testing.T) {
+	policies := New()
+	status := policies.Load([]config.RPZZone{{Name: "rpz.test", File: "testdata/nosoa.zone"}})
+	if !strings.Contains(status[0].Error, "no SOA") {
+		t.Errorf("status error = %q, want a missing SOA error", status[0].Error)
+	}
+	if policies.Len() != 0 {
+		t.Errorf("%d rules in use from a rejected zone", policies.Len())
+	}
+}
+
+func TestParseIPTrigger(t *testing.T) {
+	tests := []struct {
+		trigger string
+		want    string
+	}{
+		{trigger: "24.0.2.0.192", want: "192.0.2.0/24"},
+		{trigger: "32.1.0.0.127", want: "127.0.0.1/32"},
+		{trigger: "0.0.0.0.0", want: "0.0.0.0/0"},
+		{trigger: "64.zz.db8.2001", want: "2001:db8::/64"},
+		{trigger: "128.1.zz.db8.2001", want: "2001:db8::1/128"},
+		{trigger: "48.0.0.db8.2001", want: "2001:db8::/48"},
+		{trigger: "64.1.0.db8.2001", want: "2001:db8:0:1::/64"},
+		{trigger: "128.1.0.0.0.0.0.db8.2001", want: "2001:db8::1/128"},
+		{trigger: "24.1.2.0.192"},
+		{trigger: "33.0.2.0.192"},
+		{trigger: "24.0.2.192"},
+		{trigger: "x.0.2.0.192"},
+		{trigger: "24"},
+		{trigger: "64.zz.db8.zz.2001"},
+		{trigger: "48.1.0.db8.2001"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.trigger, func(t *testing.T) {
+			prefix, ok := parseIPTrigger(tt.trigger)
+			if want := tt.want != ""; ok != want {
+				t.Fatalf("parseIPTrigger(%s) = %s, %t, want ok %t", tt.trigger, prefix, ok, want)
+			}
+			if ok && prefix != netip.MustParsePrefix(tt.want) {
+				t.Errorf("parseIPTrigger(%s) = %s, want %s", tt.trigger, prefix, tt.want)
+			}
+		})
+	}
+}
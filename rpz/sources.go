@@ -0,0 +1,164 @@
+package rpz
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"dnsplane/cliutil"
+	"dnsplane/config"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	ErrHelpRequested = errors.New("help requested")
+	ErrInvalidArgs   = errors.New("invalid arguments")
+)
+
+type Level string
+
+const (
+	LevelInfo  Level = "info"
+	LevelWarn  Level = "warn"
+	LevelError Level = "error"
+)
+
+type Message struct {
+	Level Level
+	Text  string
+}
+
+// Add returns zones with the zone described by fullCommand appended, or
+// updated when a zone of that name exists. A zone needs a file, a primary to
+// transfer it from, or both; relative files are resolved against baseDir.
+func Add(fullCommand []string, zones []config.RPZZone, baseDir string) ([]config.RPZZone, []Message, error) {
+	if cliutil.IsHelpRequest(fullCommand) {
+		return zones, usageAdd(), ErrHelpRequested
+	}
+	if len(fullCommand) < 2 {
+		msgs := append([]Message{{Level: LevelError, Text: "a zone name and a file or primary are required"}}, usageAdd()...)
+		return zones, msgs, ErrInvalidArgs
+	}
+	name := strings.TrimSuffix(dns.CanonicalName(fullCommand[0]), ".")
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		msgs := append([]Message{{Level: LevelError, Text: fmt.Sprintf("invalid zone name: %s", fullCommand[0])}}, usageAdd()...)
+		return zones, msgs, ErrInvalidArgs
+	}
+	zone := config.RPZZone{Name: name}
+	for _, option := range fullCommand[1:] {
+		if err := applyOption(&zone, option, baseDir); err != nil {
+			msgs := append([]Message{{Level: LevelError, Text: err.Error()}}, usageAdd()...)
+			return zones, msgs, ErrInvalidArgs
+		}
+	}
+	switch {
+	case zone.File == "" && zone.Primary == "":
+		msgs := append([]Message{{Level: LevelError, Text: "a file or primary is required"}}, usageAdd()...)
+		return zones, msgs, ErrInvalidArgs
+	case zone.File == "":
+		zone.File = filepath.Join(baseDir, "rpz", name+".zone")
+	case zone.Primary == "":
+		if _, err := os.Stat(zone.File); err != nil {
+			msgs := append([]Message{{Level: LevelError, Text: fmt.Sprintf("cannot read %s: %v", zone.File, err)}}, usageAdd()...)
+			return zones, msgs, ErrInvalidArgs
+		}
+	}
+	updated := append([]config.RPZZone(nil), zones...)
+	for i, existing := range updated {
+		if existing.Name == name {
+			updated[i] = zone
+			return updated, []Message{{Level: LevelInfo, Text: fmt.Sprintf("Updated response policy zone %s", name)}}, nil
+		}
+	}
+	updated = append(updated, zone)
+	return updated, []Message{{Level: LevelInfo, Text: fmt.Sprintf("Added response policy zone %s", name)}}, nil
+}
+
+// applyOption applies a key=value option such as primary=192.0.2.1:53.
+func applyOption(zone *config.RPZZone, option, baseDir string) error {
+	key, value, _ := strings.Cut(option, "=")
+	key = strings.ToLower(strings.TrimSpace(key))
+	value = strings.TrimSpace(value)
+	switch key {
+	case "file":
+		if value == "" {
+			return errors.New("file must not be empty")
+		}
+		if !filepath.IsAbs(value) {
+			value = filepath.Join(baseDir, value)
+		}
+		zone.File = value
+	case "primary":
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			value = net.JoinHostPort(value, "53")
+		}
+		host, _, _ := net.SplitHostPort(value)
+		if host == "" {
+			return fmt.Errorf("invalid primary: %s", value)
+		}
+		zone.Primary = value
+	case "refresh":
+		interval, err := time.ParseDuration(value)
+		if seconds, convErr := strconv.Atoi(value); convErr == nil {
+			interval, err = time.Duration(seconds)*time.Second, nil
+		}
+		if err != nil || interval < time.Minute {
+			return fmt.Errorf("invalid refresh interval: %s (at least 1m)", value)
+		}
+		zone.RefreshInterval = int(interval / time.Second)
+	default:
+		return fmt.Errorf("unknown option: %s", key)
+	}
+	return nil
+}
+
+// Remove returns zones without the zone named in fullCommand.
+func Remove(fullCommand []string, zones []config.RPZZone, baseDir string) ([]config.RPZZone, []Message, error) {
+	if cliutil.IsHelpRequest(fullCommand) {
+		return zones, usageRemove(), ErrHelpRequested
+	}
+	if len(fullCommand) != 1 {
+		msgs := append([]Message{{Level: LevelError, Text: "a single zone name is required"}}, usageRemove()...)
+		return zones, msgs, ErrInvalidArgs
+	}
+	name := strings.TrimSuffix(dns.CanonicalName(fullCommand[0]), ".")
+	updated := make([]config.RPZZone, 0, len(zones))
+	for _, existing := range zones {
+		if existing.Name != name {
+			updated = append(updated, existing)
+		}
+	}
+	if len(updated) == len(zones) {
+		msgs := append([]Message{{Level: LevelWarn, Text: fmt.Sprintf("Response policy zone not found: %s", name)}}, usageRemove()...)
+		return zones, msgs, ErrInvalidArgs
+	}
+	return updated, []Message{{Level: LevelInfo, Text: fmt.Sprintf("Removed response policy zone %s", name)}}, nil
+}
+
+func usageAdd() []Message {
+	msgs := []Message{
+		{Level: LevelInfo, Text: "Usage  : rpz add <Name> [file=<File>] [primary=<Host[:Port]>] [refresh=<Duration>]"},
+		{Level: LevelInfo, Text: "Example: rpz add rpz.example.net file=/etc/dnsplane/rpz.example.net.zone"},
+		{Level: LevelInfo, Text: "Example: rpz add threats.rpz.example.net primary=192.0.2.53 refresh=15m"},
+		{Level: LevelInfo, Text: "Zones with a primary are transferred with AXFR and saved to the file (default rpz/<Name>.zone in the config directory). Zones are applied in the order they were added."},
+	}
+	return append(msgs, helpHint())
+}
+
+func usageRemove() []Message {
+	msgs := []Message{
+		{Level: LevelInfo, Text: "Usage  : rpz remove <Name>"},
+		{Level: LevelInfo, Text: "Example: rpz remove rpz.example.net"},
+	}
+	return append(msgs, helpHint())
+}
+
+func helpHint() Message {
+	return Message{Level: LevelInfo, Text: "Hint: append '?', 'help', or 'h' after the command to view this usage."}
+}
@@ -0,0 +1,314 @@
+// Package rpz applies DNS Response Policy Zones: zone files, optionally
+// transferred from a primary, whose records describe which queries to rewrite
+// and how.
+package rpz
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Actions a policy rule takes.
+const (
+	// ActionNXDOMAIN answers that the name does not exist (CNAME .).
+	ActionNXDOMAIN = "NXDOMAIN"
+	// ActionNODATA answers with no records of the type (CNAME *.).
+	ActionNODATA = "NODATA"
+	// ActionPassthru answers normally and stops later zones and blocklists
+	// from rewriting the query (CNAME rpz-passthru.).
+	ActionPassthru = "PASSTHRU"
+	// ActionDrop sends no answer at all (CNAME rpz-drop.).
+	ActionDrop = "DROP"
+	// ActionLocalData answers with the records of the rule, such as a CNAME
+	// to a walled garden.
+	ActionLocalData = "LOCAL-DATA"
+)
+
+// Triggers a rule can match on.
+const (
+	// TriggerQName matches the query name.
+	TriggerQName = "QNAME"
+	// TriggerIP matches addresses in the A and AAAA records of the answer.
+	TriggerIP = "IP"
+	// TriggerNSDName matches the names of name servers in the reply.
+	TriggerNSDName = "NSDNAME"
+)
+
+const (
+	ipSuffix      = "rpz-ip"
+	nsdnameSuffix = "rpz-nsdname"
+)
+
+// Rule is the action for one trigger of a zone.
+type Rule struct {
+	// Owner is the trigger as written in the zone, relative to its origin.
+	Owner  string
+	Action string
+	// Data holds the records of a local data rule. Their owner is the
+	// trigger and is replaced by the query name when answering.
+	Data []dns.RR
+}
+
+// Zone is a parsed response policy zone. It is never modified after Parse.
+type Zone struct {
+	// Name is the policy name, the zone's origin.
+	Name string
+	SOA  *dns.SOA
+
+	qname         map[string]*Rule
+	qnameWildcard map[string]*Rule
+	ns            map[string]*Rule
+	nsWildcard    map[string]*Rule
+	ips           map[int]map[netip.Prefix]*Rule
+	// ipBits holds the prefix lengths in ips, longest first.
+	ipBits []int
+
+	// Rules counts the triggers in use and Skipped the records ignored
+	// because their trigger or action is not supported.
+	Rules   int
+	Skipped int
+}
+
+// Serial returns the serial of the zone's SOA, or 0 without one.
+func (z *Zone) Serial() uint32 {
+	if z == nil || z.SOA == nil {
+		return 0
+	}
+	return z.SOA.Serial
+}
+
+// Parse reads a zone file whose origin is the policy name.
+func Parse(reader io.Reader, name, file string) (*Zone, error) {
+	origin := dns.CanonicalName(name)
+	parser := dns.NewZoneParser(reader, origin, file)
+	var records []dns.RR
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		records = append(records, rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	return FromRecords(records, name)
+}
+
+// FromRecords builds a zone from its records, such as those of a zone
+// transfer.
+func FromRecords(records []dns.RR, name string) (*Zone, error) {
+	origin := dns.CanonicalName(name)
+	zone := &Zone{
+		Name:          strings.TrimSuffix(origin, "."),
+		qname:         make(map[string]*Rule),
+		qnameWildcard: make(map[string]*Rule),
+		ns:            make(map[string]*Rule),
+		nsWildcard:    make(map[string]*Rule),
+		ips:           make(map[int]map[netip.Prefix]*Rule),
+	}
+	// Records of one owner make up one rule, so they are grouped first.
+	owners := make(map[string][]dns.RR)
+	var order []string
+	for _, rr := range records {
+		owner := dns.CanonicalName(rr.Header().Name)
+		if owner == origin {
+			if soa, ok := rr.(*dns.SOA); ok {
+				zone.SOA = soa
+			}
+			continue
+		}
+		if !dns.IsSubDomain(origin, owner) {
+			zone.Skipped++
+			continue
+		}
+		if _, seen := owners[owner]; !seen {
+			order = append(order, owner)
+		}
+		owners[owner] = append(owners[owner], rr)
+	}
+	if zone.SOA == nil {
+		return nil, fmt.Errorf("zone %s has no SOA record", zone.Name)
+	}
+	for _, owner := range order {
+		relative := strings.TrimSuffix(strings.TrimSuffix(owner, origin), ".")
+		rule, ok := newRule(relative, owners[owner])
+		if !ok || !zone.add(rule) {
+			zone.Skipped += len(owners[owner])
+			continue
+		}
+		zone.Rules++
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(zone.ipBits)))
+	return zone, nil
+}
+
+// newRule derives the action of a trigger from its records.
+func newRule(owner string, records []dns.RR) (*Rule, bool) {
+	rule := &Rule{Owner: owner}
+	for _, rr := range records {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			rule.Data = append(rule.Data, rr)
+			continue
+		}
+		switch dns.CanonicalName(cname.Target) {
+		case ".":
+			rule.Action = ActionNXDOMAIN
+		case "*.":
+			rule.Action = ActionNODATA
+		case "rpz-passthru.":
+			rule.Action = ActionPassthru
+		case "rpz-drop.":
+			rule.Action = ActionDrop
+		case "rpz-tcp-only.":
+			return nil, false
+		default:
+			rule.Data = append(rule.Data, rr)
+		}
+		if rule.Action != "" {
+			rule.Data = nil
+			return rule, true
+		}
+	}
+	rule.Action = ActionLocalData
+	return rule, len(rule.Data) > 0
+}
+
+// add files rule under its trigger and reports whether the trigger is
+// supported.
+func (z *Zone) add(rule *Rule) bool {
+	owner := rule.Owner
+	switch {
+	case strings.HasSuffix(owner, "."+ipSuffix):
+		prefix, ok := parseIPTrigger(strings.TrimSuffix(owner, "."+ipSuffix))
+		if !ok {
+			return false
+		}
+		if z.ips[prefix.Bits()] == nil {
+			z.ips[prefix.Bits()] = make(map[netip.Prefix]*Rule)
+			z.ipBits = append(z.ipBits, prefix.Bits())
+		}
+		z.ips[prefix.Bits()][prefix] = rule
+	case strings.HasSuffix(owner, "."+nsdnameSuffix):
+		addName(z.ns, z.nsWildcard, strings.TrimSuffix(owner, "."+nsdnameSuffix), rule)
+	case strings.HasSuffix(owner, ".rpz-client-ip") || strings.HasSuffix(owner, ".rpz-nsip"):
+		// Client IP and name server IP triggers are not supported.
+		return false
+	default:
+		addName(z.qname, z.qnameWildcard, owner, rule)
+	}
+	return true
+}
+
+func addName(exact, wildcard map[string]*Rule, name string, rule *Rule) {
+	if domain, ok := strings.CutPrefix(name, "*."); ok {
+		wildcard[dns.CanonicalName(domain)] = rule
+		return
+	}
+	exact[dns.CanonicalName(name)] = rule
+}
+
+// parseIPTrigger reads the prefix of an rpz-ip trigger, such as
+// 24.0.2.0.192 for 192.0.2.0/24 or 64.zz.db8.2001 for 2001:db8::/64.
+func parseIPTrigger(trigger string) (netip.Prefix, bool) {
+	labels := strings.Split(trigger, ".")
+	if len(labels) < 2 {
+		return netip.Prefix{}, false
+	}
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	parts := labels[1:]
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	text := strings.Join(parts, ".")
+	if !isIPv4Trigger(parts, bits) {
+		// IPv6 groups are written without leading zeros, with a zz label
+		// standing for the longest run of zero groups. Groups left out at
+		// the end are zero.
+		text = strings.Join(parts, ":")
+		for i, part := range parts {
+			if part == "zz" {
+				text = strings.Join(parts[:i], ":") + "::" + strings.Join(parts[i+1:], ":")
+				break
+			}
+		}
+		if !strings.Contains(text, "::") && len(parts) < 8 {
+			text += "::"
+		}
+	}
+	addr, err := netip.ParseAddr(text)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil || prefix.Addr() != addr {
+		return netip.Prefix{}, false
+	}
+	return prefix, true
+}
+
+// isIPv4Trigger reports whether the labels of an rpz-ip trigger, in address
+// order, are the four decimal octets of an IPv4 prefix. Anything else, such
+// as 2001.db8.0.0 for 2001:db8::/48, is read as IPv6.
+func isIPv4Trigger(parts []string, bits int) bool {
+	if len(parts) != 4 || bits > 32 {
+		return false
+	}
+	for _, part := range parts {
+		if _, err := strconv.ParseUint(part, 10, 8); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// matchName returns the rule for name, preferring an exact trigger and then
+// the closest wildcard, which only matches names below its domain.
+func matchName(exact, wildcard map[string]*Rule, name string) (*Rule, bool) {
+	if rule, ok := exact[name]; ok {
+		return rule, true
+	}
+	if len(wildcard) == 0 {
+		return nil, false
+	}
+	for offset, end := dns.NextLabel(name, 0); !end; offset, end = dns.NextLabel(name, offset) {
+		if rule, ok := wildcard[name[offset:]]; ok {
+			return rule, true
+		}
+	}
+	return nil, false
+}
+
+// matchQName returns the rule for a query name.
+func (z *Zone) matchQName(name string) (*Rule, bool) {
+	return matchName(z.qname, z.qnameWildcard, name)
+}
+
+// matchNS returns the rule for a name server name.
+func (z *Zone) matchNS(name string) (*Rule, bool) {
+	return matchName(z.ns, z.nsWildcard, name)
+}
+
+// matchIP returns the rule with the longest prefix containing addr.
+func (z *Zone) matchIP(addr netip.Addr) (*Rule, netip.Prefix, bool) {
+	addr = addr.Unmap()
+	for _, bits := range z.ipBits {
+		if bits > addr.BitLen() {
+			continue
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if rule, ok := z.ips[bits][prefix]; ok {
+			return rule, prefix, true
+		}
+	}
+	return nil, netip.Prefix{}, false
+}
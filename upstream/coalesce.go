@@ -0,0 +1,57 @@
+package upstream
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Coalescer deduplicates identical resolutions that are in flight at the same
+// time, so that a burst of clients asking for one name causes a single round
+// of upstream queries.
+type Coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done  chan struct{}
+	reply *dns.Msg
+}
+
+// NewCoalescer returns an empty Coalescer.
+func NewCoalescer() *Coalescer {
+	return &Coalescer{calls: make(map[string]*flight)}
+}
+
+// Do calls resolve for key unless a resolution for the same key is already
+// running, in which case it waits for that one instead. Callers that waited
+// get their own copy of the reply and shared set to true.
+func (c *Coalescer) Do(key string, resolve func() *dns.Msg) (reply *dns.Msg, shared bool) {
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		if call.reply == nil {
+			return nil, true
+		}
+		return call.reply.Copy(), true
+	}
+	call := &flight{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	call.reply = resolve()
+	// Waiters copy the reply, so the caller's copy must not change until
+	// they are done with it.
+	if call.reply != nil {
+		return call.reply.Copy(), false
+	}
+	return nil, false
+}
@@ -0,0 +1,171 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// HealthState describes whether an upstream is currently in rotation.
+type HealthState string
+
+// Health states reported by HealthChecker.
+const (
+	HealthUnknown   HealthState = "unknown"
+	HealthHealthy   HealthState = "healthy"
+	HealthUnhealthy HealthState = "unhealthy"
+)
+
+// DefaultFailureThreshold is the number of consecutive failures that takes a
+// server out of rotation.
+const DefaultFailureThreshold = 3
+
+// Health is the tracked status of a single upstream server.
+type Health struct {
+	State       HealthState
+	Failures    int
+	LastRTT     time.Duration
+	LastUsed    time.Time
+	LastSuccess time.Time
+	LastError   string
+}
+
+// HealthChecker tracks upstream health from probes and live queries. It acts
+// as a circuit breaker: after a run of consecutive failures a server is taken
+// out of rotation until a probe or query succeeds again.
+type HealthChecker struct {
+	probe ExchangeFunc
+
+	mu        sync.RWMutex
+	threshold int
+	status    map[string]*Health
+	onChange  func(server string, from, to HealthState)
+}
+
+// NewHealthChecker builds a checker that probes servers with probe.
+func NewHealthChecker(probe ExchangeFunc) *HealthChecker {
+	return &HealthChecker{
+		probe:     probe,
+		threshold: DefaultFailureThreshold,
+		status:    make(map[string]*Health),
+	}
+}
+
+// SetFailureThreshold sets how many consecutive failures open the circuit.
+func (h *HealthChecker) SetFailureThreshold(threshold int) {
+	if threshold <= 0 {
+		threshold = DefaultFailureThreshold
+	}
+	h.mu.Lock()
+	h.threshold = threshold
+	h.mu.Unlock()
+}
+
+// OnChange registers a callback invoked whenever a server changes state.
+func (h *HealthChecker) OnChange(fn func(server string, from, to HealthState)) {
+	h.mu.Lock()
+	h.onChange = fn
+	h.mu.Unlock()
+}
+
+// Record folds the outcome of a query or probe into the server's health.
+func (h *HealthChecker) Record(server string, rtt time.Duration, err error) {
+	now := time.Now()
+	h.mu.Lock()
+	health, ok := h.status[server]
+	if !ok {
+		health = &Health{State: HealthUnknown}
+		h.status[server] = health
+	}
+	from := health.State
+	health.LastUsed = now
+	if err != nil {
+		health.Failures++
+		health.LastError = err.Error()
+		if health.Failures >= h.threshold {
+			health.State = HealthUnhealthy
+		}
+	} else {
+		health.Failures = 0
+		health.LastError = ""
+		health.LastRTT = rtt
+		health.LastSuccess = now
+		health.State = HealthHealthy
+	}
+	to := health.State
+	notify := h.onChange
+	h.mu.Unlock()
+
+	if notify != nil && from != to {
+		notify(server, from, to)
+	}
+}
+
+// Status returns the tracked health of server.
+func (h *HealthChecker) Status(server string) (Health, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	health, ok := h.status[server]
+	if !ok {
+		return Health{State: HealthUnknown}, false
+	}
+	return *health, true
+}
+
+// Available filters out servers whose circuit is open.
+func (h *HealthChecker) Available(servers []Server) []Server {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	available := make([]Server, 0, len(servers))
+	for _, server := range servers {
+		if health, ok := h.status[server.String()]; ok && health.State == HealthUnhealthy {
+			continue
+		}
+		available = append(available, server)
+	}
+	return available
+}
+
+// Probe sends a health probe to every server in parallel and records the
+// outcome. Any reply counts as success; only transport errors count as
+// failures.
+func (h *HealthChecker) Probe(servers []Server) {
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server Server) {
+			defer wg.Done()
+			if server.Timeout <= 0 {
+				server.Timeout = DefaultTimeout
+			}
+			message := new(dns.Msg)
+			message.SetQuestion(".", dns.TypeNS)
+			start := time.Now()
+			_, err := h.probe(message, server)
+			h.Record(server.String(), time.Since(start), err)
+		}(server)
+	}
+	wg.Wait()
+}
+
+// Run probes the servers returned by servers every interval until stop is
+// closed. after, when set, is called once each round has completed.
+func (h *HealthChecker) Run(stop <-chan struct{}, interval time.Duration, servers func() []Server, after func()) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		h.Probe(servers())
+		if after != nil {
+			after()
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"dnsplane/edns"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// Transport protocols an upstream can be reached over.
+const (
+	ProtocolUDP   = "udp"
+	ProtocolTCP   = "tcp"
+	ProtocolTLS   = "tls"
+	ProtocolHTTPS = "https"
+	ProtocolQUIC  = "quic"
+)
+
+// Protocols lists every supported upstream transport.
+var Protocols = []string{ProtocolUDP, ProtocolTCP, ProtocolTLS, ProtocolHTTPS, ProtocolQUIC}
+
+// IsValidProtocol reports whether protocol is a supported transport. The empty
+// string stands for plain UDP.
+func IsValidProtocol(protocol string) bool {
+	if protocol == "" {
+		return true
+	}
+	for _, candidate := range Protocols {
+		if candidate == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// Exchange sends message to server over the server's transport and returns
+// the reply. Plain UDP replies with the TC bit set are retried over TCP, and
+// servers that reject EDNS0 with FORMERR are asked again without the OPT
+// record.
+func Exchange(message *dns.Msg, server Server) (*dns.Msg, error) {
+	if server.Timeout <= 0 {
+		server.Timeout = DefaultTimeout
+	}
+	response, err := exchange(message, server)
+	if err == nil && response.Rcode == dns.RcodeFormatError && message.IsEdns0() != nil && response.IsEdns0() == nil {
+		response, err = exchange(edns.StripOPT(message), server)
+	}
+	return response, err
+}
+
+func exchange(message *dns.Msg, server Server) (*dns.Msg, error) {
+	switch server.Protocol {
+	case "", ProtocolUDP:
+		client := &dns.Client{Timeout: server.Timeout}
+		response, _, err := client.Exchange(message, server.Address)
+		if err == nil && response.Truncated {
+			client.Net = "tcp"
+			response, _, err = client.Exchange(message, server.Address)
+		}
+		return response, err
+	case ProtocolTCP:
+		client := &dns.Client{Net: "tcp", Timeout: server.Timeout}
+		response, _, err := client.Exchange(message, server.Address)
+		return response, err
+	case ProtocolTLS:
+		client := &dns.Client{Net: "tcp-tls", Timeout: server.Timeout, TLSConfig: clientTLSConfig(server)}
+		response, _, err := client.Exchange(message, server.Address)
+		return response, err
+	case ProtocolHTTPS:
+		return exchangeHTTPS(message, server)
+	case ProtocolQUIC:
+		return exchangeQUIC(message, server)
+	default:
+		return nil, fmt.Errorf("unsupported upstream protocol: %s", server.Protocol)
+	}
+}
+
+func clientTLSConfig(server Server, nextProtos ...string) *tls.Config {
+	serverName := server.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(server.Address)
+	}
+	return &tls.Config{ServerName: serverName, NextProtos: nextProtos, MinVersion: tls.VersionTLS12}
+}
+
+// httpClients caches one client per TLS server name so that DoH connections
+// are kept alive between queries.
+var httpClients sync.Map
+
+func httpClientFor(server Server) *http.Client {
+	key := server.ServerName + "|" + server.Address
+	if client, ok := httpClients.Load(key); ok {
+		return client.(*http.Client)
+	}
+	transport := &http.Transport{
+		TLSClientConfig:   clientTLSConfig(server),
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   90 * time.Second,
+	}
+	client, _ := httpClients.LoadOrStore(key, &http.Client{Transport: transport})
+	return client.(*http.Client)
+}
+
+// exchangeHTTPS sends message as an RFC 8484 POST request.
+func exchangeHTTPS(message *dns.Msg, server Server) (*dns.Msg, error) {
+	query := message.Copy()
+	query.Id = 0
+	wire, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), server.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, bytes.NewReader(wire))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+
+	response, err := httpClientFor(server).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh upstream %s: %s", server.URL, response.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	reply := new(dns.Msg)
+	if err := reply.Unpack(body); err != nil {
+		return nil, err
+	}
+	reply.Id = message.Id
+	return reply, nil
+}
+
+// quicConns caches one connection per DoQ upstream, and quicDials holds the
+// dials in progress so that concurrent queries to a server share one.
+var (
+	quicMu    sync.Mutex
+	quicConns = make(map[string]*quic.Conn)
+	quicDials = make(map[string]*quicDial)
+)
+
+// quicDial is a connection attempt that other queries can wait for.
+type quicDial struct {
+	done chan struct{}
+	conn *quic.Conn
+	err  error
+}
+
+// quicConnFor returns the cached connection to server, dialling it when there
+// is none. quicMu is only held to look up and store connections, so a slow or
+// unreachable server never holds up queries to the others.
+func quicConnFor(ctx context.Context, server Server) (*quic.Conn, error) {
+	key := server.ServerName + "|" + server.Address
+	quicMu.Lock()
+	if conn, ok := quicConns[key]; ok {
+		if conn.Context().Err() == nil {
+			quicMu.Unlock()
+			return conn, nil
+		}
+		delete(quicConns, key)
+	}
+	dial, dialing := quicDials[key]
+	if !dialing {
+		dial = &quicDial{done: make(chan struct{})}
+		quicDials[key] = dial
+	}
+	quicMu.Unlock()
+
+	if dialing {
+		select {
+		case <-dial.done:
+			return dial.conn, dial.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	dial.conn, dial.err = quic.DialAddr(ctx, server.Address, clientTLSConfig(server, "doq"), &quic.Config{
+		MaxIdleTimeout: 30 * time.Second,
+	})
+	quicMu.Lock()
+	delete(quicDials, key)
+	if dial.err == nil {
+		quicConns[key] = dial.conn
+	}
+	quicMu.Unlock()
+	close(dial.done)
+	return dial.conn, dial.err
+}
+
+// exchangeQUIC sends message as an RFC 9250 query on a new stream of a shared
+// connection.
+func exchangeQUIC(message *dns.Msg, server Server) (*dns.Msg, error) {
+	query := message.Copy()
+	query.Id = 0
+	wire, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), server.Timeout)
+	defer cancel()
+
+	conn, err := quicConnFor(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	out := make([]byte, 2+len(wire))
+	binary.BigEndian.PutUint16(out, uint16(len(wire)))
+	copy(out[2:], wire)
+	if _, err := stream.Write(out); err != nil {
+		return nil, err
+	}
+	// Closing the send side tells the server the query is complete.
+	_ = stream.Close()
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(stream, body); err != nil {
+		return nil, err
+	}
+	reply := new(dns.Msg)
+	if err := reply.Unpack(body); err != nil {
+		return nil, err
+	}
+	if reply.Id != 0 {
+		return nil, errors.New("doq upstream replied with a non-zero message id")
+	}
+	reply.Id = message.Id
+	return reply, nil
+}
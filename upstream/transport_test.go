@@ -0,0 +1,86 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blackhole returns the address of a UDP socket that never answers, so QUIC
+// dials to it last until their context ends.
+func blackhole(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+func TestQUICDialDoesNotBlockOtherServers(t *testing.T) {
+	slow := Server{Address: blackhole(t), Protocol: ProtocolQUIC, ServerName: "slow.test"}
+	other := Server{Address: blackhole(t), Protocol: ProtocolQUIC, ServerName: "other.test"}
+
+	slowCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	dialing := make(chan struct{})
+	go func() {
+		close(dialing)
+		_, _ = quicConnFor(slowCtx, slow)
+	}()
+	<-dialing
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancelOther := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelOther()
+	start := time.Now()
+	if _, err := quicConnFor(ctx, other); err == nil {
+		t.Fatal("dial to a silent server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dial waited %s for the dial to another server", elapsed)
+	}
+}
+
+func TestQUICDialIsShared(t *testing.T) {
+	server := Server{Address: blackhole(t), Protocol: ProtocolQUIC, ServerName: "shared.test"}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := quicConnFor(ctx, server)
+			errs <- err
+		}()
+	}
+	key := server.ServerName + "|" + server.Address
+	time.Sleep(50 * time.Millisecond)
+	quicMu.Lock()
+	_, dialing := quicDials[key]
+	quicMu.Unlock()
+	if !dialing {
+		t.Error("no dial in progress")
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err == nil {
+			t.Error("dial to a silent server succeeded")
+		}
+	}
+	quicMu.Lock()
+	defer quicMu.Unlock()
+	if _, ok := quicDials[key]; ok {
+		t.Error("failed dial is still in progress")
+	}
+	if _, ok := quicConns[key]; ok {
+		t.Error("failed dial left a connection behind")
+	}
+}
@@ -0,0 +1,343 @@
+// Package upstream selects the upstream DNS servers a query is forwarded to
+// and collects their replies according to a configurable strategy.
+package upstream
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Strategy names accepted in the configuration.
+const (
+	StrategyAuthoritativeFirst = "authoritative-first"
+	StrategyFastest            = "fastest"
+	StrategySequential         = "sequential"
+	StrategyRoundRobin         = "round-robin"
+	StrategyLowestLatency      = "lowest-latency"
+)
+
+// DefaultStrategy is used when no strategy is configured.
+const DefaultStrategy = StrategyAuthoritativeFirst
+
+// Strategies lists every supported strategy in display order.
+var Strategies = []string{
+	StrategyAuthoritativeFirst,
+	StrategyFastest,
+	StrategySequential,
+	StrategyRoundRobin,
+	StrategyLowestLatency,
+}
+
+// Reply ranks used to compare upstream responses.
+const (
+	RankFailure = iota + 1
+	RankNegative
+	RankAnswer
+)
+
+// DefaultTimeout bounds a single exchange when a server has no timeout set.
+const DefaultTimeout = 2 * time.Second
+
+// Server is an upstream target together with its query options.
+type Server struct {
+	// Address is the host:port the server is reached at.
+	Address string
+	// Timeout bounds a single exchange with the server.
+	Timeout time.Duration
+	// Retries is the number of additional attempts after a failed exchange.
+	Retries int
+	// Protocol is the transport, one of Protocols; empty means UDP.
+	Protocol string
+	// ServerName is the TLS name verified for tls, https and quic servers.
+	ServerName string
+	// URL is the DNS-over-HTTPS endpoint for https servers.
+	URL string
+}
+
+// String identifies the server in logs and health tracking, e.g.
+// "1.1.1.1:53", "tls://1.1.1.1:853" or "https://dns.example/dns-query".
+func (s Server) String() string {
+	switch s.Protocol {
+	case "", ProtocolUDP:
+		return s.Address
+	case ProtocolHTTPS:
+		return s.URL
+	default:
+		return s.Protocol + "://" + s.Address
+	}
+}
+
+// ExchangeFunc sends message to server and returns the reply. Implementations
+// must honour server.Timeout.
+type ExchangeFunc func(message *dns.Msg, server Server) (*dns.Msg, error)
+
+// Result is the outcome of forwarding a query with Resolve.
+type Result struct {
+	// Answer is the selected reply, or nil when no reply satisfied the strategy.
+	Answer *dns.Msg
+	// Server is the upstream that produced Answer.
+	Server Server
+	// Replies holds every reply that was received but not selected.
+	Replies []*dns.Msg
+}
+
+// Resolver forwards queries to upstream servers and tracks their latency.
+type Resolver struct {
+	exchange ExchangeFunc
+	next     atomic.Uint64
+	health   atomic.Pointer[HealthChecker]
+
+	rttMu sync.RWMutex
+	rtt   map[string]time.Duration
+}
+
+// NewResolver builds a Resolver that uses exchange to talk to servers.
+func NewResolver(exchange ExchangeFunc) *Resolver {
+	return &Resolver{exchange: exchange, rtt: make(map[string]time.Duration)}
+}
+
+// SetHealthChecker attaches a checker that is fed with the outcome of every
+// query and used to skip servers whose circuit is open.
+func (r *Resolver) SetHealthChecker(health *HealthChecker) {
+	r.health.Store(health)
+}
+
+// IsValidStrategy reports whether name is a supported strategy.
+func IsValidStrategy(name string) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, strategy := range Strategies {
+		if strategy == name {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeStrategy returns the canonical strategy name, falling back to
+// DefaultStrategy for empty or unknown values.
+func NormalizeStrategy(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if IsValidStrategy(name) {
+		return name
+	}
+	return DefaultStrategy
+}
+
+// Rank orders upstream replies: answers beat negative replies (NXDOMAIN or
+// NODATA), which beat failures such as SERVFAIL or REFUSED.
+func Rank(msg *dns.Msg) int {
+	switch {
+	case msg == nil:
+		return 0
+	case msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0:
+		return RankAnswer
+	case msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError:
+		return RankNegative
+	default:
+		return RankFailure
+	}
+}
+
+// Best returns the highest ranked reply, preferring earlier ones on ties.
+func Best(replies []*dns.Msg) *dns.Msg {
+	var best *dns.Msg
+	for _, reply := range replies {
+		if reply != nil && Rank(reply) > Rank(best) {
+			best = reply
+		}
+	}
+	return best
+}
+
+// Resolve forwards message to servers using the named strategy. A non-zero
+// deadline bounds the whole resolution: exchanges are shortened to fit and
+// servers are not tried once it has passed.
+func (r *Resolver) Resolve(strategy string, message *dns.Msg, servers []Server, deadline time.Time) Result {
+	if health := r.health.Load(); health != nil {
+		servers = health.Available(servers)
+	}
+	if len(servers) == 0 {
+		return Result{}
+	}
+	switch NormalizeStrategy(strategy) {
+	case StrategyFastest:
+		return r.fanOut(message, servers, deadline, isUsable)
+	case StrategySequential:
+		return r.sequential(message, servers, deadline)
+	case StrategyRoundRobin:
+		return r.sequential(message, r.rotate(servers), deadline)
+	case StrategyLowestLatency:
+		return r.sequential(message, r.byLatency(servers), deadline)
+	default:
+		return r.fanOut(message, servers, deadline, func(reply *dns.Msg) bool {
+			return reply.Authoritative && isUsable(reply)
+		})
+	}
+}
+
+// Query sends message to a single server, applying its retries and the
+// deadline, and records the outcome for latency and health tracking.
+func (r *Resolver) Query(message *dns.Msg, server Server, deadline time.Time) (*dns.Msg, error) {
+	return r.query(message, server, deadline)
+}
+
+// RTT returns the smoothed round-trip time measured for server.
+func (r *Resolver) RTT(server string) (time.Duration, bool) {
+	r.rttMu.RLock()
+	defer r.rttMu.RUnlock()
+	rtt, ok := r.rtt[server]
+	return rtt, ok
+}
+
+func isUsable(reply *dns.Msg) bool {
+	return Rank(reply) > RankFailure
+}
+
+type reply struct {
+	server Server
+	msg    *dns.Msg
+}
+
+// fanOut queries every server in parallel and returns the first reply
+// accepted by accept. Remaining queries finish in the background.
+func (r *Resolver) fanOut(message *dns.Msg, servers []Server, deadline time.Time, accept func(*dns.Msg) bool) Result {
+	replies := make(chan reply, len(servers))
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server Server, message *dns.Msg) {
+			defer wg.Done()
+			if msg, _ := r.query(message, server, deadline); msg != nil {
+				replies <- reply{server: server, msg: msg}
+			}
+		}(server, message.Copy())
+	}
+	go func() {
+		wg.Wait()
+		close(replies)
+	}()
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var result Result
+	for {
+		select {
+		case rep, ok := <-replies:
+			if !ok {
+				return result
+			}
+			if accept(rep.msg) {
+				result.Answer = rep.msg
+				result.Server = rep.server
+				return result
+			}
+			result.Replies = append(result.Replies, rep.msg)
+		case <-expired:
+			return result
+		}
+	}
+}
+
+// sequential queries servers one at a time in order and returns the first
+// usable reply.
+func (r *Resolver) sequential(message *dns.Msg, servers []Server, deadline time.Time) Result {
+	var result Result
+	for _, server := range servers {
+		msg, _ := r.query(message.Copy(), server, deadline)
+		if msg == nil {
+			continue
+		}
+		if isUsable(msg) {
+			result.Answer = msg
+			result.Server = server
+			return result
+		}
+		result.Replies = append(result.Replies, msg)
+	}
+	return result
+}
+
+// errDeadlineExceeded is returned when the query deadline passes before an
+// exchange could be attempted.
+var errDeadlineExceeded = errors.New("query deadline exceeded")
+
+func (r *Resolver) query(message *dns.Msg, server Server, deadline time.Time) (*dns.Msg, error) {
+	if server.Timeout <= 0 {
+		server.Timeout = DefaultTimeout
+	}
+	var (
+		msg *dns.Msg
+		err error
+	)
+	start := time.Now()
+	for attempt := 0; attempt <= server.Retries; attempt++ {
+		attemptServer := server
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				if err == nil {
+					err = errDeadlineExceeded
+				}
+				break
+			}
+			if remaining < attemptServer.Timeout {
+				attemptServer.Timeout = remaining
+			}
+		}
+		msg, err = r.exchange(message, attemptServer)
+		if err == nil {
+			break
+		}
+	}
+	elapsed := time.Since(start)
+	r.recordRTT(server.String(), elapsed)
+	if health := r.health.Load(); health != nil {
+		health.Record(server.String(), elapsed, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// recordRTT folds a new sample into the server's moving average. Failed
+// queries are recorded too, so slow or unreachable servers sink in the
+// lowest-latency ordering.
+func (r *Resolver) recordRTT(server string, sample time.Duration) {
+	r.rttMu.Lock()
+	defer r.rttMu.Unlock()
+	if previous, ok := r.rtt[server]; ok {
+		sample = (previous*7 + sample) / 8
+	}
+	r.rtt[server] = sample
+}
+
+func (r *Resolver) rotate(servers []Server) []Server {
+	start := int((r.next.Add(1) - 1) % uint64(len(servers)))
+	ordered := make([]Server, 0, len(servers))
+	ordered = append(ordered, servers[start:]...)
+	return append(ordered, servers[:start]...)
+}
+
+// byLatency orders servers by measured RTT. Servers without measurements are
+// tried first so that they get one.
+func (r *Resolver) byLatency(servers []Server) []Server {
+	ordered := append([]Server(nil), servers...)
+	r.rttMu.RLock()
+	defer r.rttMu.RUnlock()
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return r.rtt[ordered[i].String()] < r.rtt[ordered[j].String()]
+	})
+	return ordered
+}
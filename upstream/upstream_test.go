@@ -0,0 +1,229 @@
+package upstream
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testServer is a loopback upstream with a fixed behaviour.
+type testServer struct {
+	// answer is the A record returned for every query.
+	answer        string
+	delay         time.Duration
+	authoritative bool
+	rcode         int
+
+	// drop makes the server read queries without ever replying.
+	drop    atomic.Bool
+	queries atomic.Int32
+}
+
+func (s *testServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.queries.Add(1)
+	if s.drop.Load() {
+		return
+	}
+	time.Sleep(s.delay)
+	m := new(dns.Msg)
+	m.SetRcode(r, s.rcode)
+	m.Authoritative = s.authoritative
+	if s.rcode == dns.RcodeSuccess {
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A " + s.answer)
+		m.Answer = append(m.Answer, rr)
+	}
+	_ = w.WriteMsg(m)
+}
+
+// start serves s on a loopback UDP port until the test ends.
+func (s *testServer) start(t *testing.T) Server {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: s, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return Server{Address: conn.LocalAddr().String(), Timeout: time.Second}
+}
+
+func startServers(t *testing.T, servers ...*testServer) []Server {
+	t.Helper()
+	started := make([]Server, len(servers))
+	for i, s := range servers {
+		started[i] = s.start(t)
+	}
+	return started
+}
+
+func answerOf(t *testing.T, result Result) string {
+	t.Helper()
+	if result.Answer == nil {
+		t.Fatal("no answer selected")
+	}
+	if len(result.Answer.Answer) == 0 {
+		return dns.RcodeToString[result.Answer.Rcode]
+	}
+	return result.Answer.Answer[0].(*dns.A).A.String()
+}
+
+func query() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.test.", dns.TypeA)
+	return m
+}
+
+func TestResolveStrategies(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		servers  []*testServer
+		want     string
+	}{
+		{
+			name:     "authoritative-first waits for the authoritative reply",
+			strategy: StrategyAuthoritativeFirst,
+			servers: []*testServer{
+				{answer: "192.0.2.1"},
+				{answer: "192.0.2.2", authoritative: true, delay: 100 * time.Millisecond},
+			},
+			want: "192.0.2.2",
+		},
+		{
+			name:     "authoritative-first skips an authoritative failure",
+			strategy: StrategyAuthoritativeFirst,
+			servers: []*testServer{
+				{rcode: dns.RcodeServerFailure, authoritative: true},
+				{answer: "192.0.2.2", authoritative: true, delay: 50 * time.Millisecond},
+			},
+			want: "192.0.2.2",
+		},
+		{
+			name:     "fastest takes the first usable reply",
+			strategy: StrategyFastest,
+			servers: []*testServer{
+				{answer: "192.0.2.1", authoritative: true, delay: 100 * time.Millisecond},
+				{answer: "192.0.2.2"},
+			},
+			want: "192.0.2.2",
+		},
+		{
+			name:     "fastest skips a quicker failure",
+			strategy: StrategyFastest,
+			servers: []*testServer{
+				{rcode: dns.RcodeRefused},
+				{answer: "192.0.2.2", delay: 50 * time.Millisecond},
+			},
+			want: "192.0.2.2",
+		},
+		{
+			name:     "sequential keeps the configured order",
+			strategy: StrategySequential,
+			servers: []*testServer{
+				{rcode: dns.RcodeServerFailure},
+				{answer: "192.0.2.2", delay: 50 * time.Millisecond},
+				{answer: "192.0.2.3", authoritative: true},
+			},
+			want: "192.0.2.2",
+		},
+		{
+			name:     "negative replies are usable",
+			strategy: StrategySequential,
+			servers: []*testServer{
+				{rcode: dns.RcodeNameError},
+				{answer: "192.0.2.2"},
+			},
+			want: "NXDOMAIN",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := startServers(t, tt.servers...)
+			result := NewResolver(Exchange).Resolve(tt.strategy, query(), servers, time.Time{})
+			if got := answerOf(t, result); got != tt.want {
+				t.Errorf("answer = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveRoundRobin(t *testing.T) {
+	servers := startServers(t,
+		&testServer{answer: "192.0.2.1"},
+		&testServer{answer: "192.0.2.2"},
+		&testServer{answer: "192.0.2.3"},
+	)
+	resolver := NewResolver(Exchange)
+	for i, want := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.1"} {
+		result := resolver.Resolve(StrategyRoundRobin, query(), servers, time.Time{})
+		if got := answerOf(t, result); got != want {
+			t.Errorf("query %d answer = %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestResolveLowestLatency(t *testing.T) {
+	servers := startServers(t,
+		&testServer{answer: "192.0.2.1", delay: 50 * time.Millisecond},
+		&testServer{answer: "192.0.2.2"},
+	)
+	resolver := NewResolver(Exchange)
+	for _, server := range servers {
+		if _, err := resolver.Query(query(), server, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	slow, _ := resolver.RTT(servers[0].String())
+	fast, _ := resolver.RTT(servers[1].String())
+	if fast >= slow {
+		t.Fatalf("RTT of the fast server %s is not below the slow one %s", fast, slow)
+	}
+	result := resolver.Resolve(StrategyLowestLatency, query(), servers, time.Time{})
+	if got := answerOf(t, result); got != "192.0.2.2" {
+		t.Errorf("answer = %s, want 192.0.2.2", got)
+	}
+}
+
+func TestHealthCheckerSkipsFailingServer(t *testing.T) {
+	dead := &testServer{answer: "192.0.2.1"}
+	dead.drop.Store(true)
+	good := &testServer{answer: "192.0.2.2"}
+	servers := startServers(t, dead, good)
+	servers[0].Timeout = 50 * time.Millisecond
+
+	health := NewHealthChecker(Exchange)
+	health.SetFailureThreshold(2)
+	resolver := NewResolver(Exchange)
+	resolver.SetHealthChecker(health)
+
+	for i := 0; i < 3; i++ {
+		result := resolver.Resolve(StrategySequential, query(), servers, time.Time{})
+		if got := answerOf(t, result); got != "192.0.2.2" {
+			t.Fatalf("query %d answer = %s, want 192.0.2.2", i, got)
+		}
+	}
+	if got := dead.queries.Load(); got != 2 {
+		t.Errorf("failing server got %d queries, want 2 before its circuit opened", got)
+	}
+	if status, _ := health.Status(servers[0].String()); status.State != HealthUnhealthy {
+		t.Errorf("failing server state = %v, want %v", status.State, HealthUnhealthy)
+	}
+	if status, _ := health.Status(servers[1].String()); status.State != HealthHealthy {
+		t.Errorf("good server state = %v, want %v", status.State, HealthHealthy)
+	}
+
+	// A successful probe closes the circuit again.
+	dead.drop.Store(false)
+	health.Probe(servers[:1])
+	result := resolver.Resolve(StrategySequential, query(), servers, time.Time{})
+	if got := answerOf(t, result); got != "192.0.2.1" {
+		t.Errorf("answer after recovery = %s, want 192.0.2.1", got)
+	}
+}